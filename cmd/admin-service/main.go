@@ -1,14 +1,89 @@
 package main
 
 import (
-	"fmt"
-	"taxi-hailing/config"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/broker"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/metrics"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/intenal/server"
+	"taxi-hailing/intenal/service"
+	"taxi-hailing/pkg"
+	"time"
 )
 
+const shutdownTimeout = 15 * time.Second
+
 func main() {
-	cfg, err := config.LoadConfig()
+	slogger := pkg.CustomSlog("admin-service")
+	cfg, err := pkg.ParseConfig()
+	if err != nil {
+		slogger.Error("cannot parse config", "action", "parse config", "error", err)
+		os.Exit(1)
+	}
+	shutdownTracing, err := pkg.InitTracing(context.Background(), "admin-service", cfg.TracingCfg)
+	if err != nil {
+		slogger.Error("cannot init tracing", "action", "init tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	pool, err := pkg.NewDB(context.Background(), &cfg.DatabaseCfg)
+	if err != nil {
+		slogger.Error("cannot create connection to db", "action", "connect to db", "error", err)
+		os.Exit(1)
+	}
+	defer pool.Close()
+	err = metrics.RegisterPool(pool)
+	if err != nil {
+		slogger.Error("cannot register db pool metrics", "action", "register metrics", "error", err)
+		os.Exit(1)
+	}
+	db := repo.NewAdminRepo(pool)
+	rabbit := broker.NewAdminRabbit(cfg.RabbitMQCfg, slogger)
+	// background watchers live until shutdown
+	appCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	myService := service.NewAdminService(slogger, db, rabbit)
+	keys := jwks.NewRemote(appCtx, slogger, cfg.JWTCfg.JWKSURL)
+	auth := service.NewAuthService(appCtx, slogger, repo.NewSessionRepo(pool), service.TokenConfig{
+		Keys:     keys,
+		Issuer:   cfg.JWTCfg.Issuer,
+		Audience: authz.AudienceAdmin,
+	})
+	// rabbit is only needed by the dead letter endpoints and connects lazily, so it is not a readiness check
+	myServer := server.NewAdminServer(cfg.AdminService, auth, myService,
+		server.HealthCheck{Name: "postgres", Check: pool.Ping},
+		server.HealthCheck{Name: "jwks", Check: keys.Ready},
+	)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		slogger.Info("starting the server", "action", "start the server", "port", cfg.AdminService)
+		err := myServer.StartServer()
+		slogger.Error("server stopped", "error", err)
+		quit <- nil
+	}()
+	sig := <-quit
+	slogger.Info("shutting down", "action", "shutdown", "signal", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// stop accepting requests and wait for in-flight ones
+	err = myServer.ShutDownServer(ctx)
+	if err != nil {
+		slogger.Error("cannot shutdown the server", "action", "shutdown", "error", err)
+	}
+	stop()
+	err = rabbit.CloseRabbit()
 	if err != nil {
-		fmt.Println(err)
+		slogger.Error("cannot close rabbitMQ", "action", "shutdown", "error", err)
 	}
-	fmt.Println(*cfg)
 }
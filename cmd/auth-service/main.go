@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/metrics"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/intenal/server"
+	"taxi-hailing/intenal/service"
+	"taxi-hailing/pkg"
+	"time"
+)
+
+const shutdownTimeout = 15 * time.Second
+
+func main() {
+	slogger := pkg.CustomSlog("auth-service")
+	cfg, err := pkg.ParseConfig()
+	if err != nil {
+		slogger.Error("cannot parse config", "action", "parse config", "error", err)
+		os.Exit(1)
+	}
+	shutdownTracing, err := pkg.InitTracing(context.Background(), "auth-service", cfg.TracingCfg)
+	if err != nil {
+		slogger.Error("cannot init tracing", "action", "init tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	pool, err := pkg.NewDB(context.Background(), &cfg.DatabaseCfg)
+	if err != nil {
+		slogger.Error("cannot create connection to db", "action", "connect to db", "error", err)
+		os.Exit(1)
+	}
+	defer pool.Close()
+	err = metrics.RegisterPool(pool)
+	if err != nil {
+		slogger.Error("cannot register db pool metrics", "action", "register metrics", "error", err)
+		os.Exit(1)
+	}
+
+	appCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	keys, err := jwks.NewKeyRing(appCtx, slogger, cfg.JWTCfg.KeysDir)
+	if err != nil {
+		slogger.Error("cannot load signing keys", "action", "load signing keys", "error", err)
+		os.Exit(1)
+	}
+	auth := service.NewAuthService(appCtx, slogger, repo.NewSessionRepo(pool), service.TokenConfig{
+		Keys:     keys,
+		Signer:   keys,
+		Issuer:   cfg.JWTCfg.Issuer,
+		Audience: authz.AudienceAuth,
+		Secret:   []byte(cfg.ServicesCfg.Secret),
+	})
+	users := service.NewUserService(slogger, repo.NewUserRepo(pool), auth)
+	myServer := server.NewAuthServer(cfg.ServicesCfg.AuthService, auth, users, keys,
+		server.HealthCheck{Name: "postgres", Check: pool.Ping},
+	)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		slogger.Info("starting the server", "action", "start the server", "port", cfg.ServicesCfg.AuthService)
+		err := myServer.StartServer()
+		slogger.Error("server stopped", "error", err)
+		quit <- nil
+	}()
+	sig := <-quit
+	slogger.Info("shutting down", "action", "shutdown", "signal", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = myServer.ShutDownServer(ctx)
+	if err != nil {
+		slogger.Error("cannot shutdown the server", "action", "shutdown", "error", err)
+	}
+}
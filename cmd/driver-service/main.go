@@ -3,31 +3,107 @@ package main
 import (
 	"context"
 	"os"
-	"taxi-hailing/config"
+	"os/signal"
+	"syscall"
+	"taxi-hailing/intenal/authz"
 	"taxi-hailing/intenal/broker"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/metrics"
 	"taxi-hailing/intenal/repo"
+	"taxi-hailing/intenal/server"
+	"taxi-hailing/intenal/service"
+	"taxi-hailing/intenal/ws"
 	"taxi-hailing/pkg"
+	"time"
 )
 
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	slogger := pkg.CustomSlog("driver-service")
-	cfg, err := config.LoadConfig()
+	cfg, err := pkg.ParseConfig()
 	if err != nil {
 		slogger.Error("cannot parse config", "action", "parse config", "error", err)
 		os.Exit(1)
 	}
+	shutdownTracing, err := pkg.InitTracing(context.Background(), "driver-service", cfg.TracingCfg)
+	if err != nil {
+		slogger.Error("cannot init tracing", "action", "init tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 	pool, err := pkg.NewDB(context.Background(), &cfg.DatabaseCfg)
 	if err != nil {
 		slogger.Error("cannot create connection to db", "action", "connect to db", "error", err)
 		os.Exit(1)
 	}
 	defer pool.Close()
+	err = metrics.RegisterPool(pool)
+	if err != nil {
+		slogger.Error("cannot register db pool metrics", "action", "register metrics", "error", err)
+		os.Exit(1)
+	}
 	db := repo.NewDriverRepo(pool)
 	rabbit, err := broker.NewDriverRabbit(cfg.RabbitMQCfg, slogger)
 	if err != nil {
 		slogger.Error("cannot create connection to rabbitMQ", "action", "connect to rabbitMQ", "error", err)
 		os.Exit(1)
 	}
-	defer rabbit.CloseRabbit()
-}
+	// background consumers live until shutdown
+	appCtx, stopConsumers := context.WithCancel(context.Background())
+	defer stopConsumers()
+
+	keys := jwks.NewRemote(appCtx, slogger, cfg.JWTCfg.JWKSURL)
+	auth := service.NewAuthService(appCtx, slogger, repo.NewSessionRepo(pool), service.TokenConfig{
+		Keys:     keys,
+		Issuer:   cfg.JWTCfg.Issuer,
+		Audience: authz.AudienceDriver,
+	})
+	hub := ws.NewDriverWebSocket(slogger, auth, cfg.WebSocketCfg.DriverPort)
+	auth.OnRevoke(hub.Disconnect)
+
+	myService := service.NewDriverService(appCtx, slogger, db, rabbit, hub)
+	service.NewOutboxRelay(appCtx, slogger, repo.NewOutboxRepo(pool), rabbit.PublishOutbox)
+	myServer := server.NewDriverServer(cfg.DriverLocationService, auth, myService,
+		server.HealthCheck{Name: "postgres", Check: pool.Ping},
+		server.HealthCheck{Name: "jwks", Check: keys.Ready},
+		server.HealthCheck{Name: "rabbitmq", Check: rabbit.Ready},
+		server.HealthCheck{Name: "websocket", Check: hub.Ready},
+	)
 
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	//websocket
+	go func() {
+		slogger.Info("starting the websocket server", "action", "start the server", "port", cfg.WebSocketCfg.DriverPort)
+		err := hub.StartServer()
+		slogger.Error("websocket server stopped", "error", err)
+		quit <- nil
+	}()
+
+	go func() {
+		slogger.Info("starting the server", "action", "start the server", "port", cfg.DriverLocationService)
+		err := myServer.StartServer()
+		slogger.Error("server stopped", "error", err)
+		quit <- nil
+	}()
+	sig := <-quit
+	slogger.Info("shutting down", "action", "shutdown", "signal", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// stop accepting requests and wait for in-flight ones
+	err = myServer.ShutDownServer(ctx)
+	if err != nil {
+		slogger.Error("cannot shutdown the server", "action", "shutdown", "error", err)
+	}
+	err = hub.CloseServer()
+	if err != nil {
+		slogger.Error("cannot close the websocket server", "action", "shutdown", "error", err)
+	}
+	stopConsumers()
+	err = rabbit.CloseRabbit()
+	if err != nil {
+		slogger.Error("cannot close rabbitMQ", "action", "shutdown", "error", err)
+	}
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"context"
-	"log/slog"
+	"crypto/rand"
 	"os"
 	"os/signal"
 	"syscall"
+	"taxi-hailing/intenal/authz"
 	"taxi-hailing/intenal/broker"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/metrics"
 	"taxi-hailing/intenal/repo"
 	"taxi-hailing/intenal/server"
 	"taxi-hailing/intenal/service"
 	"taxi-hailing/intenal/ws"
 	"taxi-hailing/pkg"
+	"time"
 )
 
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	slogger := pkg.CustomSlog("ride-service")
 	cfg, err := pkg.ParseConfig()
@@ -21,6 +27,12 @@ func main() {
 		slogger.Error("cannot parse config", "action", "parse config", "error", err)
 		os.Exit(1)
 	}
+	shutdownTracing, err := pkg.InitTracing(context.Background(), "ride-service", cfg.TracingCfg)
+	if err != nil {
+		slogger.Error("cannot init tracing", "action", "init tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
 
 	pool, err := pkg.NewDB(context.Background(), &cfg.DatabaseCfg)
 	if err != nil {
@@ -28,35 +40,79 @@ func main() {
 		os.Exit(1)
 	}
 	defer pool.Close()
+	err = metrics.RegisterPool(pool)
+	if err != nil {
+		slogger.Error("cannot register db pool metrics", "action", "register metrics", "error", err)
+		os.Exit(1)
+	}
 	db := repo.NewRideRepo(pool)
 	rabbit, err := broker.NewRideRabbit(cfg.RabbitMQCfg, slogger)
 	if err != nil {
 		slogger.Error("cannot create connection to rabbitMQ", "action", "connect to rabbitMQ", "error", err)
 		os.Exit(1)
 	}
-	defer rabbit.CloseRabbit()
-	ws := ws.NewWebSocket(slogger, []byte(cfg.ServicesCfg.Secret), cfg.WebSocketCfg.Port)
+	// background consumers live until shutdown
+	appCtx, stopConsumers := context.WithCancel(context.Background())
+	defer stopConsumers()
 
-	myService := service.NewRideService(context.Background(), slogger, db, rabbit, ws)
-	myServer := server.NewRideServer(cfg.RideService, cfg.ServicesCfg.Secret, myService)
+	keys := jwks.NewRemote(appCtx, slogger, cfg.JWTCfg.JWKSURL)
+	auth := service.NewAuthService(appCtx, slogger, repo.NewSessionRepo(pool), service.TokenConfig{
+		Keys:     keys,
+		Issuer:   cfg.JWTCfg.Issuer,
+		Audience: authz.AudienceRide,
+	})
+	ws := ws.NewWebSocket(slogger, auth, cfg.WebSocketCfg.Port)
+	auth.OnRevoke(ws.Disconnect)
+
+	quoteSecret := []byte(cfg.ServicesCfg.QuoteSecret)
+	if len(quoteSecret) == 0 {
+		// quotes then only hold on this instance and until it restarts
+		quoteSecret = make([]byte, 32)
+		rand.Read(quoteSecret)
+		slogger.Warn("QUOTE_SECRET is not set, using a random one", "action", "parse config")
+	}
+	myService := service.NewRideService(appCtx, slogger, db, rabbit, ws, quoteSecret)
+	service.NewOutboxRelay(appCtx, slogger, repo.NewOutboxRepo(pool), rabbit.PublishOutbox)
+	myServer := server.NewRideServer(cfg.RideService, auth, myService,
+		server.HealthCheck{Name: "postgres", Check: pool.Ping},
+		server.HealthCheck{Name: "jwks", Check: keys.Ready},
+		server.HealthCheck{Name: "rabbitmq", Check: rabbit.Ready},
+		server.HealthCheck{Name: "websocket", Check: ws.Ready},
+	)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	//websocket
 	go func() {
-
-		slogger.Info("starting the server", "action", "start the server")
+		slogger.Info("starting the websocket server", "action", "start the server", "port", cfg.WebSocketCfg.Port)
 		err := ws.StartServer()
-		slog.Error("server stopped", "error", err)
+		slogger.Error("websocket server stopped", "error", err)
 		quit <- nil
 	}()
 
 	go func() {
-		slogger.Info("starting the server", "action", "start the server")
+		slogger.Info("starting the server", "action", "start the server", "port", cfg.RideService)
 		err := myServer.StartServer()
-		slog.Error("server stopped", "error", err)
+		slogger.Error("server stopped", "error", err)
 		quit <- nil
 	}()
-	<-quit
-	myServer.ShutDownServer(context.Background())
+	sig := <-quit
+	slogger.Info("shutting down", "action", "shutdown", "signal", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// stop accepting requests and wait for in-flight ones
+	err = myServer.ShutDownServer(ctx)
+	if err != nil {
+		slogger.Error("cannot shutdown the server", "action", "shutdown", "error", err)
+	}
+	err = ws.CloseServer()
+	if err != nil {
+		slogger.Error("cannot close the websocket server", "action", "shutdown", "error", err)
+	}
+	stopConsumers()
+	err = rabbit.CloseRabbit()
+	if err != nil {
+		slogger.Error("cannot close rabbitMQ", "action", "shutdown", "error", err)
+	}
 }
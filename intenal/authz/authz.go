@@ -0,0 +1,106 @@
+// Package authz decides who may call a route. Routes declare a Rule (allowed roles and
+// path values the subject must own), the REST servers and the WebSocket hubs check it the same way.
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
+)
+
+const (
+	RolePassenger = "PASSENGER"
+	RoleDriver    = "DRIVER"
+	RoleAdmin     = "ADMIN"
+)
+
+// Token audiences, every service accepts only tokens issued for it
+const (
+	AudienceAuth   = "auth-service"
+	AudienceRide   = "ride-service"
+	AudienceDriver = "driver-service"
+	AudienceAdmin  = "admin-service"
+)
+
+// Audiences are the services a token of the role is issued for,
+// a passenger's token is useless against the driver and admin APIs
+func Audiences(role string) []string {
+	switch role {
+	case RolePassenger:
+		return []string{AudienceAuth, AudienceRide}
+	case RoleDriver:
+		return []string{AudienceAuth, AudienceDriver}
+	case RoleAdmin:
+		return []string{AudienceAuth, AudienceAdmin}
+	}
+	return []string{AudienceAuth}
+}
+
+// Authenticator checks the access token and that its session is not revoked
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*pkg.MyClaims, error)
+}
+
+// Rule is what a route requires from the authenticated subject
+type Rule struct {
+	roles []string // any of them, none means every authenticated user
+	owner []string // path values which must equal the subject's user id
+}
+
+// Allow lets the given roles in, with no roles any authenticated user
+func Allow(roles ...string) Rule {
+	return Rule{roles: roles}
+}
+
+// OwnedBy additionally requires the path value to be the subject itself,
+// like driver_id in /drivers/{driver_id}/online
+func (r Rule) OwnedBy(pathValue string) Rule {
+	r.owner = append(slices.Clone(r.owner), pathValue)
+	return r
+}
+
+// Check returns domain.ErrForbidden if the subject breaks the rule.
+// pathValue reads the route's path values, http.Request.PathValue fits.
+func (r Rule) Check(claim *pkg.MyClaims, pathValue func(string) string) error {
+	if len(r.roles) > 0 && !slices.Contains(r.roles, claim.Role) {
+		return fmt.Errorf("%w: role %s is not allowed", domain.ErrForbidden, claim.Role)
+	}
+	for _, name := range r.owner {
+		if pathValue(name) != claim.UserID {
+			return fmt.Errorf("%w: %s does not belong to the token's user", domain.ErrForbidden, name)
+		}
+	}
+	return nil
+}
+
+// Authorize authenticates the token and checks the rule. Errors wrap domain.ErrUnauthorized
+// (no valid session) or domain.ErrForbidden (valid session, not allowed).
+func Authorize(ctx context.Context, auth Authenticator, token string, rule Rule, pathValue func(string) string) (*pkg.MyClaims, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: missing token", domain.ErrUnauthorized)
+	}
+	claim, err := auth.Authenticate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	err = rule.Check(claim, pathValue)
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// Status is the http code of an Authorize error: 401, 403, or 500 when the check itself failed
+func Status(err error) int {
+	switch {
+	case errors.Is(err, domain.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, domain.ErrForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
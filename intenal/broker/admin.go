@@ -0,0 +1,207 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// redriveTarget is where a dead letter of the queue is published back to
+type redriveTarget struct {
+	exchange string
+	key      string
+}
+
+// redriveTargetOf returns the target of the queue in bindings: the queue itself through the default exchange,
+// or the exchange for exclusive queues, which are per consumer
+func redriveTargetOf(queue string) (redriveTarget, bool) {
+	b, ok := bindingOf(queue)
+	if !ok {
+		return redriveTarget{}, false
+	}
+	if b.exclusive {
+		return redriveTarget{b.exchange, b.pattern}, true
+	}
+	return redriveTarget{"", b.queue}, true
+}
+
+// AdminBroker reads and re-drives dead letter queues. It connects lazily,
+// so the admin service works without rabbit until these endpoints are used.
+type AdminBroker struct {
+	logger *slog.Logger
+	dsn    string
+	mu     sync.Mutex
+	conn   *amqp091.Connection
+}
+
+func NewAdminRabbit(cfg pkg.RabbitMQCfg, slogger *slog.Logger) *AdminBroker {
+	return &AdminBroker{
+		logger: slogger,
+		dsn:    fmt.Sprintf("amqp://%s:%s@%s:%d/", cfg.User, cfg.Password, cfg.Host, cfg.Port),
+	}
+}
+
+func (a *AdminBroker) CloseRabbit() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil || a.conn.IsClosed() {
+		return nil
+	}
+	defer a.logger.Info("rabbit closed")
+	return a.conn.Close()
+}
+
+// connection returns the connection, reconnecting if it is lost
+func (a *AdminBroker) connection() (*amqp091.Connection, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil || a.conn.IsClosed() {
+		conn, err := amqp091.Dial(a.dsn)
+		if err != nil {
+			return nil, err
+		}
+		a.conn = conn
+	}
+	return a.conn, nil
+}
+
+// DeadLetters returns up to limit messages from the head of the dead letter queue without removing them
+func (a *AdminBroker) DeadLetters(queue string, limit int) (*domain.DeadLettersResponse, error) {
+	if _, ok := redriveTargetOf(queue); !ok {
+		return nil, fmt.Errorf("%w: unknown queue %s", domain.ErrNotFound, queue)
+	}
+	conn, err := a.connection()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(deadLetterQueue(queue), true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &domain.DeadLettersResponse{
+		Queue:      queue,
+		Messages:   []domain.DeadLetter{},
+		TotalCount: q.Messages,
+	}
+	var last *amqp091.Delivery
+	for range limit {
+		d, ok, err := ch.Get(deadLetterQueue(queue), false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		last = &d
+		res.Messages = append(res.Messages, toDeadLetter(queue, &d))
+	}
+	// put everything back, closing the channel would requeue them too
+	if last != nil {
+		err = last.Nack(true, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Redrive publishes up to limit dead letters back to their queue with a fresh retry budget
+func (a *AdminBroker) Redrive(ctx context.Context, queue string, limit int) (*domain.RedriveResponse, error) {
+	target, ok := redriveTargetOf(queue)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown queue %s", domain.ErrNotFound, queue)
+	}
+	conn, err := a.connection()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	confirmCh, err := newConfirmChannel(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer confirmCh.Close()
+
+	res := &domain.RedriveResponse{Queue: queue}
+	for range limit {
+		d, ok, err := ch.Get(deadLetterQueue(queue), false)
+		if err != nil {
+			return res, err
+		}
+		if !ok {
+			break
+		}
+		headers := amqp091.Table{}
+		for k, v := range d.Headers {
+			headers[k] = v
+		}
+		delete(headers, retryCountHeader)
+		delete(headers, errorHeader)
+		delete(headers, originalQueueHeader)
+		delete(headers, "x-death")
+		err = confirmPublish(ctx, confirmCh, target.exchange, target.key, amqp091.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			MessageId:     d.MessageId,
+			CorrelationId: d.CorrelationId,
+			Timestamp:     d.Timestamp,
+			Priority:      d.Priority,
+			DeliveryMode:  amqp091.Persistent,
+			Body:          d.Body,
+		})
+		if err != nil {
+			return res, errors.Join(err, d.Nack(false, true))
+		}
+		err = d.Ack(false)
+		if err != nil {
+			return res, err
+		}
+		res.Redriven++
+		res.Remaining = int(d.MessageCount)
+	}
+	a.logger.Info("dead letters redriven", "action", "redrive", "queue", queue, "count", res.Redriven)
+	return res, nil
+}
+
+func toDeadLetter(queue string, d *amqp091.Delivery) domain.DeadLetter {
+	dl := domain.DeadLetter{
+		MessageID:  d.MessageId,
+		Queue:      queue,
+		RoutingKey: d.RoutingKey,
+		Retries:    retryCount(d.Headers),
+		Timestamp:  d.Timestamp,
+		Payload:    d.Body,
+	}
+	if s, ok := d.Headers[errorHeader].(string); ok {
+		dl.Error = s
+	}
+	// dead lettered by the queue itself, the original routing key is in x-death
+	if deaths, ok := d.Headers["x-death"].([]any); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp091.Table); ok {
+			if keys, ok := death["routing-keys"].([]any); ok && len(keys) > 0 {
+				dl.RoutingKey, _ = keys[0].(string)
+			}
+		}
+	}
+	if !json.Valid(d.Body) {
+		dl.Payload, _ = json.Marshal(string(d.Body))
+	}
+	return dl
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"taxi-hailing/intenal/domain"
+)
+
+// Message is a consumed message. After handling the service must settle it:
+// Ack on success, Nack to retry, Reject when it can never be handled.
+// Headers carry the correlation id and the trace context of the publisher, see pkg.ExtractHeaders.
+type Message[T any] interface {
+	GiveBody() (*T, error)
+	Headers() map[string]string
+	Ack() error
+	Nack(cause error) error
+	Reject(cause error) error
+}
+
+// RideConsumer is what the ride service reads: statuses from drivers (ride_topic ride.status.*),
+// matches (driver_topic driver.response.*) and driver locations (location_fanout)
+type RideConsumer interface {
+	GiveStatusChannel() <-chan Message[domain.RideStatusUpdate]
+	GiveResponeChannel() <-chan Message[domain.RideResponseMatch]
+	GiveLocationChannel() <-chan Message[domain.DriverLocationUpdate]
+}
+
+// DriverConsumer is what the driver service reads: ride requests (ride_topic ride.request.*)
+// and passenger side changes (driver_topic driver.status.*)
+type DriverConsumer interface {
+	GiveReqChannel() <-chan Message[domain.RideRequestRabbit]
+	GiveStatusChannel() <-chan Message[domain.RideStatusUpdate]
+}
+
+// OutboxPublisher publishes messages saved in the outbox to ride_topic and driver_topic
+type OutboxPublisher interface {
+	PublishOutbox(ctx context.Context, msg *domain.OutboxMessage) error
+}
+
+// LocationPublisher publishes driver locations to location_fanout, they do not go through the outbox
+type LocationPublisher interface {
+	PublishLocation(ctx context.Context, loc *domain.DriverLocationUpdate) error
+}
+
+// DriverRabbit is everything the driver service needs from the broker
+type DriverRabbit interface {
+	DriverConsumer
+	LocationPublisher
+}
+
+// exchanges are the kinds of the exchanges in bindings
+var exchanges = map[string]string{
+	domain.ExchangeRideTopic:      "topic",
+	domain.ExchangeDriverTopic:    "topic",
+	domain.ExchangeLocationFanout: "fanout",
+}
+
+// binding routes messages of an exchange to a queue, a topic pattern for topic exchanges.
+// An exclusive queue belongs to one consumer, every ride service gets all locations, so its name is only logical.
+type binding struct {
+	exchange  string
+	pattern   string
+	queue     string
+	exclusive bool
+}
+
+// bindings is the topology both services declare, shared with the in-memory broker
+var bindings = []binding{
+	{domain.ExchangeRideTopic, "ride.request.*", QueueRideRequests, false},
+	{domain.ExchangeRideTopic, "ride.status.*", QueueRideStatus, false},
+	{domain.ExchangeDriverTopic, "driver.response.*", QueueDriverResponses, false},
+	{domain.ExchangeDriverTopic, "driver.status.*", QueueDriverStatus, false},
+	{domain.ExchangeLocationFanout, "", QueueLocationUpdates, true},
+}
+
+// bindingOf returns the binding of the logical queue name
+func bindingOf(queue string) (binding, bool) {
+	for _, b := range bindings {
+		if b.queue == queue {
+			return b, true
+		}
+	}
+	return binding{}, false
+}
+
+// jsonMessage decodes the body of the settled message as T
+type jsonMessage[T any] struct {
+	settler
+	body    []byte
+	headers map[string]string
+}
+
+// settler is the broker specific part of a message
+type settler interface {
+	Ack() error
+	Nack(cause error) error
+	Reject(cause error) error
+}
+
+func (j *jsonMessage[T]) Headers() map[string]string {
+	return j.headers
+}
+
+func (j *jsonMessage[T]) GiveBody() (*T, error) {
+	v := new(T)
+	err := json.Unmarshal(j.body, v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,268 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"taxi-hailing/intenal/metrics"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// durable queues, the location queue is exclusive per ride service so it has only a logical name
+const (
+	QueueRideRequests    = "ride_requests"
+	QueueRideStatus      = "ride_status"
+	QueueDriverResponses = "driver_responses"
+	QueueDriverStatus    = "driver_status"
+	QueueLocationUpdates = "location_updates"
+)
+
+const (
+	// unacked deliveries per consumer. Ride requests stay unacked while they are matched,
+	// so this is also how many rides one driver service matches at once.
+	consumerPrefetch = 32
+
+	maxDeliveryRetries = 5
+	retryBaseDelay     = time.Second
+	retryMaxDelay      = time.Minute
+	republishTimeout   = 5 * time.Second
+
+	retryCountHeader    = "x-retry-count"
+	errorHeader         = "x-error"
+	originalQueueHeader = "x-original-queue"
+)
+
+func deadLetterExchange(queue string) string {
+	return queue + ".dlx"
+}
+
+func deadLetterQueue(queue string) string {
+	return queue + ".dlq"
+}
+
+// retryDelay is the backoff before retry n+1 of a failed message
+func retryDelay(n int) time.Duration {
+	return min(retryBaseDelay<<n, retryMaxDelay)
+}
+
+// retryQueue holds the messages waiting for the delay. Every delay has its own queue with a queue-level TTL,
+// so all messages in it expire in order: a per-message expiration in one shared queue would let a long
+// delay at the head hold back the shorter ones behind it.
+func retryQueue(queue string, delay time.Duration) string {
+	return queue + ".retry." + delay.String()
+}
+
+// declareDeadLetter declares the dead letter exchange of the queue and the queue collecting it
+func declareDeadLetter(ch *amqp091.Channel, queue string) error {
+	err := ch.ExchangeDeclare(deadLetterExchange(queue), "fanout", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(deadLetterQueue(queue), true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(deadLetterQueue(queue), "", deadLetterExchange(queue), false, nil)
+}
+
+// declareQueue declares the durable queue with its retry queue and dead letter queue.
+// Queue arguments must be the same in every service, so all durable queues are declared here.
+func declareQueue(ch *amqp091.Channel, name string) (amqp091.Queue, error) {
+	err := declareDeadLetter(ch, name)
+	if err != nil {
+		return amqp091.Queue{}, err
+	}
+	// expired retries go back to the queue through the default exchange
+	for n := range maxDeliveryRetries {
+		delay := retryDelay(n)
+		_, err = ch.QueueDeclare(retryQueue(name, delay), true, false, false, false, amqp091.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": name,
+		})
+		if err != nil {
+			return amqp091.Queue{}, err
+		}
+	}
+	return ch.QueueDeclare(name, true, false, false, false, amqp091.Table{
+		"x-dead-letter-exchange": deadLetterExchange(name),
+	})
+}
+
+// declareTopology declares every exchange and durable queue of bindings and binds them. Both services
+// declare all of it, so messages published before the consuming service first starts are kept.
+func declareTopology(ch *amqp091.Channel) error {
+	for _, name := range slices.Sorted(maps.Keys(exchanges)) {
+		err := ch.ExchangeDeclare(name, exchanges[name], true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range bindings {
+		if b.exclusive {
+			continue
+		}
+		_, err := declareQueue(ch, b.queue)
+		if err != nil {
+			return err
+		}
+		err = ch.QueueBind(b.queue, b.pattern, b.exchange, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// declareExclusive declares this consumer's own queue of an exclusive binding and its dead letter queue.
+// Returns the name rabbit generated, the queue is gone with the connection.
+func declareExclusive(ch *amqp091.Channel, queue string) (string, error) {
+	b, ok := bindingOf(queue)
+	if !ok || !b.exclusive {
+		return "", fmt.Errorf("%s is not an exclusive queue", queue)
+	}
+	err := declareDeadLetter(ch, b.queue)
+	if err != nil {
+		return "", err
+	}
+	q, err := ch.QueueDeclare("", false, false, true, false, amqp091.Table{
+		"x-dead-letter-exchange": deadLetterExchange(b.queue),
+	})
+	if err != nil {
+		return "", err
+	}
+	return q.Name, ch.QueueBind(q.Name, b.pattern, b.exchange, false, nil)
+}
+
+// consumeQueue starts passing deliveries of the queue to out until the channel is closed.
+// name is the declared queue, queue its logical name for retries, dead letters and metrics.
+func consumeQueue[T any](ch, confirmCh *amqp091.Channel, name, queue string, retries int, out chan<- Message[T]) error {
+	msgs, err := ch.Consume(
+		name,
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range msgs {
+			out <- newJSONMessage[T](&msg, queue, retries, confirmCh)
+		}
+	}()
+	return nil
+}
+
+// message is a delivery the service must settle with Ack, Nack or Reject after handling it
+type message struct {
+	delivery *amqp091.Delivery
+	queue    string           // retries go back here
+	retries  int              // 0 means failed messages are dead lettered at once
+	confirm  *amqp091.Channel // for republishing retries and dead letters
+}
+
+func newJSONMessage[T any](d *amqp091.Delivery, queue string, retries int, confirm *amqp091.Channel) Message[T] {
+	if !d.Timestamp.IsZero() {
+		metrics.ConsumerLag.WithLabelValues(queue).Observe(time.Since(d.Timestamp).Seconds())
+	}
+	return &jsonMessage[T]{
+		settler: &message{
+			delivery: d,
+			queue:    queue,
+			retries:  retries,
+			confirm:  confirm,
+		},
+		body:    d.Body,
+		headers: stringHeaders(d.Headers),
+	}
+}
+
+// stringHeaders keeps the string headers of the delivery, the trace context and the correlation id are strings
+func stringHeaders(table amqp091.Table) map[string]string {
+	headers := make(map[string]string, len(table))
+	for k, v := range table {
+		if s, ok := v.(string); ok {
+			headers[k] = s
+		}
+	}
+	return headers
+}
+
+func (m *message) Ack() error {
+	metrics.MessagesSettled.WithLabelValues(m.queue, metrics.OutcomeAck).Inc()
+	return m.delivery.Ack(false)
+}
+
+// Nack sends the message to the retry queue with exponential backoff,
+// after the last retry it goes to the dead letter queue
+func (m *message) Nack(cause error) error {
+	n := retryCount(m.delivery.Headers)
+	if n >= m.retries {
+		metrics.MessagesSettled.WithLabelValues(m.queue, metrics.OutcomeDeadLetter).Inc()
+		return m.deadLetter(cause, n)
+	}
+	metrics.MessagesSettled.WithLabelValues(m.queue, metrics.OutcomeNack).Inc()
+	err := m.republish("", retryQueue(m.queue, retryDelay(n)), cause, n+1)
+	if err != nil {
+		return m.delivery.Nack(false, true)
+	}
+	return m.delivery.Ack(false)
+}
+
+// Reject dead letters the message without retries, for messages which can never be handled (e.g. broken body)
+func (m *message) Reject(cause error) error {
+	metrics.MessagesSettled.WithLabelValues(m.queue, metrics.OutcomeReject).Inc()
+	return m.deadLetter(cause, retryCount(m.delivery.Headers))
+}
+
+func (m *message) deadLetter(cause error, retries int) error {
+	err := m.republish(deadLetterExchange(m.queue), "", cause, retries)
+	if err != nil {
+		// the queue dead letters it by itself, only without our headers
+		return m.delivery.Nack(false, false)
+	}
+	return m.delivery.Ack(false)
+}
+
+func (m *message) republish(exchange, key string, cause error, retries int) error {
+	headers := amqp091.Table{}
+	for k, v := range m.delivery.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(retries)
+	headers[errorHeader] = cause.Error()
+	headers[originalQueueHeader] = m.queue
+
+	pub := amqp091.Publishing{
+		Headers:       headers,
+		ContentType:   m.delivery.ContentType,
+		MessageId:     m.delivery.MessageId,
+		CorrelationId: m.delivery.CorrelationId,
+		Timestamp:     m.delivery.Timestamp,
+		Priority:      m.delivery.Priority,
+		DeliveryMode:  amqp091.Persistent,
+		Body:          m.delivery.Body,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), republishTimeout)
+	defer cancel()
+	return confirmPublish(ctx, m.confirm, exchange, key, pub)
+}
+
+func retryCount(headers amqp091.Table) int {
+	switch v := headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
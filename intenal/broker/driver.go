@@ -3,10 +3,8 @@ package broker
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log/slog"
-	"sync/atomic"
 	"taxi-hailing/intenal/domain"
 	"taxi-hailing/pkg"
 	"time"
@@ -15,212 +13,92 @@ import (
 )
 
 type DriverBroker struct {
-	logger    *slog.Logger
-	conn      *amqp091.Connection
-	connClose chan *amqp091.Error
-	ch        *amqp091.Channel //for publish
-	req       chan *request
-	isClosed  atomic.Bool
-}
-
-type request struct {
-	req *amqp091.Delivery
+	logger  *slog.Logger
+	session *session
+	req     chan Message[domain.RideRequestRabbit]
+	status  chan Message[domain.RideStatusUpdate]
 }
 
 func NewDriverRabbit(cfg pkg.RabbitMQCfg, slogger *slog.Logger) (*DriverBroker, error) {
 	dsn := fmt.Sprintf("amqp://%s:%s@%s:%d/", cfg.User, cfg.Password, cfg.Host, cfg.Port)
 	myRab := &DriverBroker{
 		logger: slogger,
-		req:    make(chan *request),
+		req:    make(chan Message[domain.RideRequestRabbit]),
+		status: make(chan Message[domain.RideStatusUpdate]),
 	}
 
-	err := myRab.createChannel(dsn)
+	session, err := newSession(dsn, slogger, myRab.setup)
 	if err != nil {
 		return nil, err
 	}
-
-	go myRab.reconnectConn(dsn)
+	myRab.session = session
 	return myRab, nil
 }
 
-func (d *DriverBroker) reconnectConn(dsn string) {
-	for {
-		<-d.connClose
-		if d.isClosed.Load() {
-			return
-		}
-		d.logger.Warn("rabbitMQ not working")
-		for {
-			if d.isClosed.Load() {
-				return
-			}
-			d.logger.Info("trying to connect to rabbitmq")
-			err := d.createChannel(dsn)
-			if err != nil {
-				time.Sleep(3 * time.Second)
-				continue
-			}
-		}
-	}
+// Ready fails while the connection or one of its channels is down
+func (r *DriverBroker) Ready(ctx context.Context) error {
+	return r.session.healthy()
 }
 
-func (r *DriverBroker) createChannel(dsn string) error {
-	myConn, err := amqp091.Dial(dsn)
+// setup declares the topology and starts the consumers, it runs again after every reconnect
+func (r *DriverBroker) setup(ch, confirmCh *amqp091.Channel) error {
+	err := declareTopology(ch)
 	if err != nil {
 		return err
 	}
-	r.conn = myConn
-	r.connClose = make(chan *amqp091.Error)
-	r.conn.NotifyClose(r.connClose)
-	ch, err := r.conn.Channel()
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	r.ch = ch
-
-	err = ch.ExchangeDeclare(
-		"driver_topic", // имя exchange
-		"topic",        // тип (direct, fanout, topic, headers)
-		true,           // durable
-		false,          // auto-deleted
-		false,          // internal
-		false,          // no-wait
-		nil,            // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	//matching the ride
-	que, err := ch.QueueDeclare("driver_responses", true, false, false, false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	err = ch.QueueBind(que.Name, "driver.response.*", "driver_topic", false, nil)
+	// ride changes made by passenger (cancel)
+	err = consumeQueue(ch, confirmCh, QueueDriverStatus, QueueDriverStatus, maxDeliveryRetries, r.status)
 	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	err = ch.ExchangeDeclare(
-		"ride_topic", // имя exchange
-		"topic",      // тип (direct, fanout, topic, headers)
-		true,         // durable
-		false,        // auto-deleted
-		false,        // internal
-		false,        // no-wait
-		nil,          // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	//at ride service
-	q1, err := ch.QueueDeclare("ride_requests", true, false, false, false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	requests, err := ch.Consume(
-		q1.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	go func() {
-		for req := range requests {
-			r.req <- r.newRideRequest(&req)
-		}
-	}()
-
-	//give updated status ride by driver service to ride service
-	q2, err := ch.QueueDeclare("ride_status", true, false, false, false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	err = ch.QueueBind(q2.Name, "ride.status.*", "ride_topic", false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	err = ch.ExchangeDeclare(
-		"location_fanout", // имя exchange
-		"fanout",          // тип (direct, fanout, topic, headers)
-		true,              // durable
-		false,             // auto-deleted
-		false,             // internal
-		false,             // no-wait
-		nil,               // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	return nil
-}
-
-func (r *DriverBroker) newRideRequest(req *amqp091.Delivery) *request {
-	return &request{
-		req: req,
+		return err
 	}
+	return consumeQueue(ch, confirmCh, QueueRideRequests, QueueRideRequests, maxDeliveryRetries, r.req)
 }
 
-func (d *DriverBroker) GiveReqChannel() <-chan *request {
+func (d *DriverBroker) GiveReqChannel() <-chan Message[domain.RideRequestRabbit] {
 	return d.req
 }
 
-func (r *request) GiveBody() (*domain.RideRequestRabbit, error) {
-	req := new(domain.RideRequestRabbit)
-	err := json.Unmarshal(r.req.Body, req)
-	if err != nil {
-		return nil, err
-	}
-	return req, nil
+func (d *DriverBroker) GiveStatusChannel() <-chan Message[domain.RideStatusUpdate] {
+	return d.status
 }
 
 func (r *DriverBroker) CloseRabbit() error {
-	r.isClosed.Store(true)
 	defer r.logger.Info("rabbit closed")
-	return r.conn.Close()
+	return r.session.close()
 }
 
-func (r *DriverBroker) PublishStatus(ctx context.Context, status *domain.RideStatusUpdate) error {
-	b, err := json.Marshal(status)
+func (r *DriverBroker) PublishLocation(ctx context.Context, loc *domain.DriverLocationUpdate) error {
+	b, err := json.Marshal(loc)
 	if err != nil {
 		return err
 	}
-
-	return r.ch.PublishWithContext(
+	l, err := r.session.current(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, span := startPublishSpan(ctx, pkg.InjectHeaders(ctx), domain.ExchangeLocationFanout, "")
+	defer span.End()
+	return l.ch.PublishWithContext(
 		ctx,
-		"ride_topic",
-		fmt.Sprintf("ride.status.%s", status.Status),
+		domain.ExchangeLocationFanout,
+		"",
 		false,
 		false,
 		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        b,
+			Headers:       amqpHeaders(ctx),
+			CorrelationId: loc.CorrelationID,
+			ContentType:   "application/json",
+			Timestamp:     time.Now(),
+			Body:          b,
 		},
 	)
 }
 
-func (r *DriverBroker) PublishLocation(ctx context.Context, loc *domain.DriverLocationUpdate) error {
-	b, err := json.Marshal(loc)
+// PublishOutbox publishes the message saved by the repo and waits for the confirm from rabbit
+func (r *DriverBroker) PublishOutbox(ctx context.Context, msg *domain.OutboxMessage) error {
+	l, err := r.session.current(ctx)
 	if err != nil {
 		return err
 	}
-	return r.ch.PublishWithContext(
-		ctx,
-		"location_fanout",
-		"",
-		false,
-		false,
-		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        b,
-		},
-	)
+	return publishConfirmed(ctx, l.confirmCh, msg)
 }
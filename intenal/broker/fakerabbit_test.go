@@ -0,0 +1,456 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"taxi-hailing/pkg"
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// fakeRabbit speaks just enough AMQP 0-9-1 for the session: the handshake, channels, declarations,
+// consumers and deliveries. Every connection records the topology declared on it, the test can
+// drop all connections and refuse new ones to play an outage.
+type fakeRabbit struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	refuse  bool
+	refused int
+	conns   []*fakeConn
+}
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// fakeQueue is a declared queue
+type fakeQueue struct {
+	durable   bool
+	exclusive bool
+	args      amqp091.Table
+}
+
+// fakeConsumer is a basic.consume, deliveries need its channel and tag
+type fakeConsumer struct {
+	channel uint16
+	tag     string
+}
+
+// topology is what one connection declared
+type topology struct {
+	exchanges map[string]string // name -> kind
+	queues    map[string]fakeQueue
+	bindings  map[string]bool // "exchange key queue"
+	consumers map[string]fakeConsumer
+}
+
+type fakeConn struct {
+	conn      net.Conn
+	wmu       sync.Mutex // frames of one delivery must not interleave with replies
+	mu        sync.Mutex
+	topo      topology
+	generated int
+	tags      uint64
+}
+
+func newFakeRabbit(t *testing.T) *fakeRabbit {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &fakeRabbit{ln: ln}
+	go srv.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		srv.drop()
+	})
+	return srv
+}
+
+func (srv *fakeRabbit) cfg() pkg.RabbitMQCfg {
+	addr := srv.ln.Addr().(*net.TCPAddr)
+	return pkg.RabbitMQCfg{User: "guest", Password: "guest", Host: addr.IP.String(), Port: uint16(addr.Port)}
+}
+
+func (srv *fakeRabbit) accept() {
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		if srv.refuse {
+			srv.refused++
+			srv.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		c := &fakeConn{
+			conn: conn,
+			topo: topology{
+				exchanges: make(map[string]string),
+				queues:    make(map[string]fakeQueue),
+				bindings:  make(map[string]bool),
+				consumers: make(map[string]fakeConsumer),
+			},
+		}
+		srv.conns = append(srv.conns, c)
+		srv.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// setRefuse makes the server close new connections at once, like a rabbit which is down
+func (srv *fakeRabbit) setRefuse(refuse bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.refuse = refuse
+}
+
+func (srv *fakeRabbit) refusedCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.refused
+}
+
+// drop cuts every open connection without a connection.close
+func (srv *fakeRabbit) drop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.conns {
+		c.conn.Close()
+	}
+}
+
+func (srv *fakeRabbit) last() *fakeConn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.conns) == 0 {
+		return nil
+	}
+	return srv.conns[len(srv.conns)-1]
+}
+
+// topology returns what the latest connection declared
+func (srv *fakeRabbit) topology() topology {
+	c := srv.last()
+	if c == nil {
+		return topology{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topo
+}
+
+// deliver pushes the body to the consumer of the queue on the latest connection
+func (srv *fakeRabbit) deliver(queue string, body []byte) error {
+	c := srv.last()
+	if c == nil {
+		return fmt.Errorf("no connection")
+	}
+	c.mu.Lock()
+	consumer, ok := c.topo.consumers[queue]
+	c.tags++
+	tag := c.tags
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("nobody consumes %s", queue)
+	}
+
+	deliver := new(frameWriter)
+	deliver.short(60)
+	deliver.short(60)
+	deliver.shortstr(consumer.tag)
+	deliver.longlong(tag)
+	deliver.octet(0) // not redelivered
+	deliver.shortstr("")
+	deliver.shortstr(queue)
+	header := new(frameWriter)
+	header.short(60)
+	header.short(0)
+	header.longlong(uint64(len(body)))
+	header.short(0) // no properties
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	err := c.writeFrameLocked(frameMethod, consumer.channel, deliver.Bytes())
+	if err != nil {
+		return err
+	}
+	err = c.writeFrameLocked(frameHeader, consumer.channel, header.Bytes())
+	if err != nil {
+		return err
+	}
+	return c.writeFrameLocked(frameBody, consumer.channel, body)
+}
+
+func (c *fakeConn) serve() {
+	defer c.conn.Close()
+	protocol := make([]byte, 8)
+	_, err := io.ReadFull(c.conn, protocol)
+	if err != nil || !bytes.Equal(protocol, []byte("AMQP\x00\x00\x09\x01")) {
+		return
+	}
+	c.reply(0, 10, 10, func(w *frameWriter) {
+		w.octet(0)
+		w.octet(9)
+		w.long(0) // no server properties
+		w.longstr("PLAIN")
+		w.longstr("en_US")
+	})
+	for {
+		typ, channel, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameHeartbeat:
+			c.writeFrame(frameHeartbeat, 0, nil)
+		case frameMethod:
+			if !c.handle(channel, &frameReader{buf: payload}) {
+				return
+			}
+		}
+		// content of publishes is dropped, the tests only consume
+	}
+}
+
+// handle answers the method, false when the connection is closed
+func (c *fakeConn) handle(channel uint16, r *frameReader) bool {
+	class, method := r.short(), r.short()
+	switch {
+	case class == 10 && method == 11: // connection.start-ok
+		c.reply(0, 10, 30, func(w *frameWriter) {
+			w.short(0)
+			w.long(131072)
+			w.short(0)
+		})
+	case class == 10 && method == 40: // connection.open
+		c.reply(0, 10, 41, func(w *frameWriter) { w.shortstr("") })
+	case class == 10 && method == 50: // connection.close
+		c.reply(0, 10, 51, nil)
+		return false
+	case class == 10 && method == 51: // connection.close-ok
+		return false
+	case class == 20 && method == 10: // channel.open
+		c.reply(channel, 20, 11, func(w *frameWriter) { w.long(0) })
+	case class == 20 && method == 40: // channel.close
+		c.reply(channel, 20, 41, nil)
+	case class == 40 && method == 10: // exchange.declare
+		r.short()
+		name, kind := r.shortstr(), r.shortstr()
+		nowait := r.octet()&0x10 != 0
+		r.table()
+		c.record(func(topo *topology) { topo.exchanges[name] = kind })
+		if !nowait {
+			c.reply(channel, 40, 11, nil)
+		}
+	case class == 50 && method == 10: // queue.declare
+		r.short()
+		name := r.shortstr()
+		bits := r.octet()
+		args := r.table()
+		c.record(func(topo *topology) {
+			if name == "" {
+				c.generated++
+				name = fmt.Sprintf("amq.gen-%d", c.generated)
+			}
+			topo.queues[name] = fakeQueue{durable: bits&0x02 != 0, exclusive: bits&0x04 != 0, args: args}
+		})
+		if bits&0x10 == 0 {
+			c.reply(channel, 50, 11, func(w *frameWriter) {
+				w.shortstr(name)
+				w.long(0)
+				w.long(0)
+			})
+		}
+	case class == 50 && method == 20: // queue.bind
+		r.short()
+		queue, exchange, key := r.shortstr(), r.shortstr(), r.shortstr()
+		nowait := r.octet()&0x01 != 0
+		r.table()
+		c.record(func(topo *topology) { topo.bindings[exchange+" "+key+" "+queue] = true })
+		if !nowait {
+			c.reply(channel, 50, 21, nil)
+		}
+	case class == 60 && method == 10: // basic.qos
+		c.reply(channel, 60, 11, nil)
+	case class == 60 && method == 20: // basic.consume
+		r.short()
+		queue, tag := r.shortstr(), r.shortstr()
+		nowait := r.octet()&0x08 != 0
+		r.table()
+		c.record(func(topo *topology) { topo.consumers[queue] = fakeConsumer{channel: channel, tag: tag} })
+		if !nowait {
+			c.reply(channel, 60, 21, func(w *frameWriter) { w.shortstr(tag) })
+		}
+	case class == 85 && method == 10: // confirm.select
+		if r.octet()&0x01 == 0 {
+			c.reply(channel, 85, 11, nil)
+		}
+	}
+	// acks, nacks and publishes need no answer
+	return true
+}
+
+func (c *fakeConn) record(fn func(topo *topology)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(&c.topo)
+}
+
+func (c *fakeConn) reply(channel, class, method uint16, args func(w *frameWriter)) {
+	w := new(frameWriter)
+	w.short(class)
+	w.short(method)
+	if args != nil {
+		args(w)
+	}
+	c.writeFrame(frameMethod, channel, w.Bytes())
+}
+
+func (c *fakeConn) readFrame() (byte, uint16, []byte, error) {
+	head := make([]byte, 7)
+	_, err := io.ReadFull(c.conn, head)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+	_, err = io.ReadFull(c.conn, payload)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[len(payload)-1] != frameEnd {
+		return 0, 0, nil, fmt.Errorf("bad frame end")
+	}
+	return head[0], binary.BigEndian.Uint16(head[1:]), payload[:len(payload)-1], nil
+}
+
+func (c *fakeConn) writeFrame(typ byte, channel uint16, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrameLocked(typ, channel, payload)
+}
+
+func (c *fakeConn) writeFrameLocked(typ byte, channel uint16, payload []byte) error {
+	frame := make([]byte, 7, 8+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:], channel)
+	binary.BigEndian.PutUint32(frame[3:], uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = append(frame, frameEnd)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+type frameWriter struct {
+	bytes.Buffer
+}
+
+func (w *frameWriter) octet(v byte) {
+	w.WriteByte(v)
+}
+
+func (w *frameWriter) short(v uint16) {
+	w.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *frameWriter) long(v uint32) {
+	w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *frameWriter) longlong(v uint64) {
+	w.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *frameWriter) shortstr(s string) {
+	w.octet(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *frameWriter) longstr(s string) {
+	w.long(uint32(len(s)))
+	w.WriteString(s)
+}
+
+// frameReader reads method arguments, past the end it returns zero values
+type frameReader struct {
+	buf []byte
+	off int
+}
+
+func (r *frameReader) next(n int) []byte {
+	if r.off+n > len(r.buf) {
+		r.off = len(r.buf)
+		return make([]byte, n)
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *frameReader) octet() byte {
+	return r.next(1)[0]
+}
+
+func (r *frameReader) short() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *frameReader) long() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *frameReader) longlong() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *frameReader) shortstr() string {
+	return string(r.next(int(r.octet())))
+}
+
+func (r *frameReader) longstr() string {
+	return string(r.next(int(r.long())))
+}
+
+// table decodes the field types the client sends in queue arguments
+func (r *frameReader) table() amqp091.Table {
+	end := r.off + int(r.long())
+	t := amqp091.Table{}
+	for r.off < end && r.off < len(r.buf) {
+		key := r.shortstr()
+		switch r.octet() {
+		case 't':
+			t[key] = r.octet() != 0
+		case 'b':
+			t[key] = int8(r.octet())
+		case 's':
+			t[key] = int16(r.short())
+		case 'I':
+			t[key] = int32(r.long())
+		case 'l':
+			t[key] = int64(r.longlong())
+		case 'S':
+			t[key] = r.longstr()
+		case 'F':
+			t[key] = r.table()
+		case 'V':
+			t[key] = nil
+		default:
+			// unknown type, the rest cannot be read
+			r.off = len(r.buf)
+		}
+	}
+	return t
+}
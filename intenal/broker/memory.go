@@ -0,0 +1,280 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
+	"taxi-hailing/pkg"
+	"time"
+)
+
+const (
+	memoryQueueSize  = 1024
+	memoryRetryDelay = 10 * time.Millisecond
+)
+
+// MemoryBroker is an in-process broker with the same exchanges, queues and routing keys as rabbit,
+// so services can run without RabbitMQ, e.g. in tests. Both services share one instance:
+// the ride service consumes from Ride(), the driver service from Driver(), the outbox relays publish to it.
+// Retries and dead letters work like in rabbit, only with a shorter backoff.
+type MemoryBroker struct {
+	queues map[string]chan *memoryDelivery
+	stop   chan struct{}
+	once   sync.Once
+
+	mu   sync.Mutex
+	dead map[string][]domain.DeadLetter
+
+	rideStatus   chan Message[domain.RideStatusUpdate]
+	matches      chan Message[domain.RideResponseMatch]
+	locations    chan Message[domain.DriverLocationUpdate]
+	requests     chan Message[domain.RideRequestRabbit]
+	driverStatus chan Message[domain.RideStatusUpdate]
+}
+
+type memoryDelivery struct {
+	routingKey string
+	body       []byte
+	headers    map[string]string
+	retries    int
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	m := &MemoryBroker{
+		queues: make(map[string]chan *memoryDelivery),
+		stop:   make(chan struct{}),
+		dead:   make(map[string][]domain.DeadLetter),
+	}
+	for _, b := range bindings {
+		m.queues[b.queue] = make(chan *memoryDelivery, memoryQueueSize)
+	}
+	m.rideStatus = pump[domain.RideStatusUpdate](m, QueueRideStatus, maxDeliveryRetries)
+	m.matches = pump[domain.RideResponseMatch](m, QueueDriverResponses, maxDeliveryRetries)
+	m.locations = pump[domain.DriverLocationUpdate](m, QueueLocationUpdates, 0)
+	m.requests = pump[domain.RideRequestRabbit](m, QueueRideRequests, maxDeliveryRetries)
+	m.driverStatus = pump[domain.RideStatusUpdate](m, QueueDriverStatus, maxDeliveryRetries)
+	return m
+}
+
+// pump turns raw deliveries of the queue into typed messages for the consumer
+func pump[T any](m *MemoryBroker, queue string, retries int) chan Message[T] {
+	out := make(chan Message[T])
+	go func() {
+		for {
+			select {
+			case <-m.stop:
+				return
+			case d := <-m.queues[queue]:
+				msg := &jsonMessage[T]{
+					settler: &memoryMessage{broker: m, queue: queue, retries: retries, delivery: d},
+					body:    d.body,
+					headers: d.headers,
+				}
+				select {
+				case out <- msg:
+				case <-m.stop:
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+func (m *MemoryBroker) CloseRabbit() error {
+	m.once.Do(func() { close(m.stop) })
+	return nil
+}
+
+// Ready fails only after CloseRabbit
+func (m *MemoryBroker) Ready(ctx context.Context) error {
+	select {
+	case <-m.stop:
+		return ErrBrokerClosed
+	default:
+		return nil
+	}
+}
+
+// Ride is the consumer side of the ride service
+func (m *MemoryBroker) Ride() RideConsumer {
+	return &memoryRide{m}
+}
+
+// Driver is the consumer side of the driver service, it also publishes locations
+func (m *MemoryBroker) Driver() DriverRabbit {
+	return &memoryDriver{m}
+}
+
+func (m *MemoryBroker) PublishOutbox(ctx context.Context, msg *domain.OutboxMessage) error {
+	return m.publish(ctx, msg.Exchange, msg.RoutingKey, msg.Headers, msg.Payload)
+}
+
+func (m *MemoryBroker) PublishLocation(ctx context.Context, loc *domain.DriverLocationUpdate) error {
+	b, err := json.Marshal(loc)
+	if err != nil {
+		return err
+	}
+	return m.publish(ctx, domain.ExchangeLocationFanout, "", pkg.InjectHeaders(ctx), b)
+}
+
+// DeadLetters returns the messages dead lettered from the queue so far
+func (m *MemoryBroker) DeadLetters(queue string) []domain.DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]domain.DeadLetter(nil), m.dead[queue]...)
+}
+
+// publish routes the body to every bound queue, unroutable messages are dropped like in rabbit
+func (m *MemoryBroker) publish(ctx context.Context, exchange, key string, headers map[string]string, body []byte) error {
+	for _, b := range bindings {
+		if b.exchange != exchange || !topicMatch(b.pattern, key) {
+			continue
+		}
+		err := m.enqueue(ctx, b.queue, &memoryDelivery{routingKey: key, body: body, headers: headers})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBroker) enqueue(ctx context.Context, queue string, d *memoryDelivery) error {
+	select {
+	case m.queues[queue] <- d:
+		return nil
+	case <-m.stop:
+		return ErrBrokerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// topicMatch matches the routing key against a topic pattern: * is one word, # is zero or more words.
+// The empty pattern of a fanout binding matches everything.
+func topicMatch(pattern, key string) bool {
+	if pattern == "" {
+		return true
+	}
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(key) == 0 || (pattern[0] != "*" && pattern[0] != key[0]) {
+		return false
+	}
+	return matchWords(pattern[1:], key[1:])
+}
+
+// memoryMessage settles a delivery of the in-memory broker
+type memoryMessage struct {
+	broker   *MemoryBroker
+	queue    string
+	retries  int
+	delivery *memoryDelivery
+	settled  atomic.Bool
+}
+
+var errAlreadySettled = errors.New("message is already settled")
+
+func (mm *memoryMessage) Ack() error {
+	if !mm.settled.CompareAndSwap(false, true) {
+		return errAlreadySettled
+	}
+	metrics.MessagesSettled.WithLabelValues(mm.queue, metrics.OutcomeAck).Inc()
+	return nil
+}
+
+func (mm *memoryMessage) Nack(cause error) error {
+	if !mm.settled.CompareAndSwap(false, true) {
+		return errAlreadySettled
+	}
+	d := mm.delivery
+	if d.retries >= mm.retries {
+		metrics.MessagesSettled.WithLabelValues(mm.queue, metrics.OutcomeDeadLetter).Inc()
+		mm.deadLetter(cause)
+		return nil
+	}
+	metrics.MessagesSettled.WithLabelValues(mm.queue, metrics.OutcomeNack).Inc()
+	retry := &memoryDelivery{routingKey: d.routingKey, body: d.body, headers: d.headers, retries: d.retries + 1}
+	time.AfterFunc(memoryRetryDelay<<d.retries, func() {
+		err := mm.broker.enqueue(context.Background(), mm.queue, retry)
+		if err != nil {
+			mm.deadLetter(err)
+		}
+	})
+	return nil
+}
+
+func (mm *memoryMessage) Reject(cause error) error {
+	if !mm.settled.CompareAndSwap(false, true) {
+		return errAlreadySettled
+	}
+	metrics.MessagesSettled.WithLabelValues(mm.queue, metrics.OutcomeReject).Inc()
+	mm.deadLetter(cause)
+	return nil
+}
+
+func (mm *memoryMessage) deadLetter(cause error) {
+	dl := domain.DeadLetter{
+		Queue:      mm.queue,
+		RoutingKey: mm.delivery.routingKey,
+		Retries:    mm.delivery.retries,
+		Error:      cause.Error(),
+		Timestamp:  time.Now(),
+		Payload:    mm.delivery.body,
+	}
+	mm.broker.mu.Lock()
+	defer mm.broker.mu.Unlock()
+	mm.broker.dead[mm.queue] = append(mm.broker.dead[mm.queue], dl)
+}
+
+type memoryRide struct {
+	*MemoryBroker
+}
+
+func (r *memoryRide) GiveStatusChannel() <-chan Message[domain.RideStatusUpdate] {
+	return r.rideStatus
+}
+
+func (r *memoryRide) GiveResponeChannel() <-chan Message[domain.RideResponseMatch] {
+	return r.matches
+}
+
+func (r *memoryRide) GiveLocationChannel() <-chan Message[domain.DriverLocationUpdate] {
+	return r.locations
+}
+
+type memoryDriver struct {
+	*MemoryBroker
+}
+
+func (d *memoryDriver) GiveReqChannel() <-chan Message[domain.RideRequestRabbit] {
+	return d.requests
+}
+
+func (d *memoryDriver) GiveStatusChannel() <-chan Message[domain.RideStatusUpdate] {
+	return d.driverStatus
+}
+
+var (
+	_ RideConsumer    = (*RideBroker)(nil)
+	_ DriverRabbit    = (*DriverBroker)(nil)
+	_ OutboxPublisher = (*MemoryBroker)(nil)
+)
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newConfirmChannel opens a channel in confirm mode, publishes on it are acked by rabbit
+func newConfirmChannel(conn *amqp091.Connection) (*amqp091.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// publishConfirmed publishes the outbox message as persistent and waits until rabbit acks it.
+// The publish span continues the trace of the request which wrote the message.
+func publishConfirmed(ctx context.Context, ch *amqp091.Channel, msg *domain.OutboxMessage) error {
+	ctx, span := startPublishSpan(ctx, msg.Headers, msg.Exchange, msg.RoutingKey)
+	defer span.End()
+	err := confirmPublish(ctx, ch, msg.Exchange, msg.RoutingKey, amqp091.Publishing{
+		Headers:       amqpHeaders(ctx),
+		MessageId:     msg.ID,
+		CorrelationId: msg.Headers[domain.HeaderCorrelationID],
+		ContentType:   "application/json",
+		DeliveryMode:  amqp091.Persistent,
+		Priority:      msg.Priority,
+		Timestamp:     time.Now(),
+		Body:          msg.Payload,
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// startPublishSpan starts the producer span as a child of the trace in headers
+func startPublishSpan(ctx context.Context, headers map[string]string, exchange, key string) (context.Context, trace.Span) {
+	ctx = pkg.ExtractHeaders(ctx, headers)
+	ctx, span := pkg.Tracer().Start(ctx, "publish "+exchange, trace.WithSpanKind(trace.SpanKindProducer))
+	span.SetAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.destination.name", exchange),
+		attribute.String("messaging.rabbitmq.destination.routing_key", key),
+		pkg.CorrelationAttr(pkg.CorrelationID(ctx)),
+	)
+	return ctx, span
+}
+
+// amqpHeaders are the correlation id and the trace context of ctx for the consumer
+func amqpHeaders(ctx context.Context) amqp091.Table {
+	table := amqp091.Table{}
+	for k, v := range pkg.InjectHeaders(ctx) {
+		table[k] = v
+	}
+	return table
+}
+
+// confirmPublish publishes on a channel in confirm mode and waits for the ack
+func confirmPublish(ctx context.Context, ch *amqp091.Channel, exchange, key string, pub amqp091.Publishing) error {
+	conf, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, pub)
+	if err != nil {
+		return err
+	}
+	acked, err := conf.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("message %s nacked by rabbitmq", pub.MessageId)
+	}
+	return nil
+}
@@ -2,321 +2,88 @@ package broker
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"log/slog"
-	"sync/atomic"
 	"taxi-hailing/intenal/domain"
 	"taxi-hailing/pkg"
-	"time"
 
 	"github.com/rabbitmq/amqp091-go"
 )
 
 type RideBroker struct {
 	logger         *slog.Logger
-	conn           *amqp091.Connection
-	connClose      chan *amqp091.Error
-	status         chan *statusStu
-	locationUpdate chan *locationStu
-	drRespone      chan *matchResponse
-	ch             *amqp091.Channel //for publish with ch
-	isClosed       atomic.Bool
+	session        *session
+	status         chan Message[domain.RideStatusUpdate]
+	locationUpdate chan Message[domain.DriverLocationUpdate]
+	drRespone      chan Message[domain.RideResponseMatch]
 }
 
 func NewRideRabbit(cfg pkg.RabbitMQCfg, slogger *slog.Logger) (*RideBroker, error) {
 	dsn := fmt.Sprintf("amqp://%s:%s@%s:%d/", cfg.User, cfg.Password, cfg.Host, cfg.Port)
 	myRab := &RideBroker{
 		logger:         slogger,
-		status:         make(chan *statusStu),
-		locationUpdate: make(chan *locationStu),
+		status:         make(chan Message[domain.RideStatusUpdate]),
+		locationUpdate: make(chan Message[domain.DriverLocationUpdate]),
+		drRespone:      make(chan Message[domain.RideResponseMatch]),
 	}
 
-	err := myRab.createChannel(dsn)
+	session, err := newSession(dsn, slogger, myRab.setup)
 	if err != nil {
 		return nil, err
 	}
-
-	go myRab.reconnectConn(dsn)
+	myRab.session = session
 	return myRab, nil
 }
 
-func (r *RideBroker) GiveStatusChannel() <-chan *statusStu {
+func (r *RideBroker) GiveStatusChannel() <-chan Message[domain.RideStatusUpdate] {
 	return r.status
 }
 
 func (r *RideBroker) CloseRabbit() error {
-	r.isClosed.Store(true)
 	defer r.logger.Info("rabbit closed")
-	return r.conn.Close()
+	return r.session.close()
 }
 
-func (r *RideBroker) reconnectConn(url string) {
-	for {
-		<-r.connClose
-		if r.isClosed.Load() {
-			return
-		}
-		r.logger.Warn("rabbitMQ not working")
-		for {
-			if r.isClosed.Load() {
-				return
-			}
-			r.logger.Info("trying to connect to rabbitmq")
-			err := r.createChannel(url)
-			if err != nil {
-				time.Sleep(3 * time.Second)
-				continue
-			}
-			r.logger.Info("connected to rabbitmq")
-			break
-		}
-	}
+// Ready fails while the connection or one of its channels is down
+func (r *RideBroker) Ready(ctx context.Context) error {
+	return r.session.healthy()
 }
 
-func (r *RideBroker) createChannel(dsn string) error {
-	myConn, err := amqp091.Dial(dsn)
+// setup declares the topology and starts the consumers, it runs again after every reconnect
+func (r *RideBroker) setup(ch, confirmCh *amqp091.Channel) error {
+	err := declareTopology(ch)
 	if err != nil {
 		return err
 	}
-	r.conn = myConn
-	r.connClose = make(chan *amqp091.Error)
-	r.conn.NotifyClose(r.connClose)
-	ch, err := r.conn.Channel()
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	r.ch = ch
-
-	err = ch.ExchangeDeclare(
-		"ride_topic", // имя exchange
-		"topic",      // тип (direct, fanout, topic, headers)
-		true,         // durable
-		false,        // auto-deleted
-		false,        // internal
-		false,        // no-wait
-		nil,          // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	q1, err := ch.QueueDeclare("ride_requests", true, false, false, false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	err = ch.QueueBind(q1.Name, "ride.request.*", "ride_topic", false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	q2, err := ch.QueueDeclare("ride_status", true, false, false, false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	// err = ch.QueueBind(q2.Name, "ride.status.*", "ride_topic", false, nil)
-	// if err != nil {
-	// 	return errors.Join(r.conn.Close(), err)
-	// }
-
-	msgs, err := ch.Consume(
-		q2.Name,
-		"",
-		true, // manual ack
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	go func() {
-		for msg := range msgs {
-			r.status <- r.newStatus(&msg)
-		}
-	}()
-
-	//location update
-	err = ch.ExchangeDeclare(
-		"location_fanout", // имя exchange
-		"fanout",          // тип (direct, fanout, topic, headers)
-		true,              // durable
-		false,             // auto-deleted
-		false,             // internal
-		false,             // no-wait
-		nil,               // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	q3, err := ch.QueueDeclare(
-		"",    // name
-		false, // durable
-		false, // delete when unused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	err = ch.QueueBind(
-		q3.Name,           // queue name
-		"",                // routing key
-		"location_fanout", // exchange
-		false,
-		nil,
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	msgs2, err := ch.Consume(
-		q3.Name, // queue
-		"",      // consumer
-		true,    // auto-ack
-		false,   // exclusive
-		false,   // no-local
-		false,   // no-wait
-		nil,     // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	go func() {
-		for msg := range msgs2 {
-			r.locationUpdate <- r.newLocation(&msg)
-		}
-	}()
-
-	err = ch.ExchangeDeclare(
-		"driver_topic", // имя exchange
-		"topic",        // тип (direct, fanout, topic, headers)
-		true,           // durable
-		false,          // auto-deleted
-		false,          // internal
-		false,          // no-wait
-		nil,            // args
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-
-	q4, err := ch.QueueDeclare("driver_responses", true, false, false, false, nil)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	// err = ch.QueueBind(q4.Name, "driver.response.*", "driver_topic", false, nil)
-	// if err != nil {
-	// 	return errors.Join(r.conn.Close(), err)
-	// }
-
-	msgs3, err := ch.Consume(
-		q4.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return errors.Join(r.conn.Close(), err)
-	}
-	go func() {
-		for mgs := range msgs3 {
-			r.drRespone <- r.newDriverRespone(&mgs)
-		}
-	}()
-	return nil
-}
-
-type statusStu struct {
-	delivery *amqp091.Delivery
-}
-
-func (s *RideBroker) newStatus(hat *amqp091.Delivery) *statusStu {
-	return &statusStu{
-		hat,
-	}
-}
-
-func (s *statusStu) GiveBody() (*domain.RideStatusUpdate, error) {
-	status := new(domain.RideStatusUpdate)
-	err := json.Unmarshal(s.delivery.Body, status)
+	err = consumeQueue(ch, confirmCh, QueueRideStatus, QueueRideStatus, maxDeliveryRetries, r.status)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return status, nil
-}
-
-func (s *RideBroker) PublishRide(ctx context.Context, priority uint8, req *domain.RideRequestRabbit) error {
-	b, err := json.Marshal(req)
+	err = consumeQueue(ch, confirmCh, QueueDriverResponses, QueueDriverResponses, maxDeliveryRetries, r.drRespone)
 	if err != nil {
 		return err
 	}
-
-	return s.ch.PublishWithContext(
-		ctx,
-		"ride_topic",
-		fmt.Sprintf("ride.request.%s", req.RideType),
-		false,
-		false,
-		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        b,
-			Priority:    priority,
-		},
-	)
-}
-
-type locationStu struct {
-	location *amqp091.Delivery
-}
-
-func (s *RideBroker) newLocation(hat *amqp091.Delivery) *locationStu {
-	return &locationStu{
-		location: hat,
-	}
-}
-
-func (l *locationStu) GiveBody() (*domain.DriverLocationUpdate, error) {
-	loc := new(domain.DriverLocationUpdate)
-	err := json.Unmarshal(l.location.Body, loc)
+	locations, err := declareExclusive(ch, QueueLocationUpdates)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return loc, nil
+	// locations get stale fast, failed ones are dead lettered without retries
+	return consumeQueue(ch, confirmCh, locations, QueueLocationUpdates, 0, r.locationUpdate)
 }
 
-func (s *RideBroker) GiveLocationChannel() <-chan *locationStu {
+func (s *RideBroker) GiveLocationChannel() <-chan Message[domain.DriverLocationUpdate] {
 	return s.locationUpdate
 }
 
-type matchResponse struct {
-	delivery *amqp091.Delivery
-}
-
-func (s *RideBroker) newDriverRespone(hat *amqp091.Delivery) *matchResponse {
-	return &matchResponse{
-		delivery: hat,
-	}
+func (s *RideBroker) GiveResponeChannel() <-chan Message[domain.RideResponseMatch] {
+	return s.drRespone
 }
 
-func (dr *matchResponse) GiveBody() (*domain.RideResponseMatch, error) {
-	res := new(domain.RideResponseMatch)
-	err := json.Unmarshal(dr.delivery.Body, res)
+// PublishOutbox publishes the message saved by the repo and waits for the confirm from rabbit
+func (s *RideBroker) PublishOutbox(ctx context.Context, msg *domain.OutboxMessage) error {
+	l, err := s.session.current(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return res, nil
-}
-
-func (s *RideBroker) GiveResponeChannel() <-chan *matchResponse {
-	return s.drRespone
+	return publishConfirmed(ctx, l.confirmCh, msg)
 }
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+)
+
+var (
+	ErrBrokerClosed       = errors.New("rabbitmq broker is closed")
+	ErrBrokerReconnecting = errors.New("rabbitmq is reconnecting")
+)
+
+// link is one live connection with its channels
+type link struct {
+	conn      *amqp091.Connection
+	ch        *amqp091.Channel // for publish and consume
+	confirmCh *amqp091.Channel // in confirm mode, for outbox, retries and dead letters
+	lost      []chan *amqp091.Error
+}
+
+// session keeps the rabbit connection alive. On every (re)connect it opens fresh channels
+// and runs setup, which declares the topology and starts the consumers on them.
+// Any connection or channel error drops the whole link, so consumers never stay on a dead channel.
+type session struct {
+	logger *slog.Logger
+	dsn    string
+	setup  func(ch, confirmCh *amqp091.Channel) error
+
+	mu    sync.RWMutex
+	link  *link
+	ready chan struct{} // closed while connected, replaced when the link is lost
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession(dsn string, slogger *slog.Logger, setup func(ch, confirmCh *amqp091.Channel) error) (*session, error) {
+	s := &session{
+		logger: slogger,
+		dsn:    dsn,
+		setup:  setup,
+		ready:  make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	go s.keepAlive()
+	return s, nil
+}
+
+func (s *session) connect() error {
+	conn, err := amqp091.Dial(s.dsn)
+	if err != nil {
+		return err
+	}
+	l := &link{conn: conn}
+	l.lost = append(l.lost, conn.NotifyClose(make(chan *amqp091.Error, 1)))
+
+	l.ch, err = conn.Channel()
+	if err != nil {
+		return errors.Join(err, conn.Close())
+	}
+	l.lost = append(l.lost, l.ch.NotifyClose(make(chan *amqp091.Error, 1)))
+	// without a limit rabbit pushes the whole queue to the first consumer
+	err = l.ch.Qos(consumerPrefetch, 0, false)
+	if err != nil {
+		return errors.Join(err, conn.Close())
+	}
+
+	l.confirmCh, err = newConfirmChannel(conn)
+	if err != nil {
+		return errors.Join(err, conn.Close())
+	}
+	l.lost = append(l.lost, l.confirmCh.NotifyClose(make(chan *amqp091.Error, 1)))
+
+	err = s.setup(l.ch, l.confirmCh)
+	if err != nil {
+		return errors.Join(err, conn.Close())
+	}
+
+	s.mu.Lock()
+	s.link = l
+	close(s.ready)
+	s.mu.Unlock()
+	return nil
+}
+
+// keepAlive waits until the link is lost and connects again with backoff
+func (s *session) keepAlive() {
+	for {
+		s.mu.RLock()
+		l := s.link
+		s.mu.RUnlock()
+
+		var reason *amqp091.Error
+		select {
+		case <-s.stop:
+			return
+		case reason = <-l.lost[0]:
+		case reason = <-l.lost[1]:
+		case reason = <-l.lost[2]:
+		}
+
+		s.mu.Lock()
+		s.ready = make(chan struct{})
+		s.mu.Unlock()
+		// a channel error keeps the connection open, close it so every consumer restarts
+		l.conn.Close()
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		s.logger.Warn("rabbitMQ not working", "action", "reconnect rabbitMQ", "error", reason)
+		if !s.reconnect() {
+			return
+		}
+	}
+}
+
+func (s *session) reconnect() bool {
+	delay := reconnectMinDelay
+	for {
+		s.logger.Info("trying to connect to rabbitmq", "action", "reconnect rabbitMQ")
+		err := s.connect()
+		if err == nil {
+			s.logger.Info("connected to rabbitmq", "action", "reconnect rabbitMQ")
+			return true
+		}
+		s.logger.Error("cannot connect to rabbitmq", "action", "reconnect rabbitMQ", "retry_in", delay.String(), "error", err)
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+// current waits until the session is connected, so publishes during an outage
+// either go out after the reconnect or fail when ctx is done
+func (s *session) current(ctx context.Context) (*link, error) {
+	for {
+		select {
+		case <-s.stop:
+			return nil, ErrBrokerClosed
+		default:
+		}
+		s.mu.RLock()
+		ready, l := s.ready, s.link
+		s.mu.RUnlock()
+		select {
+		case <-ready:
+			return l, nil
+		default:
+		}
+		select {
+		case <-ready:
+			// connected meanwhile, read the new link
+		case <-s.stop:
+			return nil, ErrBrokerClosed
+		case <-ctx.Done():
+			return nil, fmt.Errorf("rabbitmq is not connected: %w", ctx.Err())
+		}
+	}
+}
+
+// healthy reports whether the session can publish right now. It fails while
+// keepAlive is reconnecting, even before the lost link has been noticed.
+func (s *session) healthy() error {
+	select {
+	case <-s.stop:
+		return ErrBrokerClosed
+	default:
+	}
+	s.mu.RLock()
+	ready, l := s.ready, s.link
+	s.mu.RUnlock()
+	select {
+	case <-ready:
+	default:
+		return ErrBrokerReconnecting
+	}
+	if l.conn.IsClosed() || l.ch.IsClosed() || l.confirmCh.IsClosed() {
+		return ErrBrokerReconnecting
+	}
+	return nil
+}
+
+func (s *session) close() error {
+	err := ErrBrokerClosed
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		err = s.link.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const waitTimeout = 10 * time.Second
+
+// readier is the readiness check of both brokers
+type readier interface {
+	Ready(ctx context.Context) error
+	CloseRabbit() error
+}
+
+func TestRideBrokerReconnect(t *testing.T) {
+	srv := newFakeRabbit(t)
+	rb, err := NewRideRabbit(srv.cfg(), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { rb.CloseRabbit() })
+
+	before := srv.topology()
+	checkTopology(t, before)
+	location := exclusiveQueue(t, before)
+	checkConsumers(t, before, QueueRideStatus, QueueDriverResponses, location)
+
+	outage(t, srv, rb)
+
+	after := srv.topology()
+	checkTopology(t, after)
+	checkSame(t, before, after)
+	receive(t, srv, QueueRideStatus, rb.GiveStatusChannel())
+	receive(t, srv, QueueDriverResponses, rb.GiveResponeChannel())
+	receive(t, srv, exclusiveQueue(t, after), rb.GiveLocationChannel())
+}
+
+func TestDriverBrokerReconnect(t *testing.T) {
+	srv := newFakeRabbit(t)
+	db, err := NewDriverRabbit(srv.cfg(), slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.CloseRabbit() })
+
+	before := srv.topology()
+	checkTopology(t, before)
+	checkConsumers(t, before, QueueDriverStatus, QueueRideRequests)
+
+	outage(t, srv, db)
+
+	after := srv.topology()
+	checkTopology(t, after)
+	checkSame(t, before, after)
+	receive(t, srv, QueueDriverStatus, db.GiveStatusChannel())
+	receive(t, srv, QueueRideRequests, db.GiveReqChannel())
+}
+
+// outage drops the connection, checks the broker is not ready while rabbit refuses it
+// and waits until it is connected again
+func outage(t *testing.T, srv *fakeRabbit, b readier) {
+	t.Helper()
+	ctx := context.Background()
+	err := b.Ready(ctx)
+	if err != nil {
+		t.Fatalf("ready before the outage: %v", err)
+	}
+
+	srv.setRefuse(true)
+	srv.drop()
+	eventually(t, "broker notices the lost connection", func() bool {
+		return errors.Is(b.Ready(ctx), ErrBrokerReconnecting)
+	})
+	eventually(t, "broker tries to reconnect", func() bool { return srv.refusedCount() > 0 })
+	err = b.Ready(ctx)
+	if !errors.Is(err, ErrBrokerReconnecting) {
+		t.Fatalf("ready while rabbit is down = %v, want %v", err, ErrBrokerReconnecting)
+	}
+
+	srv.setRefuse(false)
+	eventually(t, "broker reconnects", func() bool { return b.Ready(ctx) == nil })
+}
+
+// checkTopology checks every exchange, durable queue with its retry and dead letter queues,
+// and binding of the bindings table was declared
+func checkTopology(t *testing.T, topo topology) {
+	t.Helper()
+	for name, kind := range exchanges {
+		if topo.exchanges[name] != kind {
+			t.Errorf("exchange %s is %q, want %q", name, topo.exchanges[name], kind)
+		}
+	}
+	for _, b := range bindings {
+		// only the consumer of an exclusive queue declares it
+		if b.exclusive {
+			continue
+		}
+		checkDeadLetter(t, topo, b.queue)
+		q, ok := topo.queues[b.queue]
+		if !ok || !q.durable {
+			t.Errorf("queue %s is not declared durable", b.queue)
+		}
+		if q.args["x-dead-letter-exchange"] != deadLetterExchange(b.queue) {
+			t.Errorf("queue %s dead letters to %v", b.queue, q.args["x-dead-letter-exchange"])
+		}
+		if !topo.bindings[b.exchange+" "+b.pattern+" "+b.queue] {
+			t.Errorf("queue %s is not bound to %s %s", b.queue, b.exchange, b.pattern)
+		}
+		for n := range maxDeliveryRetries {
+			delay := retryDelay(n)
+			want := amqp091.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": b.queue,
+			}
+			retry := topo.queues[retryQueue(b.queue, delay)]
+			if !reflect.DeepEqual(retry.args, want) {
+				t.Errorf("retry queue %s has %v, want %v", retryQueue(b.queue, delay), retry.args, want)
+			}
+		}
+	}
+}
+
+func checkDeadLetter(t *testing.T, topo topology, queue string) {
+	t.Helper()
+	if topo.exchanges[deadLetterExchange(queue)] != "fanout" {
+		t.Errorf("dead letter exchange of %s is not declared", queue)
+	}
+	if _, ok := topo.queues[deadLetterQueue(queue)]; !ok {
+		t.Errorf("dead letter queue of %s is not declared", queue)
+	}
+	if !topo.bindings[deadLetterExchange(queue)+"  "+deadLetterQueue(queue)] {
+		t.Errorf("dead letter queue of %s is not bound", queue)
+	}
+}
+
+// exclusiveQueue returns the generated name of the location queue
+func exclusiveQueue(t *testing.T, topo topology) string {
+	t.Helper()
+	checkDeadLetter(t, topo, QueueLocationUpdates)
+	b, _ := bindingOf(QueueLocationUpdates)
+	for name, q := range topo.queues {
+		if q.exclusive {
+			if q.args["x-dead-letter-exchange"] != deadLetterExchange(QueueLocationUpdates) {
+				t.Errorf("location queue dead letters to %v", q.args["x-dead-letter-exchange"])
+			}
+			if !topo.bindings[b.exchange+" "+b.pattern+" "+name] {
+				t.Errorf("location queue %s is not bound", name)
+			}
+			return name
+		}
+	}
+	t.Fatalf("no exclusive location queue")
+	return ""
+}
+
+func checkConsumers(t *testing.T, topo topology, queues ...string) {
+	t.Helper()
+	got := slices.Sorted(maps.Keys(topo.consumers))
+	slices.Sort(queues)
+	if !slices.Equal(got, queues) {
+		t.Errorf("consumers of %v, want %v", got, queues)
+	}
+}
+
+// checkSame compares two connections' topologies, consumer tags differ between connections
+func checkSame(t *testing.T, before, after topology) {
+	t.Helper()
+	if !reflect.DeepEqual(before.exchanges, after.exchanges) {
+		t.Errorf("exchanges after reconnect %v, want %v", after.exchanges, before.exchanges)
+	}
+	if !reflect.DeepEqual(before.queues, after.queues) {
+		t.Errorf("queues after reconnect %v, want %v", after.queues, before.queues)
+	}
+	if !reflect.DeepEqual(before.bindings, after.bindings) {
+		t.Errorf("bindings after reconnect %v, want %v", after.bindings, before.bindings)
+	}
+	checkConsumers(t, after, slices.Collect(maps.Keys(before.consumers))...)
+}
+
+// receive delivers a message to the queue and waits for it on the consumer's channel
+func receive[T any](t *testing.T, srv *fakeRabbit, queue string, ch <-chan Message[T]) {
+	t.Helper()
+	err := srv.deliver(queue, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("deliver to %s: %v", queue, err)
+	}
+	select {
+	case msg := <-ch:
+		_, err := msg.GiveBody()
+		if err != nil {
+			t.Errorf("body from %s: %v", queue, err)
+		}
+		err = msg.Ack()
+		if err != nil {
+			t.Errorf("ack from %s: %v", queue, err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("consumer of %s did not resume", queue)
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
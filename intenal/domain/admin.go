@@ -0,0 +1,113 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// http admin
+type SystemOverview struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Metrics   OverviewMetrics `json:"metrics"`
+}
+
+type OverviewMetrics struct {
+	ActiveRides                int     `json:"active_rides"`
+	AvailableDrivers           int     `json:"available_drivers"`
+	BusyDrivers                int     `json:"busy_drivers"`
+	TotalRidesToday            int     `json:"total_rides_today"`
+	TotalRevenueToday          float64 `json:"total_revenue_today"`
+	AverageWaitTimeMinutes     float64 `json:"average_wait_time_minutes"`
+	AverageRideDurationMinutes float64 `json:"average_ride_duration_minutes"`
+	CancellationRate           float64 `json:"cancellation_rate"`
+}
+
+// http admin
+type ActiveRide struct {
+	RideID             string     `json:"ride_id"`
+	RideNumber         string     `json:"ride_number"`
+	Status             string     `json:"status"`
+	PassengerID        string     `json:"passenger_id"`
+	DriverID           string     `json:"driver_id,omitempty"`
+	VehicleType        string     `json:"vehicle_type"`
+	PickupAddress      string     `json:"pickup_address"`
+	DestinationAddress string     `json:"destination_address"`
+	EstimatedFare      float64    `json:"estimated_fare"`
+	RequestedAt        time.Time  `json:"requested_at"`
+	StartedAt          *time.Time `json:"started_at,omitempty"`
+}
+
+// http admin
+type ActiveRidesResponse struct {
+	Rides      []ActiveRide `json:"rides"`
+	TotalCount int          `json:"total_count"`
+	Page       int          `json:"page"`
+	PageSize   int          `json:"page_size"`
+}
+
+// http admin
+type OnlineDriver struct {
+	DriverID         string    `json:"driver_id"`
+	Name             string    `json:"name"`
+	Status           string    `json:"status"`
+	VehicleType      string    `json:"vehicle_type"`
+	Rating           float64   `json:"rating"`
+	Location         *Location `json:"location,omitempty"`
+	SessionStartedAt time.Time `json:"session_started_at"`
+	RidesCompleted   int       `json:"rides_completed"`
+	Earnings         float64   `json:"earnings"`
+}
+
+// http admin
+type OnlineDriversResponse struct {
+	Drivers    []OnlineDriver `json:"drivers"`
+	TotalCount int            `json:"total_count"`
+}
+
+// http admin
+type RevenueReport struct {
+	From          time.Time            `json:"from"`
+	To            time.Time            `json:"to"`
+	TotalRides    int                  `json:"total_rides"`
+	TotalRevenue  float64              `json:"total_revenue"`
+	ByVehicleType []VehicleTypeRevenue `json:"by_vehicle_type"`
+}
+
+type VehicleTypeRevenue struct {
+	VehicleType  string  `json:"vehicle_type"`
+	Rides        int     `json:"rides"`
+	Revenue      float64 `json:"revenue"`
+	AverageFare  float64 `json:"average_fare"`
+	CancelledCnt int     `json:"cancelled"`
+}
+
+// http admin
+type RideEvent struct {
+	ID        string         `json:"id"`
+	EventType string         `json:"event_type"`
+	EventData map[string]any `json:"event_data"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// DeadLetter is a message which failed all retries, shown to admin
+type DeadLetter struct {
+	MessageID  string          `json:"message_id,omitempty"`
+	Queue      string          `json:"queue"`
+	RoutingKey string          `json:"routing_key"`
+	Retries    int             `json:"retries"`
+	Error      string          `json:"error,omitempty"`
+	Timestamp  time.Time       `json:"timestamp,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type DeadLettersResponse struct {
+	Queue      string       `json:"queue"`
+	Messages   []DeadLetter `json:"messages"`
+	TotalCount int          `json:"total_count"`
+}
+
+type RedriveResponse struct {
+	Queue     string `json:"queue"`
+	Redriven  int    `json:"redriven"`
+	Remaining int    `json:"remaining"`
+}
@@ -0,0 +1,60 @@
+package domain
+
+import "time"
+
+// session revoke reasons, stored in auth_sessions.revoked_reason
+const (
+	RevokeLogout          = "LOGOUT"
+	RevokeBanned          = "BANNED"
+	RevokeReused          = "REFRESH_REUSED"
+	RevokePasswordChanged = "PASSWORD_CHANGED"
+)
+
+// Session is one login of a user, kept alive by its refresh token
+type Session struct {
+	ID          string
+	UserID      string
+	RefreshHash string // sha256 of the refresh token, the token itself is never stored
+	ExpiresAt   time.Time
+}
+
+// SessionUser is the user behind a refreshed session, the new access token is built from it
+type SessionUser struct {
+	SessionID string
+	UserID    string
+	Name      string
+	Email     string
+	Role      string
+	Status    string
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RegisterRequest is POST /auth/register. Drivers also send the license and the vehicle,
+// admins are not registered through the api.
+type RegisterRequest struct {
+	Role string `json:"role"`
+	DriverRegisterRequest
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// UserInfo is GET /auth/me, the user without the password hash
+type UserInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 type Driver struct {
 	ID            string  `json:"id"`
 	Name          string  `json:"name"`
@@ -13,6 +15,16 @@ type Driver struct {
 	IsVerified    bool    `json:"is_verified"`
 }
 
+// http
+type DriverRegisterRequest struct {
+	Name          string  `json:"name"`
+	Email         string  `json:"email"`
+	Password      string  `json:"password"`
+	LicenseNumber string  `json:"license_number"`
+	VehicleType   string  `json:"vehicle_type"`
+	VehicleAttrs  Vehicle `json:"vehicle_attrs"`
+}
+
 type CompleteRideRequest struct {
 	RideID                string   `json:"ride_id"`
 	FinalLocation         Location `json:"final_location"`
@@ -74,3 +86,59 @@ type DriverCompleteRideResponse struct {
 	DriverEarnings float64 `json:"driver_earnings"`
 	Message        string  `json:"message"`
 }
+
+// matching
+type DriverCandidate struct {
+	DriverID   string   `json:"driver_id"`
+	Name       string   `json:"name"`
+	Rating     float64  `json:"rating"`
+	Vehicle    Vehicle  `json:"vehicle"`
+	Location   Location `json:"location"`
+	DistanceKM float64  `json:"distance_km"`
+}
+
+// ws driver
+type OfferLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Address   string  `json:"address,omitempty"`
+}
+
+// ws driver
+type RideOffer struct {
+	Type                string        `json:"type"`
+	OfferID             string        `json:"offer_id"`
+	RideID              string        `json:"ride_id"`
+	RideNumber          string        `json:"ride_number"`
+	PickupLocation      OfferLocation `json:"pickup_location"`
+	DestinationLocation OfferLocation `json:"destination_location"`
+	EstimatedFare       float64       `json:"estimated_fare"`
+	DriverEarnings      float64       `json:"driver_earnings"`
+	DistanceToPickupKM  float64       `json:"distance_to_pickup_km"`
+	ExpiresAt           time.Time     `json:"expires_at"`
+	CorrelationID       string        `json:"correlation_id,omitempty"`
+}
+
+// ws driver
+type RideOfferResponse struct {
+	Type            string        `json:"type"`
+	OfferID         string        `json:"offer_id"`
+	RideID          string        `json:"ride_id"`
+	Accepted        bool          `json:"accepted"`
+	CurrentLocation OfferLocation `json:"current_location"`
+}
+
+// ws driver
+type RideOfferExpired struct {
+	Type    string `json:"type"`
+	OfferID string `json:"offer_id"`
+	RideID  string `json:"ride_id"`
+}
+
+// ws driver
+type RideCancelledMessage struct {
+	Type          string `json:"type"`
+	RideID        string `json:"ride_id"`
+	Reason        string `json:"reason"`
+	CorrelationID string `json:"correlation_id"`
+}
@@ -3,7 +3,13 @@ package domain
 import "errors"
 
 var (
-	ErrNotFound = errors.New("not found")
-	Errconflict = errors.New("conflict")
-	
+	ErrNotFound  = errors.New("not found")
+	Errconflict  = errors.New("conflict")
+	ErrForbidden = errors.New("forbidden")
+	// the token's session is revoked or expired, or the user is banned
+	ErrUnauthorized = errors.New("unauthorized")
+
+	ErrDriverNotConnected = errors.New("driver is not connected")
+	ErrOfferPending       = errors.New("driver already has a pending offer")
+	ErrOfferTimeout       = errors.New("offer timeout")
 )
@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// rabbit exchanges
+const (
+	ExchangeRideTopic      = "ride_topic"
+	ExchangeDriverTopic    = "driver_topic"
+	ExchangeLocationFanout = "location_fanout"
+)
+
+// OutboxMessage is a rabbit message saved in the same tx as the change it announces,
+// the relay publishes it later
+type OutboxMessage struct {
+	ID         string
+	Exchange   string
+	RoutingKey string
+	Priority   uint8
+	Payload    []byte
+	Attempts   int
+	// AMQP headers: the correlation id and the trace context of the writer
+	Headers map[string]string
+}
+
+// HeaderCorrelationID is the AMQP header with the correlation id of the ride
+const HeaderCorrelationID = "x-correlation-id"
+
+func newOutboxMessage(exchange, routingKey string, priority uint8, correlationID string, body any) (*OutboxMessage, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	msg := &OutboxMessage{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		Priority:   priority,
+		Payload:    b,
+		Headers:    make(map[string]string),
+	}
+	if correlationID != "" {
+		msg.Headers[HeaderCorrelationID] = correlationID
+	}
+	return msg, nil
+}
+
+// NewRideRequestMessage goes to the driver service for matching
+func NewRideRequestMessage(req *RideRequestRabbit, priority uint8) (*OutboxMessage, error) {
+	return newOutboxMessage(ExchangeRideTopic, fmt.Sprintf("ride.request.%s", req.RideType), priority, req.CorrelationID, req)
+}
+
+// NewRideStatusMessage goes to the ride service when the driver moves the ride
+func NewRideStatusMessage(status *RideStatusUpdate) (*OutboxMessage, error) {
+	return newOutboxMessage(ExchangeRideTopic, fmt.Sprintf("ride.status.%s", status.Status), 0, status.CorrelationID, status)
+}
+
+// NewDriverStatusMessage goes to the driver service when the passenger changes the ride
+func NewDriverStatusMessage(status *RideStatusUpdate) (*OutboxMessage, error) {
+	return newOutboxMessage(ExchangeDriverTopic, fmt.Sprintf("driver.status.%s", status.DriverID), 0, status.CorrelationID, status)
+}
+
+// NewMatchMessage goes to the ride service when a driver accepted the ride
+func NewMatchMessage(match *RideResponseMatch) (*OutboxMessage, error) {
+	return newOutboxMessage(ExchangeDriverTopic, fmt.Sprintf("driver.response.%s", match.RideID), 0, match.CorrelationID, match)
+}
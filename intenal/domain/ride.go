@@ -28,6 +28,7 @@ type RideRequest struct {
 	EstimatedFare        float64
 	FinalFare            float64
 	RideType             string `json:"ride_type"`
+	Quote                string `json:"quote,omitempty"` // from /rides/estimate, its fare is charged
 }
 
 // http
@@ -38,14 +39,52 @@ type RideResponse struct {
 	EstimatedFare            float64 `json:"estimated_fare"`
 	EstimatedDurationMinutes int     `json:"estimated_duration_minutes"`
 	EstimatedDistanceKM      float64 `json:"estimated_distance_km"`
+	Currency                 string  `json:"currency"`
+	TariffID                 string  `json:"tariff_id"`
+	TariffVersion            int     `json:"tariff_version"`
 	BaseFare                 float64 //for sql coordinate
 }
 
+// http
+type FareEstimateRequest struct {
+	PickupLatitude       float64 `json:"pickup_latitude"`
+	PickupLongitude      float64 `json:"pickup_longitude"`
+	DestinationLatitude  float64 `json:"destination_latitude"`
+	DestinationLongitude float64 `json:"destination_longitude"`
+}
+
+type FareEstimate struct {
+	RideType      string  `json:"ride_type"`
+	EstimatedFare float64 `json:"estimated_fare"`
+	BaseFare      float64 `json:"base_fare"`
+	BookingFee    float64 `json:"booking_fee"`
+	MinFare       float64 `json:"min_fare"`
+	Currency      string  `json:"currency"`
+	TariffVersion int     `json:"tariff_version"`
+}
+
+// http
+type FareEstimateResponse struct {
+	EstimatedDistanceKM      float64        `json:"estimated_distance_km"`
+	EstimatedDurationMinutes int            `json:"estimated_duration_minutes"`
+	Estimates                []FareEstimate `json:"estimates"`
+	Quote                    string         `json:"quote"`
+	ExpiresAt                time.Time      `json:"expires_at"`
+}
+
 // http
 type CancelRideRequest struct {
 	Reason string `json:"reason"`
 }
 
+// reasons of cancellations which are not the passenger's
+const (
+	// nobody accepted the ride within the matching window
+	CancelReasonNoDriver = "no_driver"
+	// the ride went to another driver or was cancelled before the driver's accept reached it
+	CancelReasonMatchLost = "match_lost"
+)
+
 // http
 type CancelRideResponse struct {
 	RideID      string    `json:"ride_id"`
@@ -74,6 +113,7 @@ type RideStatusUpdate struct {
 	Timestamp     time.Time `json:"timestamp"`
 	DriverID      string    `json:"driver_id"`
 	CorrelationID string    `json:"correlation_id"`
+	Reason        string    `json:"reason,omitempty"`
 }
 
 // rabbit kerek
@@ -146,6 +186,7 @@ type DriverInfoWs struct {
 }
 
 type DriverLocationUpdate struct {
+	Type     string `json:"type,omitempty"`
 	DriverID string `json:"driver_id"`
 	RideID   string `json:"ride_id"`
 	Location struct {
@@ -155,6 +196,7 @@ type DriverLocationUpdate struct {
 	SpeedKmh       float64   `json:"speed_kmh"`
 	HeadingDegrees float64   `json:"heading_degrees"`
 	Timestamp      time.Time `json:"timestamp"`
+	CorrelationID  string    `json:"correlation_id,omitempty"`
 }
 
 type CoordinateUpdate struct {
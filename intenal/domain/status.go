@@ -0,0 +1,135 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ride_status
+const (
+	RideRequested  = "REQUESTED"
+	RideMatched    = "MATCHED"
+	RideEnRoute    = "EN_ROUTE"
+	RideArrived    = "ARRIVED"
+	RideInProgress = "IN_PROGRESS"
+	RideCompleted  = "COMPLETED"
+	RideCancelled  = "CANCELLED"
+)
+
+// driver_status
+const (
+	DriverOffline   = "OFFLINE"
+	DriverAvailable = "AVAILABLE"
+	DriverBusy      = "BUSY"
+	DriverEnRoute   = "EN_ROUTE"
+)
+
+// ride_event_type
+const (
+	EventRideRequested = "RIDE_REQUESTED"
+	EventDriverMatched = "DRIVER_MATCHED"
+	EventDriverArrived = "DRIVER_ARRIVED"
+	EventRideStarted   = "RIDE_STARTED"
+	EventRideCompleted = "RIDE_COMPLETED"
+	EventRideCancelled = "RIDE_CANCELLED"
+	EventStatusChanged = "STATUS_CHANGED"
+)
+
+var ErrInvalidTransition = fmt.Errorf("%w: invalid status transition", Errconflict)
+
+// ErrStatusAhead is a status which skips steps the ride has not applied yet, e.g. ARRIVED while it is MATCHED.
+// It is not a conflict: the skipped statuses are still on their way, the message is retried until they came.
+var ErrStatusAhead = errors.New("status is ahead of the ride")
+
+// ErrMatchLost is an accept which came after the ride was matched to another driver or cancelled
+var ErrMatchLost = fmt.Errorf("%w: match lost", Errconflict)
+
+// rideProgress is the order of the statuses of a ride, CANCELLED can end it at any point
+var rideProgress = []string{RideRequested, RideMatched, RideEnRoute, RideArrived, RideInProgress, RideCompleted}
+
+// RideTransition says what to record when the ride moves to a new status
+type RideTransition struct {
+	From            string
+	To              string
+	EventType       string
+	TimestampColumn string // rides column set to now(), empty if none
+}
+
+var rideTransitions = map[string]map[string]RideTransition{
+	RideRequested: {
+		RideMatched:   {EventType: EventDriverMatched, TimestampColumn: "matched_at"},
+		RideCancelled: {EventType: EventRideCancelled, TimestampColumn: "cancelled_at"},
+	},
+	RideMatched: {
+		RideEnRoute:   {EventType: EventStatusChanged},
+		RideCancelled: {EventType: EventRideCancelled, TimestampColumn: "cancelled_at"},
+	},
+	RideEnRoute: {
+		RideArrived:   {EventType: EventDriverArrived, TimestampColumn: "arrived_at"},
+		RideCancelled: {EventType: EventRideCancelled, TimestampColumn: "cancelled_at"},
+	},
+	RideArrived: {
+		RideInProgress: {EventType: EventRideStarted, TimestampColumn: "started_at"},
+		RideCancelled:  {EventType: EventRideCancelled, TimestampColumn: "cancelled_at"},
+	},
+	RideInProgress: {
+		RideCompleted: {EventType: EventRideCompleted, TimestampColumn: "completed_at"},
+		RideCancelled: {EventType: EventRideCancelled, TimestampColumn: "cancelled_at"},
+	},
+}
+
+// NextRideStatus returns the transition from -> to, ErrStatusAhead if the ride has not reached
+// the status before to yet, otherwise ErrInvalidTransition
+func NextRideStatus(from, to string) (RideTransition, error) {
+	t, ok := rideTransitions[from][to]
+	if !ok {
+		if RideBehind(from, to) {
+			return RideTransition{}, fmt.Errorf("%w: ride %s -> %s", ErrStatusAhead, from, to)
+		}
+		return RideTransition{}, fmt.Errorf("%w: ride %s -> %s", ErrInvalidTransition, from, to)
+	}
+	t.From = from
+	t.To = to
+	return t, nil
+}
+
+// RideBehind is true when the ride is active and has not reached status yet
+func RideBehind(current, status string) bool {
+	c := slices.Index(rideProgress, current)
+	return c >= 0 && c < slices.Index(rideProgress, status)
+}
+
+// IsRideActive is true for rides which are not finished yet
+func IsRideActive(status string) bool {
+	switch status {
+	case RideRequested, RideMatched, RideEnRoute, RideArrived, RideInProgress:
+		return true
+	}
+	return false
+}
+
+var driverTransitions = map[string][]string{
+	DriverOffline:   {DriverAvailable},
+	DriverAvailable: {DriverOffline, DriverEnRoute},
+	DriverEnRoute:   {DriverBusy, DriverAvailable},
+	DriverBusy:      {DriverAvailable},
+}
+
+// CheckDriverTransition returns ErrInvalidTransition if the driver can not move from -> to
+func CheckDriverTransition(from, to string) error {
+	for _, next := range driverTransitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: driver %s -> %s", ErrInvalidTransition, from, to)
+}
+
+// CheckDriverStatus is for actions which need the driver in a status but do not change it (e.g. arrived)
+func CheckDriverStatus(current, want string) error {
+	if current != want {
+		return fmt.Errorf("%w: driver is %s, expected %s", ErrInvalidTransition, current, want)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"math"
+	"time"
+)
+
+// Tariff is one version of the prices of a vehicle type. Versions are never changed once
+// created, a new price is a new version with a later effective_from. Every ride keeps the
+// version which priced it.
+type Tariff struct {
+	ID                 string    `json:"id"`
+	VehicleType        string    `json:"vehicle_type"`
+	Version            int       `json:"version"`
+	EffectiveFrom      time.Time `json:"effective_from"`
+	Currency           string    `json:"currency"`
+	BaseFare           float64   `json:"base_fare"`
+	RatePerKM          float64   `json:"rate_per_km"`
+	RatePerMin         float64   `json:"rate_per_min"`
+	MinFare            float64   `json:"min_fare"`
+	BookingFee         float64   `json:"booking_fee"`
+	WaitingFreeMinutes int       `json:"waiting_free_minutes"` // at pickup, before the waiting charge starts
+	WaitingRatePerMin  float64   `json:"waiting_rate_per_min"`
+	Priority           int       `json:"priority"`
+	CreatedAt          time.Time `json:"created_at"`
+	Active             bool      `json:"active"` // the version in effect now, set by listings
+}
+
+// Start is the meter when the ride is booked
+func (t *Tariff) Start() float64 {
+	return t.BaseFare + t.BookingFee
+}
+
+// Running is what the meter grows by for a stretch of the ride
+func (t *Tariff) Running(distanceKM, durationMin float64) float64 {
+	return distanceKM*t.RatePerKM + durationMin*t.RatePerMin
+}
+
+// Estimate is the fare of a ride of this length, without waiting at pickup
+func (t *Tariff) Estimate(distanceKM, durationMin float64) float64 {
+	return t.Final(t.Start()+t.Running(distanceKM, durationMin), 0)
+}
+
+// WaitingCharge is for the time the driver waited at pickup beyond the free minutes
+func (t *Tariff) WaitingCharge(waiting time.Duration) float64 {
+	paid := waiting.Minutes() - float64(t.WaitingFreeMinutes)
+	if paid <= 0 {
+		return 0
+	}
+	return paid * t.WaitingRatePerMin
+}
+
+// Final is the fare charged for the meter and the waiting time, at least MinFare, rounded to cents
+func (t *Tariff) Final(meter float64, waiting time.Duration) float64 {
+	fare := max(meter+t.WaitingCharge(waiting), t.MinFare)
+	return math.Round(fare*100) / 100
+}
+
+// http
+type TariffsResponse struct {
+	Tariffs []Tariff `json:"tariffs"`
+}
@@ -0,0 +1,67 @@
+// Package jwks holds the Ed25519 keys access tokens are signed with. The auth service keeps the
+// private keys in a KeyRing and publishes the public halves as a JWK set, the other services
+// verify tokens with a Remote copy of that set.
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownKey      = errors.New("unknown signing key")
+	ErrKeysUnavailable = errors.New("signing keys are not available yet")
+)
+
+// Keys resolves the kid of a token to the public key it was signed with
+type Keys interface {
+	PublicKey(ctx context.Context, kid string) (ed25519.PublicKey, error)
+}
+
+// Signer gives the key new tokens are signed with
+type Signer interface {
+	SigningKey() (kid string, key ed25519.PrivateKey, err error)
+}
+
+// Set is the JWK set served on /.well-known/jwks.json
+type Set struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is an Ed25519 public key (RFC 8037)
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	X   string `json:"x"`
+}
+
+func newJWK(kid string, key ed25519.PublicKey) JWK {
+	return JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		Alg: "EdDSA",
+		Use: "sig",
+		Kid: kid,
+		X:   base64.RawURLEncoding.EncodeToString(key),
+	}
+}
+
+func (k JWK) publicKey() (ed25519.PublicKey, error) {
+	if k.Kty != "OKP" || k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("key %s: unsupported type %s/%s", k.Kid, k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+	}
+	if len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key %s: bad length %d", k.Kid, len(x))
+	}
+	return ed25519.PublicKey(x), nil
+}
@@ -0,0 +1,149 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	remoteRefreshInterval = 5 * time.Minute
+	// an unknown kid refetches the set, but not more often than this
+	remoteMissInterval = 10 * time.Second
+	remoteRetryMin     = time.Second
+	remoteRetryMax     = 30 * time.Second
+	remoteFetchTimeout = 5 * time.Second
+)
+
+// Remote is a verifier's cached copy of the auth service's JWK set. It is refreshed periodically
+// and whenever a token names a kid it does not know yet, so rotation needs no restart.
+type Remote struct {
+	slogger *slog.Logger
+	url     string
+	client  *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]ed25519.PublicKey // nil until the first fetch
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+}
+
+// NewRemote starts fetching the set from url and keeps it fresh until ctx is done
+func NewRemote(ctx context.Context, slogger *slog.Logger, url string) *Remote {
+	r := &Remote{
+		slogger: slogger,
+		url:     url,
+		client:  &http.Client{Timeout: remoteFetchTimeout},
+	}
+	go r.refresh(ctx)
+	return r
+}
+
+func (r *Remote) refresh(ctx context.Context) {
+	delay := remoteRetryMin
+	for {
+		err := r.fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		wait := remoteRefreshInterval
+		if err != nil {
+			r.slogger.Error("cannot fetch signing keys", "action", "fetch jwks", "url", r.url, "retry_in", delay.String(), "error", err)
+			wait = delay
+			delay = min(delay*2, remoteRetryMax)
+		} else {
+			delay = remoteRetryMin
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *Remote) fetch(ctx context.Context) error {
+	r.fetchMu.Lock()
+	defer r.fetchMu.Unlock()
+	r.lastFetch = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks: unexpected status %s", res.Status)
+	}
+	set := new(Set)
+	err = json.NewDecoder(res.Body).Decode(set)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			r.slogger.Warn("skipping signing key", "action", "fetch jwks", "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	return nil
+}
+
+func (r *Remote) lookup(kid string) (key ed25519.PublicKey, fetched bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[kid], r.keys != nil
+}
+
+// PublicKey returns ErrKeysUnavailable while the set could never be fetched
+func (r *Remote) PublicKey(ctx context.Context, kid string) (ed25519.PublicKey, error) {
+	key, fetched := r.lookup(kid)
+	if key != nil {
+		return key, nil
+	}
+	if r.missAllowed() {
+		err := r.fetch(ctx)
+		if err != nil {
+			r.slogger.WarnContext(ctx, "cannot refetch signing keys", "action", "fetch jwks", "kid", kid, "error", err)
+		}
+	}
+	// another request may have fetched it meanwhile
+	key, fetched = r.lookup(kid)
+	if key != nil {
+		return key, nil
+	}
+	if !fetched {
+		return nil, ErrKeysUnavailable
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownKey, kid)
+}
+
+func (r *Remote) missAllowed() bool {
+	r.fetchMu.Lock()
+	defer r.fetchMu.Unlock()
+	return time.Since(r.lastFetch) > remoteMissInterval
+}
+
+// Ready is the readiness check, tokens cannot be verified before the first fetch
+func (r *Remote) Ready(context.Context) error {
+	if _, fetched := r.lookup(""); !fetched {
+		return ErrKeysUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JWK set that tests can change, or fail with status
+type jwksServer struct {
+	mu      sync.Mutex
+	set     *Set
+	status  int
+	fetches int
+}
+
+func newJWKSServer(t *testing.T, status int, keys map[string]ed25519.PublicKey) (*jwksServer, string) {
+	t.Helper()
+	s := &jwksServer{status: status}
+	s.serve(keys)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(s.set)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func (s *jwksServer) serve(keys map[string]ed25519.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set = &Set{Keys: []JWK{}}
+	for kid, key := range keys {
+		s.set.Keys = append(s.set.Keys, newJWK(kid, key))
+	}
+}
+
+func (s *jwksServer) fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *jwksServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func newPublicKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return public
+}
+
+func newTestRemote(t *testing.T, url string) *Remote {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewRemote(ctx, slog.New(slog.DiscardHandler), url)
+}
+
+func waitReady(t *testing.T, r *Remote) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Ready(context.Background()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("remote key set was never fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// allowMiss lets the next unknown kid refetch the set
+func allowMiss(r *Remote) {
+	r.fetchMu.Lock()
+	defer r.fetchMu.Unlock()
+	r.lastFetch = time.Now().Add(-remoteMissInterval - time.Second)
+}
+
+func TestRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	key := newPublicKey(t)
+	server, url := newJWKSServer(t, http.StatusOK, map[string]ed25519.PublicKey{"a": key})
+	remote := newTestRemote(t, url)
+	waitReady(t, remote)
+	fetches := server.fetchCount()
+
+	for range 3 {
+		got, err := remote.PublicKey(ctx, "a")
+		if err != nil {
+			t.Fatalf("public key: %v", err)
+		}
+		if !got.Equal(key) {
+			t.Fatalf("public key of a does not match the served one")
+		}
+	}
+	if server.fetchCount() != fetches {
+		t.Errorf("known kid fetched the set %d more times", server.fetchCount()-fetches)
+	}
+}
+
+func TestRemoteMissRefetch(t *testing.T) {
+	ctx := context.Background()
+	a, b := newPublicKey(t), newPublicKey(t)
+	server, url := newJWKSServer(t, http.StatusOK, map[string]ed25519.PublicKey{"a": a})
+	remote := newTestRemote(t, url)
+	waitReady(t, remote)
+
+	// rotation on the auth service: b is published after the verifier fetched the set
+	server.serve(map[string]ed25519.PublicKey{"a": a, "b": b})
+	fetches := server.fetchCount()
+
+	// a miss right after a fetch waits for remoteMissInterval, a flood of bad kids cannot hammer the auth service
+	_, err := remote.PublicKey(ctx, "b")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("kid b right after a fetch = %v, want %v", err, ErrUnknownKey)
+	}
+	if server.fetchCount() != fetches {
+		t.Errorf("miss within %v fetched the set", remoteMissInterval)
+	}
+
+	allowMiss(remote)
+	got, err := remote.PublicKey(ctx, "b")
+	if err != nil {
+		t.Fatalf("kid b after the miss interval: %v", err)
+	}
+	if !got.Equal(b) {
+		t.Errorf("public key of b does not match the served one")
+	}
+	if server.fetchCount() != fetches+1 {
+		t.Errorf("miss fetched the set %d times, want once", server.fetchCount()-fetches)
+	}
+
+	_, err = remote.PublicKey(ctx, "c")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("kid c = %v, want %v", err, ErrUnknownKey)
+	}
+	if server.fetchCount() != fetches+1 {
+		t.Errorf("second miss within %v fetched the set", remoteMissInterval)
+	}
+
+	// a key removed from the set is dropped at the next fetch
+	server.serve(map[string]ed25519.PublicKey{"b": b})
+	allowMiss(remote)
+	_, err = remote.PublicKey(ctx, "c")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("kid c = %v, want %v", err, ErrUnknownKey)
+	}
+	_, err = remote.PublicKey(ctx, "a")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("removed kid a = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestRemoteUnavailable(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"server error", http.StatusInternalServerError},
+		{"not found", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := newJWKSServer(t, tt.status, map[string]ed25519.PublicKey{"a": newPublicKey(t)})
+			remote := newTestRemote(t, url)
+			allowMiss(remote)
+
+			_, err := remote.PublicKey(ctx, "a")
+			if !errors.Is(err, ErrKeysUnavailable) {
+				t.Errorf("public key before any fetch = %v, want %v", err, ErrKeysUnavailable)
+			}
+			err = remote.Ready(ctx)
+			if !errors.Is(err, ErrKeysUnavailable) {
+				t.Errorf("ready before any fetch = %v, want %v", err, ErrKeysUnavailable)
+			}
+		})
+	}
+}
+
+func TestRemoteFailureKeepsKeys(t *testing.T) {
+	ctx := context.Background()
+	key := newPublicKey(t)
+	server, url := newJWKSServer(t, http.StatusOK, map[string]ed25519.PublicKey{"a": key})
+	remote := newTestRemote(t, url)
+	waitReady(t, remote)
+
+	// the auth service going down must not stop verification with the keys already fetched
+	server.fail(http.StatusServiceUnavailable)
+	allowMiss(remote)
+	_, err := remote.PublicKey(ctx, "b")
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown kid after a failed refetch = %v, want %v", err, ErrUnknownKey)
+	}
+	got, err := remote.PublicKey(ctx, "a")
+	if err != nil {
+		t.Fatalf("known kid after a failed refetch: %v", err)
+	}
+	if !got.Equal(key) {
+		t.Errorf("public key of a changed after a failed refetch")
+	}
+	err = remote.Ready(ctx)
+	if err != nil {
+		t.Errorf("ready after a failed refetch: %v", err)
+	}
+}
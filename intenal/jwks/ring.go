@@ -0,0 +1,214 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ringReloadInterval = time.Minute
+	// a new key is published for this long before it signs, so every
+	// auth service instance and verifier cache has seen it first
+	keyActivationDelay = 5 * time.Minute
+	// the kid is the UTC time the key was added, the file mtime is not used since
+	// copying or restoring the directory changes it
+	kidLayout = "20060102T150405Z"
+)
+
+type ringKey struct {
+	kid     string
+	private ed25519.PrivateKey
+	added   time.Time
+}
+
+// KeyRing is the auth service's set of private keys, one PKCS#8 PEM file per key in dir,
+// the file name without .pem is the kid and the time the key was added (kidLayout). Rotation
+// is adding a file: it is published at once and signs keyActivationDelay after its time.
+// The old file can be removed AccessTokenTTL after that.
+type KeyRing struct {
+	slogger *slog.Logger
+	dir     string
+
+	mu   sync.RWMutex
+	keys []*ringKey // oldest first
+}
+
+// NewKeyRing loads the keys in dir, creating the first one if there are none,
+// and reloads the directory until ctx is done
+func NewKeyRing(ctx context.Context, slogger *slog.Logger, dir string) (*KeyRing, error) {
+	k := &KeyRing{
+		slogger: slogger,
+		dir:     dir,
+	}
+	err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		kid, err := GenerateKeyFile(dir)
+		if err != nil {
+			return nil, err
+		}
+		slogger.Warn("no signing keys, generated one", "action", "load signing keys", "kid", kid, "dir", dir)
+		err = k.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+	go k.reload(ctx)
+	return k, nil
+}
+
+// GenerateKeyFile writes a new Ed25519 key to dir, named after the current time
+func GenerateKeyFile(dir string) (string, error) {
+	return generateKeyFile(dir, time.Now())
+}
+
+func generateKeyFile(dir string, added time.Time) (string, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+	kid := added.UTC().Format(kidLayout)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	// never replace a key that may already sign, two keys in the same second are an error
+	f, err := os.OpenFile(filepath.Join(dir, kid+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	return kid, f.Close()
+}
+
+func (k *KeyRing) load() error {
+	files, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	keys := make([]*ringKey, 0, len(files))
+	for _, file := range files {
+		key, err := readKeyFile(file)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].added.Before(keys[j].added)
+	})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	return nil
+}
+
+func readKeyFile(file string) (*ringKey, error) {
+	kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+	added, err := time.Parse(kidLayout, kid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: the name is not the time the key was added, like %s.pem", file, kidLayout)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", file)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	private, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", file)
+	}
+	return &ringKey{
+		kid:     kid,
+		private: private,
+		added:   added,
+	}, nil
+}
+
+func (k *KeyRing) reload(ctx context.Context) {
+	ticker := time.NewTicker(ringReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// a broken new file must not stop signing, keep the keys we have
+		err := k.load()
+		if err != nil {
+			k.slogger.Error("cannot reload signing keys", "action", "load signing keys", "dir", k.dir, "error", err)
+		}
+	}
+}
+
+// SigningKey is the newest key added at least keyActivationDelay ago,
+// or the oldest one while all of them are newer
+func (k *KeyRing) SigningKey() (string, ed25519.PrivateKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return "", nil, ErrKeysUnavailable
+	}
+	active := k.keys[0]
+	cutoff := time.Now().Add(-keyActivationDelay)
+	for _, key := range k.keys[1:] {
+		if key.added.After(cutoff) {
+			break
+		}
+		active = key
+	}
+	return active.kid, active.private, nil
+}
+
+func (k *KeyRing) PublicKey(_ context.Context, kid string) (ed25519.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.kid == kid {
+			return key.private.Public().(ed25519.PublicKey), nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", ErrUnknownKey, kid)
+}
+
+// Set returns the public keys of the ring, including the ones not signing yet
+func (k *KeyRing) Set() *Set {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := &Set{Keys: make([]JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, newJWK(key.kid, key.private.Public().(ed25519.PublicKey)))
+	}
+	return set
+}
@@ -0,0 +1,208 @@
+package jwks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRing(t *testing.T, dir string) *KeyRing {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ring, err := NewKeyRing(ctx, slog.New(slog.DiscardHandler), dir)
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	return ring
+}
+
+// addKeys writes one key file per age, a negative age is a key added in the future
+func addKeys(t *testing.T, dir string, ages ...time.Duration) []string {
+	t.Helper()
+	now := time.Now()
+	kids := make([]string, 0, len(ages))
+	for _, age := range ages {
+		kid, err := generateKeyFile(dir, now.Add(-age))
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		kids = append(kids, kid)
+	}
+	return kids
+}
+
+func TestSigningKey(t *testing.T) {
+	tests := []struct {
+		name string
+		ages []time.Duration
+		want int // index into ages
+	}{
+		{"single new key", []time.Duration{time.Minute}, 0},
+		{"single old key", []time.Duration{time.Hour}, 0},
+		{"new key not active yet", []time.Duration{time.Hour, time.Minute}, 0},
+		{"new key active", []time.Duration{time.Hour, 10 * time.Minute}, 1},
+		{"newest active of three", []time.Duration{2 * time.Hour, time.Hour, time.Minute}, 1},
+		{"all new, the oldest signs", []time.Duration{3 * time.Minute, time.Minute}, 0},
+		{"key added in the future", []time.Duration{time.Hour, -time.Hour}, 0},
+		{"files written out of order", []time.Duration{time.Minute, time.Hour, 10 * time.Minute}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			kids := addKeys(t, dir, tt.ages...)
+			ring := newTestRing(t, dir)
+
+			kid, private, err := ring.SigningKey()
+			if err != nil {
+				t.Fatalf("signing key: %v", err)
+			}
+			if kid != kids[tt.want] {
+				t.Errorf("signing kid = %s, want %s of %v", kid, kids[tt.want], kids)
+			}
+			public, err := ring.PublicKey(context.Background(), kid)
+			if err != nil {
+				t.Fatalf("public key: %v", err)
+			}
+			if !public.Equal(private.Public()) {
+				t.Errorf("public key of %s does not match its private key", kid)
+			}
+			if len(ring.Set().Keys) != len(kids) {
+				t.Errorf("set has %d keys, want all %d", len(ring.Set().Keys), len(kids))
+			}
+		})
+	}
+}
+
+// TestActivationIgnoresMtime checks a copied or restored key directory keeps its signing key
+func TestActivationIgnoresMtime(t *testing.T) {
+	dir := t.TempDir()
+	kids := addKeys(t, dir, time.Hour, time.Minute)
+	// the new key looks old on disk and the old one new
+	old := time.Now().Add(-24 * time.Hour)
+	err := os.Chtimes(filepath.Join(dir, kids[1]+".pem"), old, old)
+	if err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	err = os.Chtimes(filepath.Join(dir, kids[0]+".pem"), time.Now(), time.Now())
+	if err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	kid, _, err := newTestRing(t, dir).SigningKey()
+	if err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	if kid != kids[0] {
+		t.Errorf("signing kid = %s, want %s, the one added an hour ago", kid, kids[0])
+	}
+}
+
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	oldKids := addKeys(t, dir, time.Hour)
+	ring := newTestRing(t, dir)
+
+	// a new key is published at once but does not sign yet
+	newKids := addKeys(t, dir, time.Minute)
+	err := ring.load()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	kid, _, err := ring.SigningKey()
+	if err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	if kid != oldKids[0] {
+		t.Errorf("signing kid right after rotation = %s, want the old %s", kid, oldKids[0])
+	}
+	published := map[string]bool{}
+	for _, jwk := range ring.Set().Keys {
+		published[jwk.Kid] = true
+	}
+	if !published[oldKids[0]] || !published[newKids[0]] {
+		t.Errorf("published %v, want both %s and %s", published, oldKids[0], newKids[0])
+	}
+	_, err = ring.PublicKey(ctx, newKids[0])
+	if err != nil {
+		t.Errorf("public key of the new key: %v", err)
+	}
+
+	// removing the old file leaves the new key signing, tokens of the old one stop verifying
+	err = os.Remove(filepath.Join(dir, oldKids[0]+".pem"))
+	if err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	err = ring.load()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	kid, _, err = ring.SigningKey()
+	if err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	if kid != newKids[0] {
+		t.Errorf("signing kid after removing the old key = %s, want %s", kid, newKids[0])
+	}
+	_, err = ring.PublicKey(ctx, oldKids[0])
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("public key of the removed key = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestKeyFileName(t *testing.T) {
+	dir := t.TempDir()
+	kids := addKeys(t, dir, time.Hour)
+	ring := newTestRing(t, dir)
+
+	// the name is the activation time, a file without one is not loaded
+	data, err := os.ReadFile(filepath.Join(dir, kids[0]+".pem"))
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "current.pem"), data, 0o600)
+	if err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	err = ring.load()
+	if err == nil {
+		t.Fatalf("reload with a key file not named after a time succeeded")
+	}
+	kid, _, err := ring.SigningKey()
+	if err != nil || kid != kids[0] {
+		t.Errorf("signing key after a failed reload = %s, %v, want %s", kid, err, kids[0])
+	}
+	_, err = NewKeyRing(context.Background(), slog.New(slog.DiscardHandler), dir)
+	if err == nil {
+		t.Errorf("key ring over a key file not named after a time was created")
+	}
+}
+
+func TestGenerateKeyFileKeepsExisting(t *testing.T) {
+	dir := t.TempDir()
+	at := time.Now()
+	kid, err := generateKeyFile(dir, at)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	before, err := os.ReadFile(filepath.Join(dir, kid+".pem"))
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	_, err = generateKeyFile(dir, at)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("second key in the same second = %v, want %v", err, os.ErrExist)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, kid+".pem"))
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	if string(before) != string(after) {
+		t.Errorf("key %s was overwritten", kid)
+	}
+}
@@ -0,0 +1,133 @@
+// Package metrics holds the prometheus metrics of all services, each service exposes them on GET /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ridehail"
+
+var (
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of http requests by route pattern and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "code"})
+
+	RidesCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rides_created_total",
+		Help:      "Rides requested by passengers.",
+	}, []string{"vehicle_type"})
+
+	RidesCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rides_completed_total",
+		Help:      "Rides completed by drivers.",
+	}, []string{"vehicle_type"})
+
+	RidesCancelled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rides_cancelled_total",
+		Help:      "Rides cancelled by passengers.",
+	})
+
+	// MatchDuration is the time from the ride request reaching the matcher to the end of matching.
+	// result: matched, cancelled (ride is no longer requested), failed (no driver or error)
+	MatchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "match_duration_seconds",
+		Help:      "Time spent matching a ride with a driver by result.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 90, 120},
+	}, []string{"result"})
+
+	RideOffers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ride_offers_total",
+		Help:      "Ride offers sent to drivers by result: accepted, declined, timeout, error.",
+	}, []string{"result"})
+
+	// ConsumerLag is the time between publish and consume, the Timestamp of the message
+	ConsumerLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag_seconds",
+		Help:      "Time between publishing and consuming a message by queue.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	}, []string{"queue"})
+
+	// MessagesSettled counts how consumed messages ended: ack, nack (retry), dead_letter, reject
+	MessagesSettled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_settled_total",
+		Help:      "Consumed messages by queue and outcome: ack, nack, dead_letter, reject.",
+	}, []string{"queue", "outcome"})
+
+	WebSocketClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_clients",
+		Help:      "Connected websocket clients by hub.",
+	}, []string{"hub"})
+)
+
+// settle outcomes
+const (
+	OutcomeAck        = "ack"
+	OutcomeNack       = "nack"
+	OutcomeDeadLetter = "dead_letter"
+	OutcomeReject     = "reject"
+)
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterPool exposes the stats of the db pool
+func RegisterPool(pool *pgxpool.Pool) error {
+	return prometheus.Register(&poolCollector{pool: pool})
+}
+
+var (
+	poolAcquired = prometheus.NewDesc(namespace+"_db_pool_acquired_conns", "Connections in use.", nil, nil)
+	poolIdle     = prometheus.NewDesc(namespace+"_db_pool_idle_conns", "Idle connections.", nil, nil)
+	poolTotal    = prometheus.NewDesc(namespace+"_db_pool_total_conns", "All open connections.", nil, nil)
+	poolMax      = prometheus.NewDesc(namespace+"_db_pool_max_conns", "Maximum size of the pool.", nil, nil)
+	poolAcquires = prometheus.NewDesc(namespace+"_db_pool_acquires_total", "Successful acquires from the pool.", nil, nil)
+	poolEmpty    = prometheus.NewDesc(namespace+"_db_pool_empty_acquires_total", "Acquires which had to wait for a connection.", nil, nil)
+	poolCanceled = prometheus.NewDesc(namespace+"_db_pool_canceled_acquires_total", "Acquires canceled by the context.", nil, nil)
+	poolWait     = prometheus.NewDesc(namespace+"_db_pool_acquire_duration_seconds_total", "Time spent acquiring connections.", nil, nil)
+)
+
+// poolCollector reads pgxpool.Stat on every scrape
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquired
+	ch <- poolIdle
+	ch <- poolTotal
+	ch <- poolMax
+	ch <- poolAcquires
+	ch <- poolEmpty
+	ch <- poolCanceled
+	ch <- poolWait
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquired, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdle, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotal, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMax, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmpty, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceled, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolWait, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
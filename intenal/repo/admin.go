@@ -0,0 +1,326 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"taxi-hailing/intenal/domain"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type AdminRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewAdminRepo(pool *pgxpool.Pool) *AdminRepo {
+	return &AdminRepo{db: pool}
+}
+
+func (a *AdminRepo) GetOverview(ctx context.Context) (*domain.OverviewMetrics, error) {
+	m := new(domain.OverviewMetrics)
+	err := a.db.QueryRow(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE status IN ('REQUESTED', 'MATCHED', 'EN_ROUTE', 'ARRIVED', 'IN_PROGRESS'))
+		FROM rides
+	`).Scan(&m.ActiveRides)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.db.QueryRow(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE status = 'AVAILABLE'),
+			COUNT(*) FILTER (WHERE status IN ('BUSY', 'EN_ROUTE'))
+		FROM drivers
+	`).Scan(&m.AvailableDrivers, &m.BusyDrivers)
+	if err != nil {
+		return nil, err
+	}
+
+	var cancelled int
+	err = a.db.QueryRow(ctx, `
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE status = 'CANCELLED'),
+			COALESCE(SUM(final_fare) FILTER (WHERE status = 'COMPLETED'), 0)::float8,
+			COALESCE(AVG(EXTRACT(EPOCH FROM (matched_at - requested_at)) / 60) FILTER (WHERE matched_at IS NOT NULL), 0)::float8,
+			COALESCE(AVG(EXTRACT(EPOCH FROM (completed_at - started_at)) / 60) FILTER (WHERE status = 'COMPLETED'), 0)::float8
+		FROM rides
+		WHERE created_at::date = CURRENT_DATE
+	`).Scan(
+		&m.TotalRidesToday,
+		&cancelled,
+		&m.TotalRevenueToday,
+		&m.AverageWaitTimeMinutes,
+		&m.AverageRideDurationMinutes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if m.TotalRidesToday > 0 {
+		m.CancellationRate = float64(cancelled) / float64(m.TotalRidesToday)
+	}
+	return m, nil
+}
+
+func (a *AdminRepo) GetActiveRides(ctx context.Context, limit, offset int) ([]domain.ActiveRide, int, error) {
+	var total int
+	err := a.db.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM rides
+		WHERE status IN ('REQUESTED', 'MATCHED', 'EN_ROUTE', 'ARRIVED', 'IN_PROGRESS')
+	`).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := a.db.Query(ctx, `
+		SELECT
+			r.id, r.ride_number, r.status, r.passenger_id,
+			COALESCE(r.driver_id::text, ''), COALESCE(r.vehicle_type, ''),
+			p.address, d.address,
+			COALESCE(r.estimated_fare, 0)::float8,
+			r.requested_at, r.started_at
+		FROM rides r
+		JOIN coordinates p ON p.id = r.pickup_coordinate_id
+		JOIN coordinates d ON d.id = r.destination_coordinate_id
+		WHERE r.status IN ('REQUESTED', 'MATCHED', 'EN_ROUTE', 'ARRIVED', 'IN_PROGRESS')
+		ORDER BY r.requested_at DESC
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	rides := []domain.ActiveRide{}
+	for rows.Next() {
+		var ride domain.ActiveRide
+		err = rows.Scan(
+			&ride.RideID,
+			&ride.RideNumber,
+			&ride.Status,
+			&ride.PassengerID,
+			&ride.DriverID,
+			&ride.VehicleType,
+			&ride.PickupAddress,
+			&ride.DestinationAddress,
+			&ride.EstimatedFare,
+			&ride.RequestedAt,
+			&ride.StartedAt,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		rides = append(rides, ride)
+	}
+	return rides, total, rows.Err()
+}
+
+func (a *AdminRepo) GetOnlineDrivers(ctx context.Context) ([]domain.OnlineDriver, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT
+			d.id, u.name, d.status, COALESCE(d.vehicle_type, ''), COALESCE(d.rating, 0)::float8,
+			lh.latitude::float8, lh.longitude::float8,
+			s.started_at, s.total_rides, s.total_earnings::float8
+		FROM drivers d
+		JOIN users u ON u.id = d.id
+		JOIN driver_sessions s ON s.driver_id = d.id AND s.ended_at IS NULL
+		LEFT JOIN LATERAL (
+			SELECT latitude, longitude
+			FROM location_history
+			WHERE driver_id = d.id
+			ORDER BY recorded_at DESC
+			LIMIT 1
+		) lh ON true
+		WHERE d.status <> 'OFFLINE'
+		ORDER BY s.started_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drivers := []domain.OnlineDriver{}
+	for rows.Next() {
+		var (
+			dr       domain.OnlineDriver
+			lat, lng *float64
+		)
+		err = rows.Scan(
+			&dr.DriverID,
+			&dr.Name,
+			&dr.Status,
+			&dr.VehicleType,
+			&dr.Rating,
+			&lat,
+			&lng,
+			&dr.SessionStartedAt,
+			&dr.RidesCompleted,
+			&dr.Earnings,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lat != nil && lng != nil {
+			dr.Location = &domain.Location{Lat: *lat, Lng: *lng}
+		}
+		drivers = append(drivers, dr)
+	}
+	return drivers, rows.Err()
+}
+
+func (a *AdminRepo) GetRevenue(ctx context.Context, from, to time.Time) (*domain.RevenueReport, error) {
+	rows, err := a.db.Query(ctx, `
+		SELECT
+			COALESCE(vehicle_type, ''),
+			COUNT(*) FILTER (WHERE status = 'COMPLETED'),
+			COALESCE(SUM(final_fare) FILTER (WHERE status = 'COMPLETED'), 0)::float8,
+			COALESCE(AVG(final_fare) FILTER (WHERE status = 'COMPLETED'), 0)::float8,
+			COUNT(*) FILTER (WHERE status = 'CANCELLED')
+		FROM rides
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY vehicle_type
+		ORDER BY vehicle_type
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &domain.RevenueReport{
+		From:          from,
+		To:            to,
+		ByVehicleType: []domain.VehicleTypeRevenue{},
+	}
+	for rows.Next() {
+		var v domain.VehicleTypeRevenue
+		err = rows.Scan(&v.VehicleType, &v.Rides, &v.Revenue, &v.AverageFare, &v.CancelledCnt)
+		if err != nil {
+			return nil, err
+		}
+		report.TotalRides += v.Rides
+		report.TotalRevenue += v.Revenue
+		report.ByVehicleType = append(report.ByVehicleType, v)
+	}
+	return report, rows.Err()
+}
+
+func (a *AdminRepo) GetRideEvents(ctx context.Context, rideID string) ([]domain.RideEvent, error) {
+	var exists bool
+	err := a.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM rides WHERE id = $1)`, rideID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, domain.ErrNotFound
+	}
+
+	rows, err := a.db.Query(ctx, `
+		SELECT id, COALESCE(event_type, ''), event_data, created_at
+		FROM ride_events
+		WHERE ride_id = $1
+		ORDER BY created_at
+	`, rideID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []domain.RideEvent{}
+	for rows.Next() {
+		var e domain.RideEvent
+		err = rows.Scan(&e.ID, &e.EventType, &e.EventData, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ListTariffs returns every tariff version, of one vehicle type if given, newest first.
+// Active marks the versions in effect now.
+func (a *AdminRepo) ListTariffs(ctx context.Context, vehicleType string) ([]domain.Tariff, error) {
+	active, err := activeTariffs(ctx, a.db, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := a.db.Query(ctx, `
+		SELECT `+tariffColumns+`
+		FROM tariffs t
+		WHERE $1 = '' OR t.vehicle_type = $1
+		ORDER BY t.vehicle_type, t.effective_from DESC, t.version DESC`, vehicleType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tariffs := []domain.Tariff{}
+	for rows.Next() {
+		t, err := scanTariff(rows)
+		if err != nil {
+			return nil, err
+		}
+		cur, ok := active[t.VehicleType]
+		t.Active = ok && cur.ID == t.ID
+		tariffs = append(tariffs, *t)
+	}
+	return tariffs, rows.Err()
+}
+
+// CreateTariff saves t as the next version of its vehicle type, t gets the id and version
+func (a *AdminRepo) CreateTariff(ctx context.Context, t *domain.Tariff) error {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// the vehicle type row serializes versions of the same type
+	tag, err := tx.Exec(ctx, `SELECT 1 FROM vehicle_type WHERE value = $1 FOR UPDATE`, t.VehicleType)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("unknown vehicle_type: %s", t.VehicleType)
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO tariffs (
+			vehicle_type, version, effective_from, currency, base_fare, rate_per_km, rate_per_min,
+			min_fare, booking_fee, waiting_free_minutes, waiting_rate_per_min, priority
+		)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+		FROM tariffs
+		WHERE vehicle_type = $1
+		RETURNING id, version, created_at`,
+		t.VehicleType, t.EffectiveFrom, t.Currency, t.BaseFare, t.RatePerKM, t.RatePerMin,
+		t.MinFare, t.BookingFee, t.WaitingFreeMinutes, t.WaitingRatePerMin, t.Priority,
+	).Scan(&t.ID, &t.Version, &t.CreatedAt)
+	if err != nil {
+		return uniqueViolation(err, "tariff version already exists")
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteTariff removes a version which is not in effect yet. Versions which took effect may
+// have priced rides, they stay; a new version replaces them.
+func (a *AdminRepo) DeleteTariff(ctx context.Context, id string) error {
+	var scheduled bool
+	err := a.db.QueryRow(ctx, `SELECT effective_from > now() FROM tariffs WHERE id = $1`, id).Scan(&scheduled)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return domain.ErrNotFound
+		}
+		return err
+	}
+	if !scheduled {
+		return fmt.Errorf("%w: tariff is already in effect", domain.Errconflict)
+	}
+	_, err = a.db.Exec(ctx, `DELETE FROM tariffs WHERE id = $1 AND effective_from > now()`, id)
+	return err
+}
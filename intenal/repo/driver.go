@@ -2,10 +2,13 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"taxi-hailing/intenal/domain"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -17,33 +20,13 @@ func NewDriverRepo(db *pgxpool.Pool) *DriverRepo {
 	return &DriverRepo{db: db}
 }
 
-func (r *DriverRepo) CreateDriver(ctx context.Context, driver *domain.Driver) error {
-	tx, err := r.db.Begin(ctx)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(ctx)
-
-	err = tx.QueryRow(ctx, `
-		INSERT INTO users (name, email, password_hash, role, status)
-		VALUES ($1, $2, $3, 'DRIVER','ACTIVE')
-		RETURNING id
-	`, driver.Name, driver.Email, driver.PasswordHash).Scan(&driver.ID)
-	if err != nil {
-		return err
+// uniqueViolation turns postgres unique_violation into domain.Errconflict
+func uniqueViolation(err error, msg string) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return fmt.Errorf("%w: %s", domain.Errconflict, msg)
 	}
-
-	_, err = tx.Exec(ctx, `
-		INSERT INTO drivers (
-			id, license_number, vehicle_type, vehicle_attrs, is_verified
-		) VALUES (
-			$1, $2, $3, $4, $5
-		)
-	`, driver.ID, driver.LicenseNumber, driver.VehicleType, driver.VehicleAttrs, driver.IsVerified)
-	if err != nil {
-		return err
-	}
-	return tx.Commit(ctx)
+	return err
 }
 
 // UpdateDriverStatus changes the driver's status (e.g., "AVAILABLE", "BUSY", "EN_ROUTE", "OFFLINE") and inserts into driver_sessions when status goes to AVAILABLE.
@@ -56,20 +39,11 @@ func (r *DriverRepo) UpdateDriverToOnline(ctx context.Context, driverID uuid.UUI
 	defer tx.Rollback(ctx)
 
 	// Get current status before updating
-	var currentStatus string
-	err = tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id=$1`, driverID).Scan(&currentStatus)
+	currentStatus, err := driverState(ctx, tx, driverID)
 	if err != nil {
 		return uuid.Nil, err
 	}
-	if currentStatus != "OFFLINE" {
-		return uuid.Nil, fmt.Errorf("driver is not offline")
-	}
-
-	_, err = tx.Exec(ctx, `
-		UPDATE drivers
-		SET status = 'AVAILABLE', updated_at = now()
-		WHERE id = $2
-	`, driverID)
+	err = moveDriver(ctx, tx, driverID, currentStatus, domain.DriverAvailable)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -100,21 +74,11 @@ func (r *DriverRepo) UpdateDriverToOffline(ctx context.Context, driverID uuid.UU
 		return nil, err
 	}
 	defer tx.Rollback(ctx)
-	var currentStatus string
-	err = tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id=$1`, driverID).Scan(&currentStatus)
+	currentStatus, err := driverState(ctx, tx, driverID)
 	if err != nil {
 		return nil, err
 	}
-
-	if currentStatus != "AVAILABLE" {
-		return nil, fmt.Errorf("driver is not available")
-	}
-
-	_, err = tx.Exec(ctx, `
-		UPDATE drivers
-		SET status = 'OFFLINE', updated_at = now()
-		WHERE id = $1
-	`, driverID)
+	err = moveDriver(ctx, tx, driverID, currentStatus, domain.DriverOffline)
 	if err != nil {
 		return nil, err
 	}
@@ -154,28 +118,22 @@ func (r *DriverRepo) GetDriverSessionSummary(ctx context.Context, sessionID *uui
 	return summary, nil
 }
 
-func (r *DriverRepo) UpdateDriverToEnRoute(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage) error {
+func (r *DriverRepo) UpdateDriverToEnRoute(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error {
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	var currentStatus string
-	err = tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id=$1`, driverID).Scan(&currentStatus)
+	currentStatus, err := driverState(ctx, tx, driverID)
 	if err != nil {
 		return err
 	}
-
-	if currentStatus != "AVAILABLE" {
-		return fmt.Errorf("driver is not busy")
+	err = driverRide(ctx, tx, req.RideID, driverID, domain.RideEnRoute)
+	if err != nil {
+		return err
 	}
-
-	_, err = tx.Exec(ctx, `
-		UPDATE drivers
-		SET status = 'EN_ROUTE', updated_at = now()
-		WHERE id = $1
-	`, driverID)
+	err = moveDriver(ctx, tx, driverID, currentStatus, domain.DriverEnRoute)
 	if err != nil {
 		return err
 	}
@@ -196,29 +154,85 @@ func (r *DriverRepo) UpdateDriverToEnRoute(ctx context.Context, driverID uuid.UU
 		return err
 	}
 
+	err = enqueueRideStatus(ctx, tx, status)
+	if err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
-func (r *DriverRepo) UpdateDriverToBusy(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage) error {
+// UpdateDriverToArrived keeps the driver EN_ROUTE, marks the arrival Start checks and records the location at the pickup point
+func (r *DriverRepo) UpdateDriverToArrived(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error {
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
-	var currentStatus string
-	err = tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id=$1`, driverID).Scan(&currentStatus)
+
+	currentStatus, err := driverState(ctx, tx, driverID)
+	if err != nil {
+		return err
+	}
+	err = domain.CheckDriverStatus(currentStatus, domain.DriverEnRoute)
+	if err != nil {
+		return err
+	}
+	err = driverRide(ctx, tx, req.RideID, driverID, domain.RideArrived)
 	if err != nil {
 		return err
 	}
-	if currentStatus != "EN_ROUTE" {
-		return fmt.Errorf("driver is not EN_ROUTE")
+
+	var pickupCoordinateID uuid.UUID
+	err = tx.QueryRow(ctx, `
+		SELECT pickup_coordinate_id FROM rides WHERE id = $1
+	`, req.RideID).Scan(&pickupCoordinateID)
+	if err != nil {
+		return fmt.Errorf("cannot get pickup coordinate id for ride: %w", err)
 	}
 
 	_, err = tx.Exec(ctx, `
 		UPDATE drivers
-		SET status = 'BUSY', updated_at = now()
+		SET arrived_ride_id = $2, updated_at = now()
 		WHERE id = $1
-	`, driverID)
+	`, driverID, req.RideID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO location_history (coordinate_id, driver_id, latitude, longitude, ride_id)
+		VALUES ($1, $2, $3, $4, $5)
+	`, pickupCoordinateID, driverID, req.DriverLocation.Latitude, req.DriverLocation.Longitude, req.RideID)
+	if err != nil {
+		return err
+	}
+	err = enqueueRideStatus(ctx, tx, status)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// UpdateDriverToBusy starts the ride, only after the driver reported arriving at its pickup
+func (r *DriverRepo) UpdateDriverToBusy(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	currentStatus, err := driverState(ctx, tx, driverID)
+	if err != nil {
+		return err
+	}
+	err = driverRide(ctx, tx, req.RideID, driverID, domain.RideInProgress)
+	if err != nil {
+		return err
+	}
+	err = driverArrived(ctx, tx, driverID, req.RideID)
+	if err != nil {
+		return err
+	}
+	err = moveDriver(ctx, tx, driverID, currentStatus, domain.DriverBusy)
 	if err != nil {
 		return err
 	}
@@ -233,59 +247,48 @@ func (r *DriverRepo) UpdateDriverToBusy(ctx context.Context, driverID uuid.UUID,
 
 	_, err = tx.Exec(ctx, `
 		INSERT INTO location_history (coordinate_id, driver_id, latitude, longitude, ride_id)
-		VALUES ($1, $2, $3, $4)
+		VALUES ($1, $2, $3, $4, $5)
 	`, destinationCoordinateID, driverID, req.DriverLocation.Latitude, req.DriverLocation.Longitude, req.RideID)
 	if err != nil {
 		return err
 	}
+	err = enqueueRideStatus(ctx, tx, status)
+	if err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
-func (r *DriverRepo) CompleteRide(ctx context.Context, driverID uuid.UUID, req *domain.CompleteRideRequest) (float64, error) {
+func (r *DriverRepo) CompleteRide(ctx context.Context, driverID uuid.UUID, req *domain.CompleteRideRequest, status *domain.RideStatusUpdate) (float64, error) {
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
 		return 0, err
 	}
 	defer tx.Rollback(ctx)
 
-	var currentStatus string
-	err = tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id=$1`, driverID).Scan(&currentStatus)
+	currentStatus, err := driverState(ctx, tx, driverID)
 	if err != nil {
 		return 0, err
 	}
-	if currentStatus != "BUSY" {
-		return 0, fmt.Errorf("driver is not BUSY")
-	}
-	// update driver status to AVAILABLE, updated_at
-	_, err = tx.Exec(ctx, `
-		UPDATE drivers
-		SET status = 'AVAILABLE', updated_at = now()
-		WHERE id = $1
-	`, driverID)
+	// BUSY is the driver's own record of the start, the ride may not have applied IN_PROGRESS yet
+	err = domain.CheckDriverStatus(currentStatus, domain.DriverBusy)
 	if err != nil {
-		return 0, fmt.Errorf("cannot update driver: %w", err)
+		return 0, err
 	}
-
-	// Validate driver/ride relationship, must be driver of this ride & status BUSY
-	var dbDriverID uuid.UUID
-	var status string
-	err = tx.QueryRow(ctx, `
-		SELECT driver_id, status FROM rides WHERE id = $1
-	`, req.RideID).Scan(&dbDriverID, &status)
+	err = driverRide(ctx, tx, req.RideID, driverID, domain.RideCompleted)
 	if err != nil {
-		return 0, fmt.Errorf("cannot load ride: %w", err)
-	}
-	if dbDriverID != driverID {
-		return 0, fmt.Errorf("driver is not assigned to this ride")
+		return 0, err
 	}
-	if status != "IN_PROGRESS" {
-		return 0, fmt.Errorf("ride is not in progress")
+	// update driver status to AVAILABLE, updated_at
+	err = moveDriver(ctx, tx, driverID, currentStatus, domain.DriverAvailable)
+	if err != nil {
+		return 0, fmt.Errorf("cannot update driver: %w", err)
 	}
 
 	var destinationCoordinateID, passengerID uuid.UUID
 	err = tx.QueryRow(ctx, `
 		SELECT passenger_id, destination_coordinate_id FROM rides WHERE id = $1
-	`, req.RideID).Scan(&destinationCoordinateID, &passengerID)
+	`, req.RideID).Scan(&passengerID, &destinationCoordinateID)
 	if err != nil {
 		return 0, fmt.Errorf("cannot get destination coordinate id for ride: %w", err)
 	}
@@ -300,11 +303,7 @@ func (r *DriverRepo) CompleteRide(ctx context.Context, driverID uuid.UUID, req *
 	}
 
 	// Increment driver_sessions for current session: add ride and earnings
-	var fare float64
-	err = tx.QueryRow(ctx, `
-    SELECT fare_amount
-    FROM coordinates
-    WHERE entity_id = $1 AND is_current = TRUE`, passengerID).Scan(&fare)
+	fare, err := finalFare(ctx, tx, req.RideID)
 	if err != nil {
 		return 0, err
 	}
@@ -322,6 +321,10 @@ func (r *DriverRepo) CompleteRide(ctx context.Context, driverID uuid.UUID, req *
 		return 0, fmt.Errorf("cannot update driver_sessions: %w", err)
 	}
 
+	err = enqueueRideStatus(ctx, tx, status)
+	if err != nil {
+		return 0, err
+	}
 	return fare, tx.Commit(ctx)
 }
 
@@ -329,11 +332,11 @@ func (r *DriverRepo) CompleteRide(ctx context.Context, driverID uuid.UUID, req *
 // Если драйвер по rideId куда-то едет (то есть у него статус EN_ROUTE или BUSY),
 // то location_history связывается с соответствующей поездкой.
 // Ошибку не выдаем, если драйвер OFFLINE — просто записываем его координаты.
-
-func (r *DriverRepo) UpdateDriverLocation(ctx context.Context, driverID uuid.UUID, loc *domain.LocationUpdate) (uuid.UUID, error) {
+// Returns the history id and the ride id, uuid.Nil when the driver is not on a ride.
+func (r *DriverRepo) UpdateDriverLocation(ctx context.Context, driverID uuid.UUID, loc *domain.LocationUpdate) (uuid.UUID, uuid.UUID, error) {
 	tx, err := r.db.Begin(ctx)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, uuid.Nil, err
 	}
 	defer tx.Rollback(ctx)
 
@@ -341,13 +344,13 @@ func (r *DriverRepo) UpdateDriverLocation(ctx context.Context, driverID uuid.UUI
 	var status string
 	err = tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id=$1`, driverID).Scan(&status)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, uuid.Nil, err
 	}
-	var returnID uuid.UUID
+	var returnID, rideID uuid.UUID
 	switch status {
-	case "OFFLINE":
-		return uuid.Nil, fmt.Errorf("cannot update driver offines")
-	case "AVAILABLE":
+	case domain.DriverOffline:
+		return uuid.Nil, uuid.Nil, fmt.Errorf("cannot update driver offines")
+	case domain.DriverAvailable:
 		err = tx.QueryRow(ctx, `
 		INSERT INTO location_history (
 			driver_id, latitude, longitude, accuracy_meters, speed_kmh, heading_degrees
@@ -363,10 +366,10 @@ func (r *DriverRepo) UpdateDriverLocation(ctx context.Context, driverID uuid.UUI
 			loc.HeadingDegrees,
 		).Scan(&returnID)
 		if err != nil {
-			return uuid.Nil, err
+			return uuid.Nil, uuid.Nil, err
 		}
-	case "BUSY", "EN_ROUTE":
-		var rideID, coordinateID uuid.UUID
+	case domain.DriverBusy, domain.DriverEnRoute:
+		var coordinateID uuid.UUID
 		err = tx.QueryRow(ctx, `
 			SELECT ride_id, coordinate_id
 			FROM location_history 
@@ -376,7 +379,7 @@ func (r *DriverRepo) UpdateDriverLocation(ctx context.Context, driverID uuid.UUI
 		`, driverID).Scan(&rideID, &coordinateID)
 
 		if err != nil {
-			return uuid.Nil, fmt.Errorf("cannot get rideID from location_history for driver: %w", err)
+			return uuid.Nil, uuid.Nil, fmt.Errorf("cannot get rideID from location_history for driver: %w", err)
 		}
 		err = tx.QueryRow(ctx, `
 		INSERT INTO location_history (
@@ -395,10 +398,139 @@ func (r *DriverRepo) UpdateDriverLocation(ctx context.Context, driverID uuid.UUI
 		).Scan(&returnID)
 
 		if err != nil {
-			return uuid.Nil, err
+			return uuid.Nil, uuid.Nil, err
 		}
 	default:
-		return uuid.Nil, fmt.Errorf("invalid driver status: %s", status)
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid driver status: %s", status)
+	}
+	return returnID, rideID, tx.Commit(ctx)
+}
+
+// FindNearbyDrivers returns AVAILABLE drivers of the given vehicle type whose latest
+// location_history row is within radiusKM of pickup, nearest and best rated first.
+// Drivers already assigned to an unfinished ride are skipped.
+func (r *DriverRepo) FindNearbyDrivers(ctx context.Context, vehicleType string, pickup *domain.Location, radiusKM float64, limit int) ([]domain.DriverCandidate, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, name, rating, vehicle_attrs, latitude, longitude, distance_km
+		FROM (
+			SELECT
+				d.id,
+				u.name,
+				COALESCE(d.rating, 5.0)::float8 AS rating,
+				d.vehicle_attrs,
+				lh.latitude::float8 AS latitude,
+				lh.longitude::float8 AS longitude,
+				6371 * acos(least(1, greatest(-1,
+					cos(radians($2)) * cos(radians(lh.latitude)) * cos(radians(lh.longitude) - radians($3)) +
+					sin(radians($2)) * sin(radians(lh.latitude))
+				))) AS distance_km
+			FROM drivers d
+			JOIN users u ON u.id = d.id
+			JOIN LATERAL (
+				SELECT latitude, longitude
+				FROM location_history
+				WHERE driver_id = d.id
+				ORDER BY recorded_at DESC
+				LIMIT 1
+			) lh ON true
+			WHERE d.status = 'AVAILABLE'
+				AND d.vehicle_type = $1
+				AND NOT EXISTS (
+					SELECT 1 FROM rides
+					WHERE driver_id = d.id
+						AND status IN ('MATCHED', 'EN_ROUTE', 'ARRIVED', 'IN_PROGRESS')
+				)
+		) c
+		WHERE distance_km <= $4
+		ORDER BY distance_km, rating DESC
+		LIMIT $5
+	`, vehicleType, pickup.Lat, pickup.Lng, radiusKM, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []domain.DriverCandidate
+	for rows.Next() {
+		var (
+			c       domain.DriverCandidate
+			vehicle *domain.Vehicle
+		)
+		err = rows.Scan(&c.DriverID, &c.Name, &c.Rating, &vehicle, &c.Location.Lat, &c.Location.Lng, &c.DistanceKM)
+		if err != nil {
+			return nil, err
+		}
+		if vehicle != nil {
+			c.Vehicle = *vehicle
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// EnqueueMatch puts the accepted offer into the outbox for the ride service
+func (r *DriverRepo) EnqueueMatch(ctx context.Context, match *domain.RideResponseMatch) error {
+	msg, err := domain.NewMatchMessage(match)
+	if err != nil {
+		return err
+	}
+	return enqueue(ctx, r.db, msg)
+}
+
+// EnqueueNoDriver puts the cancellation of a ride nobody accepted into the outbox for the ride service
+func (r *DriverRepo) EnqueueNoDriver(ctx context.Context, status *domain.RideStatusUpdate) error {
+	msg, err := domain.NewRideStatusMessage(status)
+	if err != nil {
+		return err
+	}
+	return enqueue(ctx, r.db, msg)
+}
+
+// ReleaseDriver makes the driver AVAILABLE again after the ride was cancelled or the accept lost.
+// A driver who is not on that ride (a repeated cancel, went offline or on to another ride) is left as is.
+func (r *DriverRepo) ReleaseDriver(ctx context.Context, driverID uuid.UUID, rideID string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	currentStatus, err := driverState(ctx, tx, driverID)
+	if err != nil {
+		return err
+	}
+	if currentStatus != domain.DriverEnRoute && currentStatus != domain.DriverBusy {
+		return nil
+	}
+	// the ride of the latest location, like UpdateDriverLocation
+	var currentRide string
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(ride_id::text, '')
+		FROM location_history
+		WHERE driver_id = $1
+		ORDER BY recorded_at DESC
+		LIMIT 1`, driverID).Scan(&currentRide)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if currentRide != rideID {
+		return nil
+	}
+	err = moveDriver(ctx, tx, driverID, currentStatus, domain.DriverAvailable)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *DriverRepo) GetRideStatus(ctx context.Context, rideID string) (string, error) {
+	var status string
+	err := r.db.QueryRow(ctx, `SELECT status FROM rides WHERE id = $1`, rideID).Scan(&status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", domain.ErrNotFound
+		}
+		return "", err
 	}
-	return returnID, tx.Commit(ctx)
+	return status, nil
 }
@@ -0,0 +1,1253 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"taxi-hailing/intenal/domain"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps users, drivers, rides and the outbox in memory and follows the same
+// status rules as the postgres repos, so services can be run and tested without a db.
+// One store plays the whole db: pass it as RideStore, DriverStore and OutboxStore.
+// Every method holds the lock for its whole run and validates before it changes anything,
+// which is what the row locks and transactions give the postgres repos.
+type MemoryStore struct {
+	mu       sync.Mutex
+	users    map[string]*domain.User
+	drivers  map[string]*memDriver
+	rides    map[string]*memRide
+	current  map[string]*domain.CoordinateUpdate
+	sessions []*memSession
+	history  []*memLocation
+	events   map[string][]domain.RideEvent
+	outbox   []*memOutbox
+	auth     map[string]*memAuthSession
+	watchers []func(userID, sessionID string)
+	tariffs  []*domain.Tariff
+	now      func() time.Time
+}
+
+type memDriver struct {
+	domain.Driver
+	updatedAt   time.Time
+	arrivedRide string // drivers.arrived_ride_id
+}
+
+type memRide struct {
+	id                 string
+	number             string
+	passengerID        string
+	driverID           string
+	vehicleType        string
+	status             string
+	priority           uint
+	pickup             domain.Coordinates
+	destination        domain.Coordinates
+	estimatedFare      float64
+	finalFare          float64
+	tariffID           string
+	cancellationReason string
+	correlationID      string
+	createdAt          time.Time
+	updatedAt          time.Time
+	timestamps         map[string]time.Time // rides timestamp columns, see domain.RideTransition
+}
+
+type memSession struct {
+	id        uuid.UUID
+	driverID  string
+	startedAt time.Time
+	endedAt   time.Time
+	rides     int
+	earnings  float64
+}
+
+type memLocation struct {
+	id         uuid.UUID
+	driverID   string
+	rideID     uuid.UUID
+	lat        float64
+	lng        float64
+	recordedAt time.Time
+}
+
+type memAuthSession struct {
+	domain.Session
+	usedHashes    map[string]bool // every refresh hash rotated away from
+	revokedAt     time.Time
+	revokedReason string
+}
+
+type memOutbox struct {
+	msg          domain.OutboxMessage
+	createdAt    time.Time
+	sentAt       time.Time
+	claimedUntil time.Time
+	lastError    string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:   make(map[string]*domain.User),
+		drivers: make(map[string]*memDriver),
+		rides:   make(map[string]*memRide),
+		current: make(map[string]*domain.CoordinateUpdate),
+		events:  make(map[string][]domain.RideEvent),
+		auth:    make(map[string]*memAuthSession),
+		tariffs: defaultTariffs(),
+		now:     time.Now,
+	}
+}
+
+// defaultTariffs are the seed rows of the tariffs migration
+func defaultTariffs() []*domain.Tariff {
+	seed := func(vehicleType string, base, perKM, perMin float64, priority int) *domain.Tariff {
+		return &domain.Tariff{
+			ID:            uuid.NewString(),
+			VehicleType:   vehicleType,
+			Version:       1,
+			EffectiveFrom: time.Unix(0, 0).UTC(),
+			Currency:      "KZT",
+			BaseFare:      base,
+			RatePerKM:     perKM,
+			RatePerMin:    perMin,
+			Priority:      priority,
+		}
+	}
+	return []*domain.Tariff{
+		seed("ECONOMY", 500, 100, 50, 1),
+		seed("PREMIUM", 800, 120, 60, 5),
+		seed("XL", 1000, 150, 75, 10),
+	}
+}
+
+// SetClock replaces time.Now, for tests of durations and fares
+func (m *MemoryStore) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+func (m *MemoryStore) RegisterPassenger(ctx context.Context, user *domain.User) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.userByEmail(user.Email) != nil {
+		return "", fmt.Errorf("%w: email already registered", domain.Errconflict)
+	}
+	u := *user
+	u.ID = uuid.NewString()
+	u.Role = "PASSENGER"
+	u.Status = "INACTIVE"
+	u.CreatedAt = m.now()
+	u.UpdatedAt = u.CreatedAt
+	m.users[u.ID] = &u
+	return u.ID, nil
+}
+
+func (m *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.userByEmail(email)
+	if u == nil {
+		return nil, domain.ErrNotFound
+	}
+	user := *u
+	return &user, nil
+}
+
+func (m *MemoryStore) GetUserByID(ctx context.Context, id string) (*domain.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	user := *u
+	return &user, nil
+}
+
+func (m *MemoryStore) UpdatePasswordHash(ctx context.Context, userID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	u.PasswordHash = hash
+	u.UpdatedAt = m.now()
+	return nil
+}
+
+// SetUserStatus changes users.status, e.g. to BANNED
+func (m *MemoryStore) SetUserStatus(userID, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	banned := status == "BANNED" && u.Status != "BANNED"
+	u.Status = status
+	u.UpdatedAt = m.now()
+	if banned {
+		// what the users trigger does in postgres
+		m.revokeAuth(func(a *memAuthSession) bool { return a.UserID == userID }, domain.RevokeBanned)
+	}
+	return nil
+}
+
+func (m *MemoryStore) userByEmail(email string) *domain.User {
+	for _, u := range m.users {
+		if u.Email == email {
+			return u
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateRideTx(ctx context.Context, r *domain.RideRequest, res *domain.RideResponse, req *domain.RideRequestRabbit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[r.PassengerID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if u.Status == "ACTIVE" || u.Status == "BANNED" {
+		return fmt.Errorf("%w: passenger status is %s", domain.Errconflict, u.Status)
+	}
+
+	now := m.now()
+	count := 0
+	for _, ride := range m.rides {
+		if sameDay(ride.createdAt, now) {
+			count++
+		}
+	}
+	ride := &memRide{
+		id:          uuid.NewString(),
+		number:      fmt.Sprintf("RIDE_%s_%03d", now.Format("20060102"), count+1),
+		passengerID: r.PassengerID,
+		vehicleType: r.RideType,
+		status:      domain.RideRequested,
+		priority:    r.Priority,
+		pickup: domain.Coordinates{
+			Lat:     r.PickupLatitude,
+			Lng:     r.PickupLongitude,
+			Address: r.PickupAddress,
+		},
+		destination: domain.Coordinates{
+			Lat:     r.DestinationLatitude,
+			Lng:     r.DestinationLongitude,
+			Address: r.DestinationAddress,
+		},
+		estimatedFare: res.EstimatedFare,
+		tariffID:      res.TariffID,
+		correlationID: req.CorrelationID,
+		createdAt:     now,
+		updatedAt:     now,
+		timestamps:    make(map[string]time.Time),
+	}
+
+	req.RideID = ride.id
+	req.RideNumber = ride.number
+	msg, err := domain.NewRideRequestMessage(req, uint8(r.Priority))
+	if err != nil {
+		return err
+	}
+
+	u.Status = "ACTIVE"
+	u.UpdatedAt = now
+	m.current[r.PassengerID] = &domain.CoordinateUpdate{
+		UpdatedAt:  now,
+		Latitude:   r.PickupLatitude,
+		Longitude:  r.PickupLongitude,
+		FareAmount: res.BaseFare,
+	}
+	m.rides[ride.id] = ride
+	res.RideID = ride.id
+	res.RideNumber = ride.number
+	m.addEvent(ride.id, domain.EventRideRequested, map[string]any{
+		"ride_id":        ride.id,
+		"ride_number":    ride.number,
+		"estimated_fare": res.EstimatedFare,
+	})
+	m.enqueue(ctx, msg)
+	return nil
+}
+
+func (m *MemoryStore) CancelRide(ctx context.Context, passengerID, rideID string, stu *domain.CancelRideRequest, notify *domain.RideStatusUpdate) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[rideID]
+	if !ok {
+		return "", domain.ErrNotFound
+	}
+	if ride.passengerID != passengerID {
+		return "", fmt.Errorf("%w: ride belongs to another passenger", domain.ErrForbidden)
+	}
+	t, err := domain.NextRideStatus(ride.status, domain.RideCancelled)
+	if err != nil {
+		return "", err
+	}
+	notify.RideID = rideID
+	if notify.CorrelationID == "" {
+		notify.CorrelationID = ride.correlationID
+	}
+	var msg *domain.OutboxMessage
+	if ride.driverID != "" {
+		notify.DriverID = ride.driverID
+		msg, err = domain.NewDriverStatusMessage(notify)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	eventData := map[string]any{
+		"reason": stu.Reason,
+	}
+	if ride.driverID != "" {
+		eventData["driver_id"] = ride.driverID
+	}
+	ride.cancellationReason = stu.Reason
+	m.moveRide(ride, t, eventData)
+	if u, ok := m.users[passengerID]; ok && u.Status == "ACTIVE" {
+		u.Status = "INACTIVE"
+		u.UpdatedAt = m.now()
+	}
+	if msg != nil {
+		m.enqueue(ctx, msg)
+	}
+	return ride.driverID, nil
+}
+
+// RideNoDriverUpdate cancels a REQUESTED ride nobody accepted, like RideRepo.RideNoDriverUpdate
+func (m *MemoryStore) RideNoDriverUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[data.RideID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if ride.status != domain.RideRequested {
+		return fmt.Errorf("%w: ride %s is %s, not waiting for a driver", domain.ErrInvalidTransition, data.RideID, ride.status)
+	}
+	t, err := domain.NextRideStatus(ride.status, domain.RideCancelled)
+	if err != nil {
+		return err
+	}
+	ride.cancellationReason = data.Reason
+	m.moveRide(ride, t, map[string]any{"reason": data.Reason})
+	if u, ok := m.users[ride.passengerID]; ok && u.Status == "ACTIVE" {
+		u.Status = "INACTIVE"
+		u.UpdatedAt = m.now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) RideMatchedUpdate(ctx context.Context, data *domain.RideResponseMatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[data.RideID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if ride.status == domain.RideMatched && ride.driverID == data.DriverID {
+		return nil
+	}
+	if ride.status != domain.RideRequested {
+		msg, err := domain.NewDriverStatusMessage(matchLost(data))
+		if err != nil {
+			return err
+		}
+		m.enqueue(ctx, msg)
+		return fmt.Errorf("%w: ride %s is %s", domain.ErrMatchLost, data.RideID, ride.status)
+	}
+	t, err := domain.NextRideStatus(ride.status, domain.RideMatched)
+	if err != nil {
+		return err
+	}
+	ride.driverID = data.DriverID
+	m.moveRide(ride, t, map[string]any{
+		"driver_id": data.DriverID,
+		"location": map[string]float64{
+			"lat": data.DriverLocation.Lat,
+			"lng": data.DriverLocation.Lng,
+		},
+		"estimated_arrival": data.EstimatedArrival,
+	})
+	return nil
+}
+
+func (m *MemoryStore) RideEnRouteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	return m.driverRideUpdate(data, domain.RideEnRoute)
+}
+
+func (m *MemoryStore) RideArrivedUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	return m.driverRideUpdate(data, domain.RideArrived)
+}
+
+func (m *MemoryStore) RideInProgressUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	return m.driverRideUpdate(data, domain.RideInProgress)
+}
+
+func (m *MemoryStore) driverRideUpdate(data *domain.RideStatusUpdate, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[data.RideID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if ride.driverID != data.DriverID {
+		return fmt.Errorf("%w: invalid driver id: %s != %s", domain.Errconflict, data.DriverID, ride.driverID)
+	}
+	if ride.status == to {
+		return nil
+	}
+	t, err := domain.NextRideStatus(ride.status, to)
+	if err != nil {
+		return err
+	}
+	m.moveRide(ride, t, map[string]any{"driver_id": data.DriverID})
+	if coord, ok := m.current[ride.passengerID]; ok && to == domain.RideInProgress {
+		// like RideRepo, the meter starts at pickup
+		coord.UpdatedAt = m.now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) RideCompleteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[data.RideID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if ride.driverID != data.DriverID {
+		return fmt.Errorf("%w: invalid driver id: %s != %s", domain.Errconflict, data.DriverID, ride.driverID)
+	}
+	if ride.status == domain.RideCompleted {
+		return nil
+	}
+	fare, err := m.finalFare(ride)
+	if err != nil {
+		return err
+	}
+	t, err := domain.NextRideStatus(ride.status, domain.RideCompleted)
+	if err != nil {
+		return err
+	}
+	ride.finalFare = fare
+	m.moveRide(ride, t, map[string]any{
+		"driver_id":  data.DriverID,
+		"final_fare": fare,
+	})
+	if u, ok := m.users[ride.passengerID]; ok && u.Status == "ACTIVE" {
+		u.Status = "INACTIVE"
+		u.UpdatedAt = m.now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) RideLocationUpdate(ctx context.Context, data *domain.LocationCoordinateUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[data.RideID]
+	if !ok {
+		return domain.ErrNotFound
+	}
+	if ride.status != domain.RideInProgress {
+		return fmt.Errorf("%w: invalid status: %s", domain.Errconflict, ride.status)
+	}
+	if ride.driverID != data.DriverID {
+		return fmt.Errorf("%w: invalid driver id: %s != %s", domain.Errconflict, ride.driverID, data.DriverID)
+	}
+
+	now := m.now()
+	m.current[ride.passengerID] = &domain.CoordinateUpdate{
+		UpdatedAt:       now,
+		Latitude:        data.Location.Lat,
+		Longitude:       data.Location.Lng,
+		FareAmount:      data.FareAmount,
+		DistanceKm:      data.Distance,
+		DurationMinutes: data.DurationMinute,
+	}
+	ride.finalFare = data.FareAmount
+	ride.updatedAt = now
+	if ride.estimatedFare < data.FareAmount {
+		m.addEvent(ride.id, "FARE_ADJUSTED", map[string]any{
+			"raznicha": data.FareAmount - ride.estimatedFare,
+		})
+	}
+	m.addEvent(ride.id, "LOCATION_UPDATED", map[string]any{
+		"location_updated": data.Location,
+	})
+	return nil
+}
+
+func (m *MemoryStore) GetPassengerWS(ctx context.Context, id string) (*domain.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	return &domain.User{Name: u.Name, Role: u.Role, Status: u.Status, Email: u.Email}, nil
+}
+
+func (m *MemoryStore) GetPassengerIDByRideID(ctx context.Context, id string) (string, error) {
+	ride, err := m.ride(id)
+	if err != nil {
+		return "", err
+	}
+	return ride.passengerID, nil
+}
+
+func (m *MemoryStore) GetRideNumberByRideID(ctx context.Context, id string) (string, error) {
+	ride, err := m.ride(id)
+	if err != nil {
+		return "", err
+	}
+	return ride.number, nil
+}
+
+func (m *MemoryStore) GetRideStatus(ctx context.Context, rideID string) (string, error) {
+	ride, err := m.ride(rideID)
+	if err != nil {
+		return "", err
+	}
+	return ride.status, nil
+}
+
+func (m *MemoryStore) GetRideVehicleType(ctx context.Context, rideID string) (string, error) {
+	ride, err := m.ride(rideID)
+	if err != nil {
+		return "", err
+	}
+	return ride.vehicleType, nil
+}
+
+func (m *MemoryStore) ActiveTariffs(ctx context.Context, at time.Time) (map[string]*domain.Tariff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := make(map[string]*domain.Tariff)
+	for _, t := range m.tariffs {
+		if t.EffectiveFrom.After(at) {
+			continue
+		}
+		cur, ok := active[t.VehicleType]
+		if ok && (cur.EffectiveFrom.After(t.EffectiveFrom) || cur.EffectiveFrom.Equal(t.EffectiveFrom) && cur.Version > t.Version) {
+			continue
+		}
+		c := *t
+		c.Active = true
+		active[t.VehicleType] = &c
+	}
+	return active, nil
+}
+
+func (m *MemoryStore) GetTariff(ctx context.Context, id string) (*domain.Tariff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tariff(id)
+}
+
+func (m *MemoryStore) GetRideTariff(ctx context.Context, rideID string) (*domain.Tariff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[rideID]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	return m.tariff(ride.tariffID)
+}
+
+func (m *MemoryStore) tariff(id string) (*domain.Tariff, error) {
+	for _, t := range m.tariffs {
+		if t.ID == id {
+			c := *t
+			return &c, nil
+		}
+	}
+	return nil, domain.ErrNotFound
+}
+
+// finalFare is finalFare of the postgres repos
+func (m *MemoryStore) finalFare(ride *memRide) (float64, error) {
+	coord, ok := m.current[ride.passengerID]
+	if !ok {
+		return 0, domain.ErrNotFound
+	}
+	t, err := m.tariff(ride.tariffID)
+	if err != nil {
+		return 0, err
+	}
+	var waiting time.Duration
+	arrived, okArrived := ride.timestamps["arrived_at"]
+	started, okStarted := ride.timestamps["started_at"]
+	if okArrived && okStarted {
+		waiting = started.Sub(arrived)
+	}
+	return t.Final(coord.FareAmount, waiting), nil
+}
+
+func (m *MemoryStore) GetCurrentCoordinate(ctx context.Context, passengerID string) (*domain.CoordinateUpdate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coord, ok := m.current[passengerID]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	c := *coord
+	return &c, nil
+}
+
+// GetRideEvents returns the ride_events of the ride in creation order, like AdminRepo
+func (m *MemoryStore) GetRideEvents(ctx context.Context, rideID string) ([]domain.RideEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rides[rideID]; !ok {
+		return nil, domain.ErrNotFound
+	}
+	return append([]domain.RideEvent{}, m.events[rideID]...), nil
+}
+
+func (m *MemoryStore) ride(id string) (memRide, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ride, ok := m.rides[id]
+	if !ok {
+		return memRide{}, domain.ErrNotFound
+	}
+	return *ride, nil
+}
+
+// moveRide applies the checked transition, like moveRide of the postgres repos
+func (m *MemoryStore) moveRide(ride *memRide, t domain.RideTransition, eventData map[string]any) {
+	now := m.now()
+	ride.status = t.To
+	ride.updatedAt = now
+	if t.TimestampColumn != "" {
+		ride.timestamps[t.TimestampColumn] = now
+	}
+	eventData["old_status"] = t.From
+	eventData["new_status"] = t.To
+	m.addEvent(ride.id, t.EventType, eventData)
+}
+
+func (m *MemoryStore) addEvent(rideID, eventType string, data map[string]any) {
+	m.events[rideID] = append(m.events[rideID], domain.RideEvent{
+		ID:        uuid.NewString(),
+		EventType: eventType,
+		EventData: data,
+		CreatedAt: m.now(),
+	})
+}
+
+func (m *MemoryStore) CreateDriver(ctx context.Context, driver *domain.Driver) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.userByEmail(driver.Email) != nil {
+		return fmt.Errorf("%w: email already registered", domain.Errconflict)
+	}
+	for _, d := range m.drivers {
+		if d.LicenseNumber == driver.LicenseNumber {
+			return fmt.Errorf("%w: license number already registered", domain.Errconflict)
+		}
+	}
+	now := m.now()
+	driver.ID = uuid.NewString()
+	m.users[driver.ID] = &domain.User{
+		ID:           driver.ID,
+		Name:         driver.Name,
+		Email:        driver.Email,
+		PasswordHash: driver.PasswordHash,
+		Role:         "DRIVER",
+		Status:       "ACTIVE",
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	d := &memDriver{Driver: *driver, updatedAt: now}
+	d.Status = domain.DriverOffline
+	if d.Rating == 0 {
+		d.Rating = 5.0
+	}
+	m.drivers[driver.ID] = d
+	return nil
+}
+
+func (m *MemoryStore) UpdateDriverToOnline(ctx context.Context, driverID uuid.UUID, location *domain.Location) (uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.moveDriver(driverID, domain.DriverAvailable)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	now := m.now()
+	s := &memSession{id: uuid.New(), driverID: d.ID, startedAt: now}
+	m.sessions = append(m.sessions, s)
+	m.addLocation(d.ID, uuid.Nil, location.Lat, location.Lng)
+	return s.id, nil
+}
+
+func (m *MemoryStore) UpdateDriverToOffline(ctx context.Context, driverID uuid.UUID) (*uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.openSession(driverID.String())
+	if s == nil {
+		return nil, fmt.Errorf("%w: driver %s has no open session", domain.ErrNotFound, driverID)
+	}
+	_, err := m.moveDriver(driverID, domain.DriverOffline)
+	if err != nil {
+		return nil, err
+	}
+	s.endedAt = m.now()
+	return &s.id, nil
+}
+
+func (m *MemoryStore) GetDriverSessionSummary(ctx context.Context, sessionID *uuid.UUID) (*domain.DriverSessionSummary, error) {
+	if sessionID == nil {
+		return nil, fmt.Errorf("sessionID is nil")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		if s.id == *sessionID && !s.endedAt.IsZero() {
+			return &domain.DriverSessionSummary{
+				DurationHours:  s.endedAt.Sub(s.startedAt).Hours(),
+				RidesCompleted: s.rides,
+				Earnings:       s.earnings,
+			}, nil
+		}
+	}
+	return nil, domain.ErrNotFound
+}
+
+func (m *MemoryStore) UpdateDriverToEnRoute(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.driver(driverID)
+	if err != nil {
+		return err
+	}
+	err = domain.CheckDriverTransition(d.Status, domain.DriverEnRoute)
+	if err != nil {
+		return err
+	}
+	rideID, err := m.driverRide(req.RideID, driverID, domain.RideEnRoute)
+	if err != nil {
+		return err
+	}
+	msg, err := m.rideStatusMessage(status)
+	if err != nil {
+		return err
+	}
+	m.setDriverStatus(d, domain.DriverEnRoute)
+	m.addLocation(d.ID, rideID, req.DriverLocation.Latitude, req.DriverLocation.Longitude)
+	m.enqueue(ctx, msg)
+	return nil
+}
+
+// UpdateDriverToArrived keeps the driver EN_ROUTE, marks the arrival Start checks and records the location at the pickup point
+func (m *MemoryStore) UpdateDriverToArrived(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.driver(driverID)
+	if err != nil {
+		return err
+	}
+	err = domain.CheckDriverStatus(d.Status, domain.DriverEnRoute)
+	if err != nil {
+		return err
+	}
+	rideID, err := m.driverRide(req.RideID, driverID, domain.RideArrived)
+	if err != nil {
+		return err
+	}
+	msg, err := m.rideStatusMessage(status)
+	if err != nil {
+		return err
+	}
+	d.updatedAt = m.now()
+	d.arrivedRide = req.RideID
+	m.addLocation(d.ID, rideID, req.DriverLocation.Latitude, req.DriverLocation.Longitude)
+	m.enqueue(ctx, msg)
+	return nil
+}
+
+// UpdateDriverToBusy starts the ride, only after the driver reported arriving at its pickup
+func (m *MemoryStore) UpdateDriverToBusy(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.driver(driverID)
+	if err != nil {
+		return err
+	}
+	err = domain.CheckDriverTransition(d.Status, domain.DriverBusy)
+	if err != nil {
+		return err
+	}
+	rideID, err := m.driverRide(req.RideID, driverID, domain.RideInProgress)
+	if err != nil {
+		return err
+	}
+	err = checkArrived(req.RideID, d.arrivedRide)
+	if err != nil {
+		return err
+	}
+	msg, err := m.rideStatusMessage(status)
+	if err != nil {
+		return err
+	}
+	m.setDriverStatus(d, domain.DriverBusy)
+	m.addLocation(d.ID, rideID, req.DriverLocation.Latitude, req.DriverLocation.Longitude)
+	m.enqueue(ctx, msg)
+	return nil
+}
+
+func (m *MemoryStore) CompleteRide(ctx context.Context, driverID uuid.UUID, req *domain.CompleteRideRequest, status *domain.RideStatusUpdate) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.driver(driverID)
+	if err != nil {
+		return 0, err
+	}
+	// BUSY is the driver's own record of the start, the ride may not have applied IN_PROGRESS yet
+	err = domain.CheckDriverStatus(d.Status, domain.DriverBusy)
+	if err != nil {
+		return 0, err
+	}
+	rideID, err := m.driverRide(req.RideID, driverID, domain.RideCompleted)
+	if err != nil {
+		return 0, err
+	}
+	ride := m.rides[req.RideID]
+	fare, err := m.finalFare(ride)
+	if err != nil {
+		return 0, err
+	}
+	msg, err := m.rideStatusMessage(status)
+	if err != nil {
+		return 0, err
+	}
+
+	m.setDriverStatus(d, domain.DriverAvailable)
+	m.addLocation(d.ID, rideID, req.FinalLocation.Lat, req.FinalLocation.Lng)
+	if s := m.openSession(d.ID); s != nil {
+		s.rides++
+		s.earnings += fare
+	}
+	m.enqueue(ctx, msg)
+	return fare, nil
+}
+
+// UpdateDriverLocation records the location, linked to the ride of the latest history row
+// when the driver is EN_ROUTE or BUSY. Returns the history id and the ride id.
+func (m *MemoryStore) UpdateDriverLocation(ctx context.Context, driverID uuid.UUID, loc *domain.LocationUpdate) (uuid.UUID, uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.driver(driverID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	var rideID uuid.UUID
+	switch d.Status {
+	case domain.DriverOffline:
+		return uuid.Nil, uuid.Nil, fmt.Errorf("cannot update driver offines")
+	case domain.DriverAvailable:
+	case domain.DriverBusy, domain.DriverEnRoute:
+		last := m.lastLocation(d.ID)
+		if last == nil {
+			return uuid.Nil, uuid.Nil, fmt.Errorf("cannot get rideID from location_history for driver: %w", domain.ErrNotFound)
+		}
+		rideID = last.rideID
+	default:
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid driver status: %s", d.Status)
+	}
+	l := m.addLocation(d.ID, rideID, loc.Latitude, loc.Longitude)
+	return l.id, rideID, nil
+}
+
+// FindNearbyDrivers returns AVAILABLE drivers of the vehicle type within radiusKM of pickup,
+// nearest and best rated first, skipping drivers assigned to an unfinished ride
+func (m *MemoryStore) FindNearbyDrivers(ctx context.Context, vehicleType string, pickup *domain.Location, radiusKM float64, limit int) ([]domain.DriverCandidate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	busy := make(map[string]bool)
+	for _, ride := range m.rides {
+		if ride.driverID != "" && ride.status != domain.RideRequested && domain.IsRideActive(ride.status) {
+			busy[ride.driverID] = true
+		}
+	}
+
+	var candidates []domain.DriverCandidate
+	for id, d := range m.drivers {
+		if d.Status != domain.DriverAvailable || d.VehicleType != vehicleType || busy[id] {
+			continue
+		}
+		last := m.lastLocation(id)
+		if last == nil {
+			continue
+		}
+		dist := haversineKM(pickup.Lat, pickup.Lng, last.lat, last.lng)
+		if dist > radiusKM {
+			continue
+		}
+		candidates = append(candidates, domain.DriverCandidate{
+			DriverID:   id,
+			Name:       d.Name,
+			Rating:     d.Rating,
+			Vehicle:    d.VehicleAttrs,
+			Location:   domain.Location{Lat: last.lat, Lng: last.lng},
+			DistanceKM: dist,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].DistanceKM != candidates[j].DistanceKM {
+			return candidates[i].DistanceKM < candidates[j].DistanceKM
+		}
+		return candidates[i].Rating > candidates[j].Rating
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates, nil
+}
+
+// EnqueueMatch puts the accepted offer into the outbox for the ride service
+func (m *MemoryStore) EnqueueMatch(ctx context.Context, match *domain.RideResponseMatch) error {
+	msg, err := domain.NewMatchMessage(match)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enqueue(ctx, msg)
+	return nil
+}
+
+// EnqueueNoDriver puts the cancellation of a ride nobody accepted into the outbox for the ride service
+func (m *MemoryStore) EnqueueNoDriver(ctx context.Context, status *domain.RideStatusUpdate) error {
+	msg, err := domain.NewRideStatusMessage(status)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enqueue(ctx, msg)
+	return nil
+}
+
+// ReleaseDriver makes the driver AVAILABLE again after the ride was cancelled or the accept lost,
+// a driver who is not on that ride is left as is
+func (m *MemoryStore) ReleaseDriver(ctx context.Context, driverID uuid.UUID, rideID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, err := m.driver(driverID)
+	if err != nil {
+		return err
+	}
+	if d.Status != domain.DriverEnRoute && d.Status != domain.DriverBusy {
+		return nil
+	}
+	if last := m.lastLocation(d.ID); last == nil || last.rideID.String() != rideID {
+		return nil
+	}
+	_, err = m.moveDriver(driverID, domain.DriverAvailable)
+	return err
+}
+
+// rideStatusMessage sends the status with the correlation id of the ride, like enqueueRideStatus
+func (m *MemoryStore) rideStatusMessage(status *domain.RideStatusUpdate) (*domain.OutboxMessage, error) {
+	if status.CorrelationID == "" {
+		ride, ok := m.rides[status.RideID]
+		if !ok {
+			return nil, domain.ErrNotFound
+		}
+		status.CorrelationID = ride.correlationID
+	}
+	return domain.NewRideStatusMessage(status)
+}
+
+func (m *MemoryStore) driver(driverID uuid.UUID) (*memDriver, error) {
+	d, ok := m.drivers[driverID.String()]
+	if !ok {
+		return nil, domain.ErrNotFound
+	}
+	return d, nil
+}
+
+// moveDriver applies the domain transition to the current status of the driver
+func (m *MemoryStore) moveDriver(driverID uuid.UUID, to string) (*memDriver, error) {
+	d, err := m.driver(driverID)
+	if err != nil {
+		return nil, err
+	}
+	err = domain.CheckDriverTransition(d.Status, to)
+	if err != nil {
+		return nil, err
+	}
+	m.setDriverStatus(d, to)
+	return d, nil
+}
+
+// setDriverStatus changes the status, which clears the arrival like moveDriver of the postgres repo
+func (m *MemoryStore) setDriverStatus(d *memDriver, status string) {
+	d.Status = status
+	d.arrivedRide = ""
+	d.updatedAt = m.now()
+}
+
+// driverRide checks the ride for the driver's action like driverRide of the postgres repo
+func (m *MemoryStore) driverRide(rideID string, driverID uuid.UUID, to string) (uuid.UUID, error) {
+	ride, ok := m.rides[rideID]
+	if !ok {
+		return uuid.Nil, domain.ErrNotFound
+	}
+	err := checkDriverRide(rideID, ride.status, ride.driverID, driverID, to)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(ride.id)
+}
+
+func (m *MemoryStore) openSession(driverID string) *memSession {
+	for _, s := range m.sessions {
+		if s.driverID == driverID && s.endedAt.IsZero() {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) addLocation(driverID string, rideID uuid.UUID, lat, lng float64) *memLocation {
+	l := &memLocation{
+		id:         uuid.New(),
+		driverID:   driverID,
+		rideID:     rideID,
+		lat:        lat,
+		lng:        lng,
+		recordedAt: m.now(),
+	}
+	m.history = append(m.history, l)
+	return l
+}
+
+func (m *MemoryStore) lastLocation(driverID string) *memLocation {
+	for i := len(m.history) - 1; i >= 0; i-- {
+		if m.history[i].driverID == driverID {
+			return m.history[i]
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) enqueue(ctx context.Context, msg *domain.OutboxMessage) {
+	addTraceHeaders(ctx, msg)
+	o := &memOutbox{msg: *msg, createdAt: m.now()}
+	o.msg.ID = uuid.NewString()
+	m.outbox = append(m.outbox, o)
+}
+
+// Relay publishes up to limit pending messages in creation order, like OutboxRepo.Relay:
+// the batch is claimed for lease under the lock and published without it.
+func (m *MemoryStore) Relay(ctx context.Context, limit int, lease time.Duration, publish func(context.Context, *domain.OutboxMessage) error) (int, error) {
+	m.mu.Lock()
+	now := m.now()
+	var batch []*memOutbox
+	for _, o := range m.outbox {
+		if len(batch) == limit {
+			break
+		}
+		if o.sentAt.IsZero() && !o.claimedUntil.After(now) {
+			o.claimedUntil = now.Add(lease)
+			batch = append(batch, o)
+		}
+	}
+	msgs := make([]domain.OutboxMessage, len(batch))
+	for i, o := range batch {
+		msgs[i] = o.msg
+	}
+	m.mu.Unlock()
+
+	for i := range msgs {
+		err := publish(ctx, &msgs[i])
+		m.mu.Lock()
+		if err != nil {
+			batch[i].msg.Attempts++
+			batch[i].lastError = err.Error()
+			for _, o := range batch[i:] {
+				o.claimedUntil = time.Time{}
+			}
+			m.mu.Unlock()
+			return i, err
+		}
+		batch[i].sentAt = m.now()
+		batch[i].claimedUntil = time.Time{}
+		m.mu.Unlock()
+	}
+	return len(msgs), nil
+}
+
+// PurgeSent deletes messages published more than olderThan ago
+func (m *MemoryStore) PurgeSent(ctx context.Context, olderThan time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := len(m.outbox)
+	deadline := m.now().Add(-olderThan)
+	m.outbox = slices.DeleteFunc(m.outbox, func(o *memOutbox) bool {
+		return !o.sentAt.IsZero() && o.sentAt.Before(deadline)
+	})
+	return int64(before - len(m.outbox)), nil
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, s *domain.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[s.UserID]; !ok {
+		return domain.ErrNotFound
+	}
+	s.ID = uuid.NewString()
+	m.auth[s.ID] = &memAuthSession{Session: *s, usedHashes: make(map[string]bool)}
+	return nil
+}
+
+func (m *MemoryStore) RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*domain.SessionUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a *memAuthSession
+	for _, s := range m.auth {
+		if s.RefreshHash == oldHash || s.usedHashes[oldHash] {
+			a = s
+			break
+		}
+	}
+	if a == nil {
+		return nil, fmt.Errorf("%w: unknown refresh token", domain.ErrUnauthorized)
+	}
+	if !a.revokedAt.IsZero() || !a.ExpiresAt.After(m.now()) {
+		return nil, fmt.Errorf("%w: session is revoked or expired", domain.ErrUnauthorized)
+	}
+	u := m.users[a.UserID]
+	current := a.RefreshHash == oldHash
+	if !current || u.Status == "BANNED" {
+		reason := domain.RevokeReused
+		if current {
+			reason = domain.RevokeBanned
+		}
+		m.revokeAuth(func(s *memAuthSession) bool { return s == a }, reason)
+		return nil, fmt.Errorf("%w: session revoked, %s", domain.ErrUnauthorized, reason)
+	}
+	a.usedHashes[a.RefreshHash] = true
+	a.RefreshHash = newHash
+	a.ExpiresAt = expiresAt
+	return &domain.SessionUser{
+		SessionID: a.ID,
+		UserID:    u.ID,
+		Name:      u.Name,
+		Email:     u.Email,
+		Role:      u.Role,
+		Status:    u.Status,
+	}, nil
+}
+
+func (m *MemoryStore) RevokeSession(ctx context.Context, userID, sessionID, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.auth[sessionID]
+	if !ok || a.UserID != userID {
+		return domain.ErrNotFound
+	}
+	m.revokeAuth(func(s *memAuthSession) bool { return s == a }, reason)
+	return nil
+}
+
+func (m *MemoryStore) RevokeUserSessions(ctx context.Context, userID, reason string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.revokeAuth(func(s *memAuthSession) bool { return s.UserID == userID }, reason), nil
+}
+
+func (m *MemoryStore) CheckSession(ctx context.Context, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.auth[sessionID]
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: unknown session", domain.ErrUnauthorized)
+	case !a.revokedAt.IsZero():
+		return fmt.Errorf("%w: session is revoked", domain.ErrUnauthorized)
+	case !a.ExpiresAt.After(m.now()):
+		return fmt.Errorf("%w: session is expired", domain.ErrUnauthorized)
+	case m.users[a.UserID].Status == "BANNED":
+		return fmt.Errorf("%w: user is banned", domain.ErrUnauthorized)
+	}
+	return nil
+}
+
+// WatchRevocations calls fn for every session revoked until ctx is done
+func (m *MemoryStore) WatchRevocations(ctx context.Context, fn func(userID, sessionID string)) error {
+	m.mu.Lock()
+	m.watchers = append(m.watchers, fn)
+	idx := len(m.watchers) - 1
+	m.mu.Unlock()
+	<-ctx.Done()
+	m.mu.Lock()
+	m.watchers[idx] = nil
+	m.mu.Unlock()
+	return ctx.Err()
+}
+
+// revokeAuth revokes the active sessions which match and notifies the watchers
+// asynchronously, like NOTIFY does after the commit. Caller holds the lock.
+func (m *MemoryStore) revokeAuth(match func(*memAuthSession) bool, reason string) int64 {
+	var n int64
+	for _, a := range m.auth {
+		if !a.revokedAt.IsZero() || !match(a) {
+			continue
+		}
+		a.revokedAt = m.now()
+		a.revokedReason = reason
+		n++
+		for _, w := range m.watchers {
+			if w != nil {
+				go w(a.UserID, a.ID)
+			}
+		}
+	}
+	return n
+}
+
+// Pending returns the messages not published yet, for checking what a call enqueued
+func (m *MemoryStore) Pending() []domain.OutboxMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var msgs []domain.OutboxMessage
+	for _, o := range m.outbox {
+		if o.sentAt.IsZero() {
+			msgs = append(msgs, o.msg)
+		}
+	}
+	return msgs
+}
+
+func sameDay(a, b time.Time) bool {
+	y1, m1, d1 := a.Date()
+	y2, m2, d2 := b.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2
+}
+
+func haversineKM(lat1, lon1, lat2, lon2 float64) float64 {
+	const r = 6371.0
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Sin(dLon/2)*math.Sin(dLon/2)*math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)
+	return r * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
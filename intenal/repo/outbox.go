@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type OutboxRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewOutboxRepo(pool *pgxpool.Pool) *OutboxRepo {
+	return &OutboxRepo{
+		db: pool,
+	}
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// enqueue saves the message, given the caller's tx it is published only if the tx commits.
+// The trace and correlation id of ctx go to the headers, the ride's correlation id set by domain wins.
+func enqueue(ctx context.Context, db execer, msg *domain.OutboxMessage) error {
+	addTraceHeaders(ctx, msg)
+	_, err := db.Exec(ctx, `
+		INSERT INTO outbox (exchange, routing_key, priority, payload, headers)
+		VALUES ($1, $2, $3, $4, $5)
+	`, msg.Exchange, msg.RoutingKey, msg.Priority, msg.Payload, msg.Headers)
+	return err
+}
+
+func addTraceHeaders(ctx context.Context, msg *domain.OutboxMessage) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	for k, v := range pkg.InjectHeaders(ctx) {
+		if _, ok := msg.Headers[k]; !ok {
+			msg.Headers[k] = v
+		}
+	}
+}
+
+// Relay publishes up to limit pending messages in creation order and marks them sent.
+// The batch is claimed for lease and committed first, so no transaction is open while rabbit is slow,
+// and relays of several services do not publish the same message. A relay which dies mid batch
+// leaves the rest to be claimed again once the lease is over, rabbit gets those at least once.
+// On the first publish error the batch stops, the message and the rest of the batch stay pending.
+func (o *OutboxRepo) Relay(ctx context.Context, limit int, lease time.Duration, publish func(context.Context, *domain.OutboxMessage) error) (int, error) {
+	msgs, err := o.claim(ctx, limit, lease)
+	if err != nil {
+		return 0, err
+	}
+	for i, msg := range msgs {
+		pubErr := publish(ctx, msg)
+		if pubErr != nil {
+			_, err = o.db.Exec(ctx, `
+				UPDATE outbox
+				SET attempts = attempts + 1, last_error = $2, claimed_until = NULL
+				WHERE id = $1
+			`, msg.ID, pubErr.Error())
+			if err != nil {
+				return i, err
+			}
+			// the next relay starts with the failed message again, not past it
+			err = o.unclaim(ctx, msgs[i+1:])
+			if err != nil {
+				return i, err
+			}
+			return i, pubErr
+		}
+		_, err = o.db.Exec(ctx, `UPDATE outbox SET sent_at = now(), claimed_until = NULL WHERE id = $1`, msg.ID)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// claim takes the oldest pending messages nobody holds a lease on
+func (o *OutboxRepo) claim(ctx context.Context, limit int, lease time.Duration) ([]*domain.OutboxMessage, error) {
+	rows, err := o.db.Query(ctx, `
+		UPDATE outbox
+		SET claimed_until = now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until < now())
+			ORDER BY created_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, exchange, routing_key, priority, payload, attempts, headers, created_at
+	`, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []*domain.OutboxMessage
+	created := make(map[*domain.OutboxMessage]time.Time)
+	for rows.Next() {
+		msg := new(domain.OutboxMessage)
+		var createdAt time.Time
+		err = rows.Scan(&msg.ID, &msg.Exchange, &msg.RoutingKey, &msg.Priority, &msg.Payload, &msg.Attempts, &msg.Headers, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		created[msg] = createdAt
+		msgs = append(msgs, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING has no order
+	slices.SortStableFunc(msgs, func(a, b *domain.OutboxMessage) int {
+		return created[a].Compare(created[b])
+	})
+	return msgs, nil
+}
+
+// unclaim gives the messages back before their lease is over
+func (o *OutboxRepo) unclaim(ctx context.Context, msgs []*domain.OutboxMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	_, err := o.db.Exec(ctx, `UPDATE outbox SET claimed_until = NULL WHERE id = ANY($1::uuid[])`, ids)
+	return err
+}
+
+// PurgeSent deletes messages published more than olderThan ago
+func (o *OutboxRepo) PurgeSent(ctx context.Context, olderThan time.Duration) (int64, error) {
+	tag, err := o.db.Exec(ctx, `
+		DELETE FROM outbox
+		WHERE sent_at IS NOT NULL AND sent_at < now() - make_interval(secs => $1)
+	`, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// enqueueRideStatus sends the status with the correlation id of the ride,
+// the driver's requests do not know it
+func enqueueRideStatus(ctx context.Context, tx pgx.Tx, status *domain.RideStatusUpdate) error {
+	err := fillCorrelationID(ctx, tx, status)
+	if err != nil {
+		return err
+	}
+	msg, err := domain.NewRideStatusMessage(status)
+	if err != nil {
+		return err
+	}
+	return enqueue(ctx, tx, msg)
+}
+
+// fillCorrelationID sets the correlation id minted when the ride was requested, if it is not set yet
+func fillCorrelationID(ctx context.Context, tx pgx.Tx, status *domain.RideStatusUpdate) error {
+	if status.CorrelationID != "" {
+		return nil
+	}
+	err := tx.QueryRow(ctx, `SELECT COALESCE(correlation_id, '') FROM rides WHERE id = $1`, status.RideID).Scan(&status.CorrelationID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.ErrNotFound
+	}
+	return err
+}
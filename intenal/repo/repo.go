@@ -0,0 +1,90 @@
+package repo
+
+import (
+	"context"
+	"taxi-hailing/intenal/domain"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RideStore is what the ride service needs from the db: passengers, rides and their status
+// transitions. Implemented by RideRepo (postgres) and MemoryStore.
+type RideStore interface {
+	CreateRideTx(ctx context.Context, r *domain.RideRequest, res *domain.RideResponse, req *domain.RideRequestRabbit) error
+	CancelRide(ctx context.Context, passengerID, rideID string, stu *domain.CancelRideRequest, notify *domain.RideStatusUpdate) (string, error)
+	RideMatchedUpdate(ctx context.Context, data *domain.RideResponseMatch) error
+	RideEnRouteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error
+	RideArrivedUpdate(ctx context.Context, data *domain.RideStatusUpdate) error
+	RideInProgressUpdate(ctx context.Context, data *domain.RideStatusUpdate) error
+	RideCompleteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error
+	RideNoDriverUpdate(ctx context.Context, data *domain.RideStatusUpdate) error
+	RideLocationUpdate(ctx context.Context, data *domain.LocationCoordinateUpdate) error
+	GetPassengerWS(ctx context.Context, id string) (*domain.User, error)
+	GetPassengerIDByRideID(ctx context.Context, id string) (string, error)
+	GetRideNumberByRideID(ctx context.Context, id string) (string, error)
+	GetRideStatus(ctx context.Context, rideID string) (string, error)
+	GetRideVehicleType(ctx context.Context, rideID string) (string, error)
+	ActiveTariffs(ctx context.Context, at time.Time) (map[string]*domain.Tariff, error)
+	GetTariff(ctx context.Context, id string) (*domain.Tariff, error)
+	GetRideTariff(ctx context.Context, rideID string) (*domain.Tariff, error)
+	GetCurrentCoordinate(ctx context.Context, passengerID string) (*domain.CoordinateUpdate, error)
+}
+
+// DriverStore is what the driver service needs from the db: drivers, their sessions,
+// locations and the driver side of the ride. Implemented by DriverRepo (postgres) and MemoryStore.
+type DriverStore interface {
+	UpdateDriverToOnline(ctx context.Context, driverID uuid.UUID, location *domain.Location) (uuid.UUID, error)
+	UpdateDriverToOffline(ctx context.Context, driverID uuid.UUID) (*uuid.UUID, error)
+	GetDriverSessionSummary(ctx context.Context, sessionID *uuid.UUID) (*domain.DriverSessionSummary, error)
+	UpdateDriverToEnRoute(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error
+	UpdateDriverToArrived(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error
+	UpdateDriverToBusy(ctx context.Context, driverID uuid.UUID, req *domain.DriverLocationMessage, status *domain.RideStatusUpdate) error
+	CompleteRide(ctx context.Context, driverID uuid.UUID, req *domain.CompleteRideRequest, status *domain.RideStatusUpdate) (float64, error)
+	UpdateDriverLocation(ctx context.Context, driverID uuid.UUID, loc *domain.LocationUpdate) (uuid.UUID, uuid.UUID, error)
+	FindNearbyDrivers(ctx context.Context, vehicleType string, pickup *domain.Location, radiusKM float64, limit int) ([]domain.DriverCandidate, error)
+	EnqueueMatch(ctx context.Context, match *domain.RideResponseMatch) error
+	EnqueueNoDriver(ctx context.Context, status *domain.RideStatusUpdate) error
+	ReleaseDriver(ctx context.Context, driverID uuid.UUID, rideID string) error
+	GetRideStatus(ctx context.Context, rideID string) (string, error)
+}
+
+// OutboxStore is what the outbox relay needs. Implemented by OutboxRepo (postgres) and MemoryStore.
+type OutboxStore interface {
+	Relay(ctx context.Context, limit int, lease time.Duration, publish func(context.Context, *domain.OutboxMessage) error) (int, error)
+	PurgeSent(ctx context.Context, olderThan time.Duration) (int64, error)
+}
+
+// UserStore is what the auth service needs: users of every role and their passwords.
+// Implemented by UserRepo (postgres) and MemoryStore.
+type UserStore interface {
+	RegisterPassenger(ctx context.Context, user *domain.User) (string, error)
+	CreateDriver(ctx context.Context, driver *domain.Driver) error
+	GetUserByEmail(ctx context.Context, email string) (*domain.User, error)
+	GetUserByID(ctx context.Context, id string) (*domain.User, error)
+	UpdatePasswordHash(ctx context.Context, userID, hash string) error
+}
+
+// SessionStore keeps login sessions, their refresh tokens and revocations.
+// Implemented by SessionRepo (postgres) and MemoryStore.
+type SessionStore interface {
+	CreateSession(ctx context.Context, s *domain.Session) error
+	RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*domain.SessionUser, error)
+	RevokeSession(ctx context.Context, userID, sessionID, reason string) error
+	RevokeUserSessions(ctx context.Context, userID, reason string) (int64, error)
+	CheckSession(ctx context.Context, sessionID string) error
+	WatchRevocations(ctx context.Context, fn func(userID, sessionID string)) error
+}
+
+var (
+	_ RideStore    = (*RideRepo)(nil)
+	_ DriverStore  = (*DriverRepo)(nil)
+	_ OutboxStore  = (*OutboxRepo)(nil)
+	_ UserStore    = (*UserRepo)(nil)
+	_ SessionStore = (*SessionRepo)(nil)
+	_ RideStore    = (*MemoryStore)(nil)
+	_ DriverStore  = (*MemoryStore)(nil)
+	_ OutboxStore  = (*MemoryStore)(nil)
+	_ UserStore    = (*MemoryStore)(nil)
+	_ SessionStore = (*MemoryStore)(nil)
+)
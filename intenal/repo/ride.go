@@ -21,33 +21,9 @@ func NewRideRepo(pool *pgxpool.Pool) *RideRepo {
 	}
 }
 
-func (p *RideRepo) RegisterPassenger(ctx context.Context, user *domain.User) (string, error) {
-	var id string
-	err := p.db.QueryRow(ctx, `
-			INSERT INTO users (name, email, role, password_hash)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id`,
-		user.Name, user.Email, user.Role, user.PasswordHash).Scan(&id)
-	return id, err
-}
-
-func (p *RideRepo) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
-	user := new(domain.User)
-	err := p.db.QueryRow(ctx, `
-		SELECT id, name, password_hash, role, status
-		FROM users
-		WHERE email = $1
-	`, email).Scan(&user.ID, &user.Name, &user.PasswordHash, &user.Role, &user.Status)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, domain.ErrNotFound
-		}
-		return nil, err
-	}
-	return user, nil
-}
-
-func (p *RideRepo) CreateRideTx(ctx context.Context, r *domain.RideRequest, res *domain.RideResponse) error {
+// CreateRideTx saves the ride and puts req into the outbox for the driver service,
+// req gets the ride id and number of the new ride.
+func (p *RideRepo) CreateRideTx(ctx context.Context, r *domain.RideRequest, res *domain.RideResponse, req *domain.RideRequestRabbit) error {
 	// Начинаем транзакцию
 	tx, err := p.db.Begin(ctx)
 	if err != nil {
@@ -58,15 +34,15 @@ func (p *RideRepo) CreateRideTx(ctx context.Context, r *domain.RideRequest, res
 	var pickupID, destID, rideID string
 	var passengerStatus string
 
-	err = p.db.QueryRow(ctx, `SELECT status FROM users WHERE id = $1`, r.PassengerID).Scan(&passengerStatus)
+	err = tx.QueryRow(ctx, `SELECT status FROM users WHERE id = $1 FOR UPDATE`, r.PassengerID).Scan(&passengerStatus)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return domain.ErrNotFound
 		}
 		return err
 	}
-	if passengerStatus == "ACTIVE" {
-		return fmt.Errorf("passenger is active already")
+	if passengerStatus == "ACTIVE" || passengerStatus == "BANNED" {
+		return fmt.Errorf("%w: passenger status is %s", domain.Errconflict, passengerStatus)
 	}
 
 	_, err = tx.Exec(ctx, `
@@ -78,9 +54,6 @@ func (p *RideRepo) CreateRideTx(ctx context.Context, r *domain.RideRequest, res
 	if err != nil {
 		return err
 	}
-	if passengerStatus == "ACTIVE" || passengerStatus == "BANNED" {
-		return fmt.Errorf("invalid status: %s", passengerStatus)
-	}
 	// Вставляем pickup координату
 	err = tx.QueryRow(ctx, `
         INSERT INTO coordinates (
@@ -132,10 +105,10 @@ func (p *RideRepo) CreateRideTx(ctx context.Context, r *domain.RideRequest, res
 	// Создаём поездку
 	rideNumber := fmt.Sprintf("RIDE_%s_%03d", time.Now().Format("20060102"), count+1) // упрощённо
 	err = tx.QueryRow(ctx, `
-        INSERT INTO rides (ride_number, passenger_id, vehicle_type, status, priority, pickup_coordinate_id, destination_coordinate_id, estimated_fare)
-        VALUES ($1, $2, $3, 'REQUESTED',$4, $5, $6, $7)
+        INSERT INTO rides (ride_number, passenger_id, vehicle_type, status, priority, pickup_coordinate_id, destination_coordinate_id, estimated_fare, correlation_id, tariff_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
         RETURNING id
-    `, rideNumber, r.PassengerID, r.RideType, r.Priority, pickupID, destID, res.EstimatedFare).Scan(&rideID)
+    `, rideNumber, r.PassengerID, r.RideType, domain.RideRequested, r.Priority, pickupID, destID, res.EstimatedFare, req.CorrelationID, res.TariffID).Scan(&rideID)
 	if err != nil {
 		return err
 	}
@@ -143,294 +116,228 @@ func (p *RideRepo) CreateRideTx(ctx context.Context, r *domain.RideRequest, res
 	res.RideNumber = rideNumber
 	_, err = tx.Exec(ctx, `
     INSERT INTO ride_events (ride_id, event_type, event_data)
-    VALUES ($1, 'RIDE_REQUESTED', $2::jsonb)
-`, rideID, res)
+    VALUES ($1, $2, $3::jsonb)
+`, rideID, domain.EventRideRequested, res)
 	if err != nil {
 		return err
 	}
-	return tx.Commit(ctx)
-}
 
-func (p *RideRepo) CancelRide(ctx context.Context, rideID string, stu *domain.CancelRideRequest) error {
-	// Начинаем транзакцию
-	tx, err := p.db.Begin(ctx)
+	req.RideID = rideID
+	req.RideNumber = rideNumber
+	msg, err := domain.NewRideRequestMessage(req, uint8(r.Priority))
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback(ctx)
-	var oldStatus string
-	err = tx.QueryRow(ctx, `
-        SELECT status, passenger_id
-        FROM rides
-        WHERE id = $1`, rideID).Scan(&oldStatus)
-
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return domain.ErrNotFound // или своя ошибка
-		}
-		return err
-	}
-	switch oldStatus {
-	case "CANCELLED":
-		return fmt.Errorf("already cancelled")
-	case "COMPLETED":
-		return fmt.Errorf("already completed")
-	}
-
-	_, err = tx.Exec(ctx, `
-        UPDATE rides
-        SET status = 'CANCELLED',
-            cancelled_at = now(),
-            cancellation_reason = $2,
-            updated_at = now()
-        WHERE id = $1`, rideID, stu.Reason)
-	if err != nil {
-		return err
-	}
-	// Формируем event_data
-	eventData := map[string]any{
-		"reason":     stu.Reason,
-		"old_status": oldStatus,
-		"new_status": "CANCELLED",
-	}
-	_, err = tx.Exec(ctx, `
-        INSERT INTO ride_events (ride_id, event_type, event_data)
-        VALUES ($1, 'RIDE_CANCELLED', $2::jsonb)
-    `, rideID, eventData)
+	err = enqueue(ctx, tx, msg)
 	if err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
-func (p *RideRepo) RideMatchedUpdate(ctx context.Context, data *domain.RideResponseMatch) error {
+// CancelRide cancels the ride of the passenger and makes him INACTIVE so he can book again.
+// notify gets the correlation id of the ride. If the ride was already matched, it also gets the driver id
+// and goes to the outbox for the driver service.
+// Returns the driver id if the ride was already matched, otherwise empty string.
+func (p *RideRepo) CancelRide(ctx context.Context, passengerID, rideID string, stu *domain.CancelRideRequest, notify *domain.RideStatusUpdate) (string, error) {
+	// Начинаем транзакцию
 	tx, err := p.db.Begin(ctx)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer tx.Rollback(ctx)
-	var oldStatus string
-	err = tx.QueryRow(ctx, `
-        SELECT status
-        FROM rides
-        WHERE id = $1
-    `, data.RideID).Scan(&oldStatus)
+	oldStatus, ridePassengerID, driverID, err := rideState(ctx, tx, rideID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return domain.ErrNotFound // или своя ошибка
-		}
-		return err
+		return "", err
 	}
-	if oldStatus != "REQUESTED" {
-		return fmt.Errorf("invalid old status: %s", oldStatus)
+	if ridePassengerID != passengerID {
+		return "", fmt.Errorf("%w: ride belongs to another passenger", domain.ErrForbidden)
 	}
-	_, err = tx.Exec(ctx, `
-        UPDATE rides
-        SET
-            status = 'MATCHED',
-            driver_id= $2,
-            matched_at = now(),
-            updated_at = now()
-        WHERE id = $1`, data.RideID, data.DriverID)
+	notify.RideID = rideID
+	err = fillCorrelationID(ctx, tx, notify)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// 2️⃣ Формируем данные события
+	// Формируем event_data
 	eventData := map[string]any{
-		"old_status": oldStatus,
-		"new_status": "MATCHED",
-		"driver_id":  data.DriverID,
-		// "location": map[string]float64{
-		// 	"lat": data.Location.Lat,
-		// 	"lng": data.Location.Lng,
-		// },
-		// "estimated_arrival": data.EstimatedArrival, // time.Time или строка в ISO8601
+		"reason": stu.Reason,
+	}
+	if driverID != "" {
+		eventData["driver_id"] = driverID
+	}
+	err = moveRide(ctx, tx, rideID, oldStatus, domain.RideCancelled, eventData,
+		setColumn{"cancellation_reason", stu.Reason})
+	if err != nil {
+		return "", err
 	}
 
-	// 3️⃣ Вставляем событие в ride_events
 	_, err = tx.Exec(ctx, `
-        INSERT INTO ride_events (ride_id, event_type, event_data)
-        VALUES ($1, 'DRIVER_MATCHED', $2::jsonb)
-    `, data.RideID, eventData)
+	    UPDATE users
+			SET status = 'INACTIVE',
+	    	updated_at = NOW()
+		WHERE id = $1 AND status = 'ACTIVE';
+	`, passengerID)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return tx.Commit(ctx)
+
+	if driverID != "" {
+		notify.DriverID = driverID
+		msg, err := domain.NewDriverStatusMessage(notify)
+		if err != nil {
+			return "", err
+		}
+		err = enqueue(ctx, tx, msg)
+		if err != nil {
+			return "", err
+		}
+	}
+	return driverID, tx.Commit(ctx)
 }
 
-func (p *RideRepo) RideEnRouteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+// RideNoDriverUpdate cancels the ride the driver service found no driver for and makes the passenger
+// INACTIVE so they can book again. Only a REQUESTED ride, anything else was decided by somebody else.
+func (p *RideRepo) RideNoDriverUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
 	tx, err := p.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
-
-	var oldStatus string
-	err = tx.QueryRow(ctx, `
-        SELECT status
-        FROM rides
-        WHERE id = $1
-    `, data.RideID).Scan(&oldStatus)
+	oldStatus, passengerID, _, err := rideState(ctx, tx, data.RideID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return domain.ErrNotFound // или своя ошибка
-		}
 		return err
 	}
-	if oldStatus != "MATCHED" {
-		return fmt.Errorf("invalid old status: %s", oldStatus)
+	if oldStatus != domain.RideRequested {
+		return fmt.Errorf("%w: ride %s is %s, not waiting for a driver", domain.ErrInvalidTransition, data.RideID, oldStatus)
 	}
-
-	var driverID string
-
-	err = tx.QueryRow(ctx, `
-    SELECT driver_id::text
-    FROM rides
-    WHERE id = $1
-`, data.RideID).Scan(&driverID)
+	err = moveRide(ctx, tx, data.RideID, oldStatus, domain.RideCancelled, map[string]any{"reason": data.Reason},
+		setColumn{"cancellation_reason", data.Reason})
 	if err != nil {
 		return err
 	}
-	if driverID != data.DriverID {
-		return fmt.Errorf("invalid driver id: %s != %s", data.DriverID, driverID)
-	}
-
 	_, err = tx.Exec(ctx, `
-        UPDATE rides
-        SET
-            status = 'EN_ROUTE',
-            updated_at = now()
-        WHERE id = $1`, data.RideID)
+		UPDATE users
+		SET status = 'INACTIVE', updated_at = now()
+		WHERE id = $1 AND status = 'ACTIVE'`, passengerID)
 	if err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
-func (p *RideRepo) RideArrivedUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+func (p *RideRepo) RideMatchedUpdate(ctx context.Context, data *domain.RideResponseMatch) error {
 	tx, err := p.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
-	var oldStatus string
-	err = tx.QueryRow(ctx, `
-        SELECT status
-        FROM rides
-        WHERE id = $1`, data.RideID).Scan(&oldStatus)
-
+	oldStatus, _, driverID, err := rideState(ctx, tx, data.RideID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return domain.ErrNotFound // или своя ошибка
-		}
 		return err
 	}
-
-	if oldStatus != "EN_ROUTE" {
-		return fmt.Errorf("invalid old status: %s", oldStatus)
+	if oldStatus == domain.RideMatched && driverID == data.DriverID {
+		// a re-delivered match, it is applied already
+		return nil
 	}
-
-	// 	var driverID string
-
-	// 	err = tx.QueryRow(ctx, `
-	//     SELECT driver_id::text
-	//     FROM rides
-	//     WHERE id = $1
-	// `, data.RideID).Scan(&driverID)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	if driverID != data.DriverID {
-	// 		return fmt.Errorf("invalid driver id: %s != %s", data.DriverID, driverID)
-	// 	}
-	_, err = tx.Exec(ctx, `
-        UPDATE rides
-        SET
-            status = 'ARRIVED',
-            updated_at = now(),
-            arrived_at = now()
-        WHERE id = $1`, data.RideID)
-	if err != nil {
-		return err
+	if oldStatus != domain.RideRequested {
+		// the driver holds on to the ride until told otherwise, the release commits with the refusal
+		err = enqueueMatchLost(ctx, tx, data)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: ride %s is %s", domain.ErrMatchLost, data.RideID, oldStatus)
 	}
 
+	// Формируем данные события
 	eventData := map[string]any{
-		"old_status": oldStatus,
-		"new_status": "DRIVER_ARRIVED",
+		"driver_id": data.DriverID,
+		"location": map[string]float64{
+			"lat": data.DriverLocation.Lat,
+			"lng": data.DriverLocation.Lng,
+		},
+		"estimated_arrival": data.EstimatedArrival,
 	}
-
-	_, err = tx.Exec(ctx, `
-        INSERT INTO ride_events (ride_id, event_type, event_data)
-        VALUES ($1, 'DRIVER_ARRIVED', $2::jsonb)
-    `, data.RideID, eventData)
+	err = moveRide(ctx, tx, data.RideID, oldStatus, domain.RideMatched, eventData,
+		setColumn{"driver_id", data.DriverID})
 	if err != nil {
 		return err
 	}
 	return tx.Commit(ctx)
 }
 
-func (p *RideRepo) RideInProgressUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
-	tx, err := p.db.Begin(ctx)
+// enqueueMatchLost tells the driver whose accept lost to drop the ride
+func enqueueMatchLost(ctx context.Context, tx pgx.Tx, data *domain.RideResponseMatch) error {
+	msg, err := domain.NewDriverStatusMessage(matchLost(data))
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback(ctx)
-	var oldStatus string
-	err = tx.QueryRow(ctx, `
-        SELECT status
-        FROM rides
-        WHERE id = $1`, data.RideID).Scan(&oldStatus)
+	return enqueue(ctx, tx, msg)
+}
 
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return domain.ErrNotFound // или своя ошибка
-		}
-		return err
+// matchLost is the cancellation the driver of a lost accept gets
+func matchLost(data *domain.RideResponseMatch) *domain.RideStatusUpdate {
+	return &domain.RideStatusUpdate{
+		RideID:        data.RideID,
+		Status:        domain.RideCancelled,
+		Timestamp:     time.Now(),
+		DriverID:      data.DriverID,
+		CorrelationID: data.CorrelationID,
+		Reason:        domain.CancelReasonMatchLost,
 	}
+}
 
-	if oldStatus != "ARRIVED" {
-		return fmt.Errorf("invalid old status: %s", oldStatus)
-	}
+func (p *RideRepo) RideEnRouteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	return p.driverRideUpdate(ctx, data, domain.RideEnRoute)
+}
 
-	var driverID string
-	err = tx.QueryRow(ctx, `
-    SELECT driver_id::text
-    FROM rides
-    WHERE id = $1
-`, data.RideID).Scan(&driverID)
+func (p *RideRepo) RideArrivedUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	return p.driverRideUpdate(ctx, data, domain.RideArrived)
+}
+
+func (p *RideRepo) RideInProgressUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
+	return p.driverRideUpdate(ctx, data, domain.RideInProgress)
+}
+
+// driverRideUpdate moves the ride on behalf of its driver
+func (p *RideRepo) driverRideUpdate(ctx context.Context, data *domain.RideStatusUpdate, to string) error {
+	tx, err := p.db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	if driverID != data.DriverID {
-		return fmt.Errorf("invalid driver id: %s != %s", data.DriverID, driverID)
-	}
+	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(ctx, `
-        UPDATE rides
-        SET
-            status = 'IN_PROGRESS',
-            updated_at = now(),
-            started_at = now()
-        WHERE id = $1`, data.RideID)
+	oldStatus, passengerID, driverID, err := rideState(ctx, tx, data.RideID)
 	if err != nil {
 		return err
 	}
-	eventData := map[string]any{
-		"old_status": oldStatus,
-		"new_status": "RIDE_STARTED",
-		"driver_id":  data.DriverID,
+	if driverID != data.DriverID {
+		return fmt.Errorf("%w: invalid driver id: %s != %s", domain.Errconflict, data.DriverID, driverID)
+	}
+	if oldStatus == to {
+		// a re-delivered status, it is applied already
+		return nil
 	}
 
-	_, err = tx.Exec(ctx, `
-        INSERT INTO ride_events (ride_id, event_type, event_data)
-        VALUES ($1, 'RIDE_STARTED', $2::jsonb)
-    `, data.RideID, eventData)
+	err = moveRide(ctx, tx, data.RideID, oldStatus, to, map[string]any{"driver_id": data.DriverID})
 	if err != nil {
 		return err
 	}
+	if to == domain.RideInProgress {
+		// the meter counts minutes from its last update, the time at pickup is the waiting charge
+		_, err = tx.Exec(ctx, `
+			UPDATE coordinates
+			SET updated_at = now()
+			WHERE entity_id = $1 AND is_current = true`, passengerID)
+		if err != nil {
+			return err
+		}
+	}
 	return tx.Commit(ctx)
-
 }
 
 func (p *RideRepo) RideCompleteUpdate(ctx context.Context, data *domain.RideStatusUpdate) error {
@@ -439,75 +346,39 @@ func (p *RideRepo) RideCompleteUpdate(ctx context.Context, data *domain.RideStat
 		return err
 	}
 	defer tx.Rollback(ctx)
-	var oldStatus, passengerID string
-	err = tx.QueryRow(ctx, `
-        SELECT status, passenger_id
-        FROM rides
-        WHERE id = $1`, data.RideID).Scan(&oldStatus, &passengerID)
-
+	oldStatus, passengerID, driverID, err := rideState(ctx, tx, data.RideID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return domain.ErrNotFound // или своя ошибка
-		}
 		return err
 	}
-
-	if oldStatus != "IN_PROGRESS" {
-		return fmt.Errorf("invalid old status: %s", oldStatus)
-	}
-	// 	var driverID string
-	// 	err = tx.QueryRow(ctx, `
-	//     SELECT driver_id::text
-	//     FROM rides
-	//     WHERE id = $1
-	// `, data.RideID).Scan(&driverID)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	if driverID != data.DriverID {
-	// 		return fmt.Errorf("invalid driver id: %s != %s", data.DriverID, driverID)
-	// 	}
-
-	var fare float64
-
-	err = tx.QueryRow(ctx, `
-    SELECT fare_amount
-    FROM coordinates
-    WHERE entity_id = $1 AND is_current = TRUE`, passengerID).Scan(&fare)
-	if err != nil {
-		return err
+	if driverID != data.DriverID {
+		return fmt.Errorf("%w: invalid driver id: %s != %s", domain.Errconflict, data.DriverID, driverID)
 	}
-	_, err = tx.Exec(ctx, `
-	    UPDATE users
-			SET status = 'INACTIVE',
-	    	updated_at = NOW()
-		WHERE id = $1;
-	`, passengerID)
-	if err != nil {
-		return err
+	if oldStatus == domain.RideCompleted {
+		// a re-delivered status, it is applied already
+		return nil
 	}
 
-	_, err = tx.Exec(ctx, `
-        UPDATE rides
-        SET
-            status = 'COMPLETED',
-            updated_at = now(),
-            completed_at = now(),
-			final_fare = $2,
-        WHERE id = $1`, data.RideID, fare)
+	fare, err := finalFare(ctx, tx, data.RideID)
 	if err != nil {
 		return err
 	}
+
 	eventData := map[string]any{
-		"old_status": oldStatus,
-		"new_status": "COMPLETED",
 		"driver_id":  data.DriverID,
+		"final_fare": fare,
+	}
+	err = moveRide(ctx, tx, data.RideID, oldStatus, domain.RideCompleted, eventData,
+		setColumn{"final_fare", fare})
+	if err != nil {
+		return err
 	}
 
 	_, err = tx.Exec(ctx, `
-        INSERT INTO ride_events (ride_id, event_type, event_data)
-        VALUES ($1, 'RIDE_STARTED', $2::jsonb)
-    `, data.RideID, eventData)
+	    UPDATE users
+			SET status = 'INACTIVE',
+	    	updated_at = NOW()
+		WHERE id = $1 AND status = 'ACTIVE';
+	`, passengerID)
 	if err != nil {
 		return err
 	}
@@ -533,12 +404,12 @@ func (p *RideRepo) RideLocationUpdate(ctx context.Context, data *domain.Location
 		}
 		return err
 	}
-	if statusRide != "IN_PROGRESS" /*&& oldStatus != "EN_ROUTE"*/ {
-		return fmt.Errorf("invalid status : %s", statusRide)
+	if statusRide != domain.RideInProgress {
+		return fmt.Errorf("%w: invalid status: %s", domain.Errconflict, statusRide)
 	}
 
 	if drID != data.DriverID {
-		return fmt.Errorf("invalid driver id: %s != %s", drID, data.DriverID)
+		return fmt.Errorf("%w: invalid driver id: %s != %s", domain.Errconflict, drID, data.DriverID)
 	}
 
 	_, err = tx.Exec(ctx, `
@@ -564,7 +435,7 @@ func (p *RideRepo) RideLocationUpdate(ctx context.Context, data *domain.Location
         duration_minutes)
         VALUES ($1, 'passenger', $2, $3, $4, $5, $6, $7)
     `, passengerID,
-		data.Location,
+		"",
 		data.Location.Lat,
 		data.Location.Lng,
 		data.FareAmount,
@@ -663,6 +534,18 @@ func (p *RideRepo) GetRideNumberByRideID(ctx context.Context, id string) (string
 	return rideNumber, nil
 }
 
+func (p *RideRepo) GetRideStatus(ctx context.Context, rideID string) (string, error) {
+	var status string
+	err := p.db.QueryRow(ctx, `SELECT status FROM rides WHERE id = $1`, rideID).Scan(&status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", domain.ErrNotFound
+		}
+		return "", err
+	}
+	return status, nil
+}
+
 func (p *RideRepo) GetRideVehicleType(ctx context.Context, rideID string) (string, error) {
 	var vehicleType string
 	const query = `SELECT vehicle_type FROM rides WHERE id = $1`
@@ -673,6 +556,27 @@ func (p *RideRepo) GetRideVehicleType(ctx context.Context, rideID string) (strin
 	return vehicleType, nil
 }
 
+// ActiveTariffs returns the tariff in effect at the time for every vehicle type
+func (p *RideRepo) ActiveTariffs(ctx context.Context, at time.Time) (map[string]*domain.Tariff, error) {
+	return activeTariffs(ctx, p.db, at)
+}
+
+func (p *RideRepo) GetTariff(ctx context.Context, id string) (*domain.Tariff, error) {
+	return scanTariff(p.db.QueryRow(ctx, `
+		SELECT `+tariffColumns+`
+		FROM tariffs t
+		WHERE t.id = $1`, id))
+}
+
+// GetRideTariff returns the tariff version which priced the ride
+func (p *RideRepo) GetRideTariff(ctx context.Context, rideID string) (*domain.Tariff, error) {
+	return scanTariff(p.db.QueryRow(ctx, `
+		SELECT `+tariffColumns+`
+		FROM rides r
+		JOIN tariffs t ON t.id = r.tariff_id
+		WHERE r.id = $1`, rideID))
+}
+
 func (p *RideRepo) GetCurrentCoordinate(ctx context.Context, passengerID string) (*domain.CoordinateUpdate, error) {
 	coord := new(domain.CoordinateUpdate)
 	const query = `
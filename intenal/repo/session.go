@@ -0,0 +1,185 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"taxi-hailing/intenal/domain"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// channelSessionRevoked is notified by the trigger on auth_sessions.revoked_at
+const channelSessionRevoked = "auth_session_revoked"
+
+type SessionRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewSessionRepo(pool *pgxpool.Pool) *SessionRepo {
+	return &SessionRepo{
+		db: pool,
+	}
+}
+
+func (r *SessionRepo) CreateSession(ctx context.Context, s *domain.Session) error {
+	return r.db.QueryRow(ctx, `
+		INSERT INTO auth_sessions (user_id, refresh_hash, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id`,
+		s.UserID, s.RefreshHash, s.ExpiresAt).Scan(&s.ID)
+}
+
+// RotateSession swaps the refresh hash of the session and returns its user.
+// Any refresh token the session already rotated away from means it was copied, the whole session is revoked then.
+func (r *SessionRepo) RotateSession(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*domain.SessionUser, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	user := new(domain.SessionUser)
+	var current, active bool
+	err = tx.QueryRow(ctx, `
+		SELECT s.id, s.user_id, s.refresh_hash = $1, s.revoked_at IS NULL AND s.expires_at > now(),
+			u.name, u.email, u.role, u.status
+		FROM auth_sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.refresh_hash = $1
+			OR s.id = (SELECT session_id FROM auth_session_used_hashes WHERE refresh_hash = $1)
+		FOR UPDATE OF s`, oldHash).Scan(
+		&user.SessionID, &user.UserID, &current, &active,
+		&user.Name, &user.Email, &user.Role, &user.Status,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: unknown refresh token", domain.ErrUnauthorized)
+		}
+		return nil, err
+	}
+	if !active {
+		return nil, fmt.Errorf("%w: session is revoked or expired", domain.ErrUnauthorized)
+	}
+	if !current || user.Status == "BANNED" {
+		reason := domain.RevokeReused
+		if current {
+			reason = domain.RevokeBanned
+		}
+		_, err = revokeSessions(ctx, tx, "id = $1", user.SessionID, reason)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: session revoked, %s", domain.ErrUnauthorized, reason)
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO auth_session_used_hashes (refresh_hash, session_id)
+		VALUES ($1, $2)`, oldHash, user.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE auth_sessions
+		SET refresh_hash = $2, expires_at = $3, last_used_at = now()
+		WHERE id = $1`, user.SessionID, newHash, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return user, tx.Commit(ctx)
+}
+
+// RevokeSession ends one session of the user, revoking an already revoked one is fine
+func (r *SessionRepo) RevokeSession(ctx context.Context, userID, sessionID, reason string) error {
+	var exists bool
+	err := r.db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM auth_sessions WHERE id = $1 AND user_id = $2)`,
+		sessionID, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return domain.ErrNotFound
+	}
+	_, err = revokeSessions(ctx, r.db, "id = $1", sessionID, reason)
+	return err
+}
+
+// RevokeUserSessions ends every session of the user and returns how many were active
+func (r *SessionRepo) RevokeUserSessions(ctx context.Context, userID, reason string) (int64, error) {
+	return revokeSessions(ctx, r.db, "user_id = $1", userID, reason)
+}
+
+func revokeSessions(ctx context.Context, db execer, where string, arg any, reason string) (int64, error) {
+	tag, err := db.Exec(ctx, `
+		UPDATE auth_sessions
+		SET revoked_at = now(), revoked_reason = $2
+		WHERE revoked_at IS NULL AND `+where, arg, reason)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// CheckSession is the revocation list lookup behind every authenticated request
+func (r *SessionRepo) CheckSession(ctx context.Context, sessionID string) error {
+	var revoked, expired bool
+	var status string
+	err := r.db.QueryRow(ctx, `
+		SELECT s.revoked_at IS NOT NULL, s.expires_at <= now(), u.status
+		FROM auth_sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1`, sessionID).Scan(&revoked, &expired, &status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: unknown session", domain.ErrUnauthorized)
+		}
+		return err
+	}
+	switch {
+	case revoked:
+		return fmt.Errorf("%w: session is revoked", domain.ErrUnauthorized)
+	case expired:
+		return fmt.Errorf("%w: session is expired", domain.ErrUnauthorized)
+	case status == "BANNED":
+		return fmt.Errorf("%w: user is banned", domain.ErrUnauthorized)
+	}
+	return nil
+}
+
+// WatchRevocations listens for revoked sessions on a dedicated connection and calls fn for each one.
+// It returns when ctx is done or the connection fails, the caller decides whether to listen again.
+func (r *SessionRepo) WatchRevocations(ctx context.Context, fn func(userID, sessionID string)) error {
+	conn, err := r.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, "LISTEN "+channelSessionRevoked)
+	if err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			// the connection may still be listening, do not give it back to the pool
+			conn.Hijack().Close(context.Background())
+			return err
+		}
+		var payload struct {
+			UserID    string `json:"user_id"`
+			SessionID string `json:"session_id"`
+		}
+		if json.Unmarshal([]byte(n.Payload), &payload) != nil {
+			continue
+		}
+		fn(payload.UserID, payload.SessionID)
+	}
+}
@@ -0,0 +1,158 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"taxi-hailing/intenal/domain"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type setColumn struct {
+	name  string
+	value any
+}
+
+// rideState reads what every ride transition needs to check and locks the ride row
+// until the end of tx, so concurrent transitions of the same ride are serialized.
+func rideState(ctx context.Context, tx pgx.Tx, rideID string) (status, passengerID, driverID string, err error) {
+	err = tx.QueryRow(ctx, `
+        SELECT status, passenger_id, COALESCE(driver_id::text, '')
+        FROM rides
+        WHERE id = $1
+        FOR UPDATE`, rideID).Scan(&status, &passengerID, &driverID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", "", domain.ErrNotFound
+		}
+		return "", "", "", err
+	}
+	return status, passengerID, driverID, nil
+}
+
+// moveRide applies the domain transition from -> to: sets the status, its timestamp column,
+// the extra columns and writes the ride_events row. Must be called inside the caller's tx.
+// The UPDATE is conditional on the status still being from, otherwise domain.Errconflict.
+func moveRide(ctx context.Context, tx pgx.Tx, rideID, from, to string, eventData map[string]any, extra ...setColumn) error {
+	t, err := domain.NextRideStatus(from, to)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE rides SET status = $2, updated_at = now()`
+	args := []any{rideID, to, from}
+	if t.TimestampColumn != "" {
+		query += fmt.Sprintf(", %s = now()", t.TimestampColumn)
+	}
+	for _, c := range extra {
+		args = append(args, c.value)
+		query += fmt.Sprintf(", %s = $%d", c.name, len(args))
+	}
+	query += ` WHERE id = $1 AND status = $3`
+	tag, err := tx.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: ride %s is no longer %s", domain.Errconflict, rideID, from)
+	}
+
+	if eventData == nil {
+		eventData = make(map[string]any)
+	}
+	eventData["old_status"] = from
+	eventData["new_status"] = to
+	_, err = tx.Exec(ctx, `
+        INSERT INTO ride_events (ride_id, event_type, event_data)
+        VALUES ($1, $2, $3::jsonb)
+    `, rideID, t.EventType, eventData)
+	return err
+}
+
+// moveDriver applies the domain transition from -> to on drivers.status and clears the arrival,
+// domain.Errconflict if somebody changed the status in between
+func moveDriver(ctx context.Context, tx pgx.Tx, driverID uuid.UUID, from, to string) error {
+	err := domain.CheckDriverTransition(from, to)
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE drivers
+		SET status = $2, arrived_ride_id = NULL, updated_at = now()
+		WHERE id = $1 AND status = $3
+	`, driverID, to, from)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: driver %s is no longer %s", domain.Errconflict, driverID, from)
+	}
+	return nil
+}
+
+// driverState reads the driver status and locks the row until the end of tx
+func driverState(ctx context.Context, tx pgx.Tx, driverID uuid.UUID) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, `SELECT status FROM drivers WHERE id = $1 FOR UPDATE`, driverID).Scan(&status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", domain.ErrNotFound
+		}
+		return "", err
+	}
+	return status, nil
+}
+
+// driverRideStatuses are the ride statuses a driver action moving the ride to the key accepts.
+// The ride service applies the driver's statuses from the outbox, so the ride may still be a step or two behind.
+// The driver's own state says how far the driver got: IN_PROGRESS also needs checkArrived, COMPLETED a BUSY driver.
+var driverRideStatuses = map[string][]string{
+	domain.RideEnRoute:    {domain.RideMatched},
+	domain.RideArrived:    {domain.RideMatched, domain.RideEnRoute},
+	domain.RideInProgress: {domain.RideMatched, domain.RideEnRoute, domain.RideArrived},
+	domain.RideCompleted:  {domain.RideMatched, domain.RideEnRoute, domain.RideArrived, domain.RideInProgress},
+}
+
+// checkDriverRide checks that the ride may go on to the status: it is assigned to the driver and was not
+// cancelled or moved past it. Errors other than domain.ErrNotFound wrap domain.Errconflict.
+func checkDriverRide(rideID, rideStatus, rideDriverID string, driverID uuid.UUID, to string) error {
+	if rideDriverID != driverID.String() {
+		return fmt.Errorf("%w: driver is not assigned to ride %s", domain.Errconflict, rideID)
+	}
+	if !slices.Contains(driverRideStatuses[to], rideStatus) {
+		return fmt.Errorf("%w: ride %s is %s, cannot go %s", domain.Errconflict, rideID, rideStatus, to)
+	}
+	return nil
+}
+
+// driverRide locks the ride row until the end of tx and checks it with checkDriverRide,
+// so a cancel cannot slip in between the check and the driver's transition
+func driverRide(ctx context.Context, tx pgx.Tx, rideID string, driverID uuid.UUID, to string) error {
+	status, _, rideDriverID, err := rideState(ctx, tx, rideID)
+	if err != nil {
+		return err
+	}
+	return checkDriverRide(rideID, status, rideDriverID, driverID, to)
+}
+
+// checkArrived checks the driver reported arriving at the pickup of the ride, so Start cannot skip Arrived
+func checkArrived(rideID, arrivedRideID string) error {
+	if arrivedRideID != rideID {
+		return fmt.Errorf("%w: driver has not arrived at the pickup of ride %s", domain.ErrInvalidTransition, rideID)
+	}
+	return nil
+}
+
+// driverArrived reads the ride the driver arrived at, the row is locked by driverState already
+func driverArrived(ctx context.Context, tx pgx.Tx, driverID uuid.UUID, rideID string) error {
+	var arrivedRideID string
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(arrived_ride_id::text, '') FROM drivers WHERE id = $1`, driverID).Scan(&arrivedRideID)
+	if err != nil {
+		return err
+	}
+	return checkArrived(rideID, arrivedRideID)
+}
@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"taxi-hailing/intenal/domain"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// querier is a pool or a tx
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+const tariffColumns = `
+	t.id, t.vehicle_type, t.version, t.effective_from, t.currency,
+	t.base_fare::float8, t.rate_per_km::float8, t.rate_per_min::float8, t.min_fare::float8,
+	t.booking_fee::float8, t.waiting_free_minutes, t.waiting_rate_per_min::float8,
+	t.priority, t.created_at`
+
+func scanTariff(row pgx.Row, extra ...any) (*domain.Tariff, error) {
+	t := new(domain.Tariff)
+	err := row.Scan(append([]any{
+		&t.ID, &t.VehicleType, &t.Version, &t.EffectiveFrom, &t.Currency,
+		&t.BaseFare, &t.RatePerKM, &t.RatePerMin, &t.MinFare,
+		&t.BookingFee, &t.WaitingFreeMinutes, &t.WaitingRatePerMin,
+		&t.Priority, &t.CreatedAt,
+	}, extra...)...)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+// activeTariffs returns the version in effect at the time for every vehicle type
+func activeTariffs(ctx context.Context, db querier, at time.Time) (map[string]*domain.Tariff, error) {
+	rows, err := db.Query(ctx, `
+		SELECT DISTINCT ON (t.vehicle_type) `+tariffColumns+`
+		FROM tariffs t
+		WHERE t.effective_from <= $1
+		ORDER BY t.vehicle_type, t.effective_from DESC, t.version DESC`, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tariffs := make(map[string]*domain.Tariff)
+	for rows.Next() {
+		t, err := scanTariff(rows)
+		if err != nil {
+			return nil, err
+		}
+		t.Active = true
+		tariffs[t.VehicleType] = t
+	}
+	return tariffs, rows.Err()
+}
+
+// finalFare is the passenger's meter plus the waiting charge of the ride's tariff, at least its
+// minimum fare. The ride and the driver side both charge it, so they always agree.
+func finalFare(ctx context.Context, db querier, rideID string) (float64, error) {
+	var meter float64
+	var arrivedAt, startedAt *time.Time
+	t, err := scanTariff(db.QueryRow(ctx, `
+		SELECT `+tariffColumns+`, c.fare_amount::float8, r.arrived_at, r.started_at
+		FROM rides r
+		JOIN tariffs t ON t.id = r.tariff_id
+		JOIN coordinates c ON c.entity_id = r.passenger_id AND c.is_current = TRUE
+		WHERE r.id = $1`, rideID), &meter, &arrivedAt, &startedAt)
+	if err != nil {
+		return 0, err
+	}
+	var waiting time.Duration
+	if arrivedAt != nil && startedAt != nil {
+		waiting = startedAt.Sub(*arrivedAt)
+	}
+	return t.Final(meter, waiting), nil
+}
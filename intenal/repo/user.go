@@ -0,0 +1,105 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"taxi-hailing/intenal/domain"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UserRepo owns the users table for the auth service: passengers, drivers and admins
+type UserRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewUserRepo(pool *pgxpool.Pool) *UserRepo {
+	return &UserRepo{
+		db: pool,
+	}
+}
+
+func (r *UserRepo) RegisterPassenger(ctx context.Context, user *domain.User) (string, error) {
+	var id string
+	err := r.db.QueryRow(ctx, `
+			INSERT INTO users (name, email, role, password_hash)
+			VALUES ($1, $2, 'PASSENGER', $3)
+			RETURNING id`,
+		user.Name, user.Email, user.PasswordHash).Scan(&id)
+	if err != nil {
+		return "", uniqueViolation(err, "email already registered")
+	}
+	return id, nil
+}
+
+// CreateDriver saves the users and drivers rows in one tx, driver gets the new id
+func (r *UserRepo) CreateDriver(ctx context.Context, driver *domain.Driver) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO users (name, email, password_hash, role, status)
+		VALUES ($1, $2, $3, 'DRIVER','ACTIVE')
+		RETURNING id
+	`, driver.Name, driver.Email, driver.PasswordHash).Scan(&driver.ID)
+	if err != nil {
+		return uniqueViolation(err, "email already registered")
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO drivers (
+			id, license_number, vehicle_type, vehicle_attrs, is_verified
+		) VALUES (
+			$1, $2, $3, $4, $5
+		)
+	`, driver.ID, driver.LicenseNumber, driver.VehicleType, driver.VehicleAttrs, driver.IsVerified)
+	if err != nil {
+		return uniqueViolation(err, "license number already registered")
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *UserRepo) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
+	return r.getUser(ctx, "email = $1", email)
+}
+
+func (r *UserRepo) GetUserByID(ctx context.Context, id string) (*domain.User, error) {
+	return r.getUser(ctx, "id = $1", id)
+}
+
+func (r *UserRepo) getUser(ctx context.Context, where string, arg any) (*domain.User, error) {
+	user := new(domain.User)
+	err := r.db.QueryRow(ctx, `
+		SELECT id, name, email, password_hash, role, status, created_at, updated_at
+		FROM users
+		WHERE `+where, arg).Scan(
+		&user.ID, &user.Name, &user.Email, &user.PasswordHash,
+		&user.Role, &user.Status, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, domain.ErrNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// UpdatePasswordHash replaces the hash of a passenger, driver or admin
+func (r *UserRepo) UpdatePasswordHash(ctx context.Context, userID, hash string) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE users
+		SET password_hash = $2, updated_at = now()
+		WHERE id = $1`, userID, hash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return domain.ErrNotFound
+	}
+	return nil
+}
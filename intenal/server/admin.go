@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
+	"taxi-hailing/intenal/service"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	dateLayout      = "2006-01-02"
+)
+
+type adminServer struct {
+	srv http.Server
+}
+
+func NewAdminServer(port uint16, auth *service.AuthService, use *service.AdminService, checks ...HealthCheck) *adminServer {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	healthRoutes(mux, checks)
+	hand := &adminHandler{use}
+	adminOnly := authz.Allow(authz.RoleAdmin)
+	mux.Handle("GET /admin/overview", protect(auth, adminOnly, hand.overview))
+	mux.Handle("GET /admin/rides/active", protect(auth, adminOnly, hand.activeRides))
+	mux.Handle("GET /admin/rides/{ride_id}/events", protect(auth, adminOnly, hand.rideEvents))
+	mux.Handle("GET /admin/drivers/online", protect(auth, adminOnly, hand.onlineDrivers))
+	mux.Handle("GET /admin/revenue", protect(auth, adminOnly, hand.revenue))
+	mux.Handle("GET /admin/dead-letters/{queue}", protect(auth, adminOnly, hand.deadLetters))
+	mux.Handle("POST /admin/dead-letters/{queue}/redrive", protect(auth, adminOnly, hand.redrive))
+	mux.Handle("GET /admin/tariffs", protect(auth, adminOnly, hand.tariffs))
+	mux.Handle("POST /admin/tariffs", protect(auth, adminOnly, hand.createTariff))
+	mux.Handle("DELETE /admin/tariffs/{tariff_id}", protect(auth, adminOnly, hand.deleteTariff))
+	return &adminServer{
+		srv: http.Server{
+			Addr:    fmt.Sprintf(":%d", port),
+			Handler: traceMiddleware(metricsMiddleware(mux)),
+		},
+	}
+}
+
+func (s *adminServer) StartServer() error {
+	return s.srv.ListenAndServe()
+}
+
+func (s *adminServer) ShutDownServer(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+type adminHandler struct {
+	use *service.AdminService
+}
+
+func (h *adminHandler) overview(w http.ResponseWriter, r *http.Request) {
+	res, err := h.use.Overview(r.Context())
+	if err != nil {
+		errorWrite(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminHandler) activeRides(w http.ResponseWriter, r *http.Request) {
+	page, err := queryInt(r, "page", 1)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	pageSize, err := queryInt(r, "page_size", defaultPageSize)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	if page < 1 {
+		errorWrite(w, http.StatusBadRequest, fmt.Errorf("page must be positive"))
+		return
+	}
+	if pageSize < 1 || pageSize > maxPageSize {
+		errorWrite(w, http.StatusBadRequest, fmt.Errorf("page_size must be between 1 and %d", maxPageSize))
+		return
+	}
+
+	res, err := h.use.ActiveRides(r.Context(), page, pageSize)
+	if err != nil {
+		errorWrite(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminHandler) onlineDrivers(w http.ResponseWriter, r *http.Request) {
+	res, err := h.use.OnlineDrivers(r.Context())
+	if err != nil {
+		errorWrite(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// revenue accepts from/to as YYYY-MM-DD, to is inclusive. Defaults to today.
+func (h *adminHandler) revenue(w http.ResponseWriter, r *http.Request) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, err := queryDate(r, "from", today)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := queryDate(r, "to", from)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	if to.Before(from) {
+		errorWrite(w, http.StatusBadRequest, fmt.Errorf("to must not be before from"))
+		return
+	}
+
+	res, err := h.use.Revenue(r.Context(), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		errorWrite(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminHandler) rideEvents(w http.ResponseWriter, r *http.Request) {
+	rideID := r.PathValue("ride_id")
+	if _, err := uuid.Parse(rideID); err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.use.RideEvents(r.Context(), rideID)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminHandler) deadLetters(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryLimit(r)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.use.DeadLetters(r.PathValue("queue"), limit)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// redrive puts dead letters back to their queue, up to limit per call
+func (h *adminHandler) redrive(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryLimit(r)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.use.Redrive(r.Context(), r.PathValue("queue"), limit)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminHandler) tariffs(w http.ResponseWriter, r *http.Request) {
+	res, err := h.use.Tariffs(r.Context(), r.URL.Query().Get("vehicle_type"))
+	if err != nil {
+		errorWrite(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// createTariff adds the next version, effective now unless effective_from is given
+func (h *adminHandler) createTariff(w http.ResponseWriter, r *http.Request) {
+	t := new(domain.Tariff)
+	err := json.NewDecoder(r.Body).Decode(t)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	err = validatorTariff(t, time.Now())
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.use.CreateTariff(r.Context(), t)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// deleteTariff only removes versions which are not in effect yet
+func (h *adminHandler) deleteTariff(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("tariff_id")
+	if _, err := uuid.Parse(id); err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	err := h.use.DeleteTariff(r.Context(), id)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validatorTariff also fills the defaults. History cannot be rewritten,
+// so effective_from may not be in the past.
+func validatorTariff(t *domain.Tariff, now time.Time) error {
+	if t.VehicleType == "" {
+		return fmt.Errorf("vehicle_type is required")
+	}
+	if t.EffectiveFrom.IsZero() {
+		t.EffectiveFrom = now
+	}
+	if t.EffectiveFrom.Before(now.Add(-time.Minute)) {
+		return fmt.Errorf("effective_from must not be in the past")
+	}
+	if t.Currency == "" {
+		t.Currency = "KZT"
+	}
+	if len(t.Currency) != 3 || strings.ToUpper(t.Currency) != t.Currency {
+		return fmt.Errorf("currency must be a 3 letter ISO 4217 code")
+	}
+	if t.Priority == 0 {
+		t.Priority = 1
+	}
+	if t.Priority < 1 || t.Priority > 10 {
+		return fmt.Errorf("priority must be between 1 and 10")
+	}
+	for name, v := range map[string]float64{
+		"base_fare":            t.BaseFare,
+		"rate_per_km":          t.RatePerKM,
+		"rate_per_min":         t.RatePerMin,
+		"min_fare":             t.MinFare,
+		"booking_fee":          t.BookingFee,
+		"waiting_rate_per_min": t.WaitingRatePerMin,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if t.WaitingFreeMinutes < 0 {
+		return fmt.Errorf("waiting_free_minutes must not be negative")
+	}
+	return nil
+}
+
+func queryLimit(r *http.Request) (int, error) {
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	return limit, nil
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	str := r.URL.Query().Get(key)
+	if str == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, str)
+	}
+	return n, nil
+}
+
+func queryDate(r *http.Request, key string, def time.Time) (time.Time, error) {
+	str := r.URL.Query().Get(key)
+	if str == "" {
+		return def, nil
+	}
+	t, err := time.Parse(dateLayout, str)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s, expected YYYY-MM-DD: %s", key, str)
+	}
+	return t, nil
+}
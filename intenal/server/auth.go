@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/metrics"
+	"taxi-hailing/intenal/service"
+	"taxi-hailing/pkg"
+)
+
+type authServer struct {
+	srv http.Server
+}
+
+// NewAuthServer is the identity service. Users of every role register and log in here,
+// the other services only verify the tokens it issues with the keys from /.well-known/jwks.json.
+func NewAuthServer(port uint16, auth *service.AuthService, use *service.UserService, keys *jwks.KeyRing, checks ...HealthCheck) *authServer {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	healthRoutes(mux, checks)
+	hand := &authHandler{auth, use, keys}
+	mux.HandleFunc("GET /.well-known/jwks.json", hand.jwks)
+	anyUser := authz.Allow()
+	mux.HandleFunc("POST /auth/register", hand.register)
+	mux.HandleFunc("POST /auth/login", hand.login)
+	mux.HandleFunc("POST /auth/refresh", hand.refresh)
+	mux.Handle("POST /auth/logout", protect(auth, anyUser, hand.logout))
+	mux.Handle("POST /auth/logout/all", protect(auth, anyUser, hand.logoutAll))
+	mux.Handle("POST /auth/password", protect(auth, anyUser, hand.changePassword))
+	mux.Handle("GET /auth/me", protect(auth, anyUser, hand.me))
+	return &authServer{
+		srv: http.Server{
+			Addr:    fmt.Sprintf(":%d", port),
+			Handler: traceMiddleware(metricsMiddleware(mux)),
+		},
+	}
+}
+
+func (s *authServer) StartServer() error {
+	return s.srv.ListenAndServe()
+}
+
+func (s *authServer) ShutDownServer(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+type authHandler struct {
+	auth *service.AuthService
+	use  *service.UserService
+	keys *jwks.KeyRing
+}
+
+func (h *authHandler) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// verifiers refetch on an unknown kid anyway, the cache only spares requests
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.keys.Set())
+}
+
+func (h *authHandler) register(w http.ResponseWriter, r *http.Request) {
+	req := new(domain.RegisterRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Role == "DRIVER" {
+		err = validateDriverInput(&req.DriverRegisterRequest)
+	} else {
+		err = validateUserInput(&domain.User{
+			Name:         req.Name,
+			Email:        req.Email,
+			PasswordHash: req.Password,
+			Role:         req.Role,
+		}, true)
+	}
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.use.Register(r.Context(), req)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *authHandler) login(w http.ResponseWriter, r *http.Request) {
+	req := new(domain.LoginRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	err = validateUserInput(&domain.User{Email: req.Email, PasswordHash: req.Password}, false)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.use.Login(r.Context(), req)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *authHandler) refresh(w http.ResponseWriter, r *http.Request) {
+	req := new(domain.RefreshRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := h.auth.Refresh(r.Context(), req.RefreshToken)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *authHandler) logout(w http.ResponseWriter, r *http.Request) {
+	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
+	if !ok {
+		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
+		return
+	}
+	err := h.auth.Logout(r.Context(), claim)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *authHandler) logoutAll(w http.ResponseWriter, r *http.Request) {
+	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
+	if !ok {
+		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
+		return
+	}
+	n, err := h.auth.LogoutAll(r.Context(), claim.UserID)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"revoked_sessions": n})
+}
+
+func (h *authHandler) changePassword(w http.ResponseWriter, r *http.Request) {
+	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
+	if !ok {
+		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
+		return
+	}
+	req := new(domain.ChangePasswordRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.NewPassword) < 6 {
+		errorWrite(w, http.StatusBadRequest, fmt.Errorf("password too short, minimum 6 characters"))
+		return
+	}
+	res, err := h.use.ChangePassword(r.Context(), claim, req)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *authHandler) me(w http.ResponseWriter, r *http.Request) {
+	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
+	if !ok {
+		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
+		return
+	}
+	res, err := h.use.Me(r.Context(), claim.UserID)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -5,9 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"taxi-hailing/intenal/authz"
 	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
 	"taxi-hailing/intenal/service"
-	"taxi-hailing/pkg"
 
 	"github.com/google/uuid"
 )
@@ -16,22 +17,23 @@ type driverServer struct {
 	srv http.Server
 }
 
-func NewDriverServer(port uint16, sec string, use *service.DriverService) *driverServer {
+func NewDriverServer(port uint16, auth *service.AuthService, use *service.DriverService, checks ...HealthCheck) *driverServer {
 	mux := http.NewServeMux()
-	hand := &driverHandler{[]byte(sec), use}
-	// mux.HandleFunc("POST /drivers/register", hand.registerDriver)
-	// mux.HandleFunc("POST /drivers/login", hand.loginDriver)
-	// mux.HandleFunc("GET /drivers/info", hand.infoUser)
-	mux.Handle("POST /drivers/{driver_id}/online", authMiddleware(http.HandlerFunc(hand.driverOnline), []byte(sec)))
-	mux.Handle("POST /drivers/{driver_id}/offline", authMiddleware(http.HandlerFunc(hand.driverOffline), []byte(sec)))
-	mux.Handle("POST /drivers/{driver_id}/location", authMiddleware(http.HandlerFunc(hand.driverLocationUpdate), []byte(sec)))
-	mux.Handle("POST /drivers/{driver_id}/route", authMiddleware(http.HandlerFunc(hand.driverEnRoute), []byte(sec)))
-	mux.Handle("POST /drivers/{driver_id}/start", authMiddleware(http.HandlerFunc(hand.driverStart), []byte(sec)))
-	mux.Handle("POST /drivers/{driver_id}/complete", authMiddleware(http.HandlerFunc(hand.driverComplete), []byte(sec)))
+	mux.Handle("GET /metrics", metrics.Handler())
+	healthRoutes(mux, checks)
+	hand := &driverHandler{use}
+	ownDriver := authz.Allow(authz.RoleDriver).OwnedBy("driver_id")
+	mux.Handle("POST /drivers/{driver_id}/online", protect(auth, ownDriver, hand.driverOnline))
+	mux.Handle("POST /drivers/{driver_id}/offline", protect(auth, ownDriver, hand.driverOffline))
+	mux.Handle("POST /drivers/{driver_id}/location", protect(auth, ownDriver, hand.driverLocationUpdate))
+	mux.Handle("POST /drivers/{driver_id}/route", protect(auth, ownDriver, hand.driverEnRoute))
+	mux.Handle("POST /drivers/{driver_id}/arrived", protect(auth, ownDriver, hand.driverArrived))
+	mux.Handle("POST /drivers/{driver_id}/start", protect(auth, ownDriver, hand.driverStart))
+	mux.Handle("POST /drivers/{driver_id}/complete", protect(auth, ownDriver, hand.driverComplete))
 	return &driverServer{
 		srv: http.Server{
 			Addr:    fmt.Sprintf(":%d", port),
-			Handler: mux,
+			Handler: traceMiddleware(metricsMiddleware(mux)),
 		},
 	}
 }
@@ -45,21 +47,11 @@ func (s *driverServer) ShutDownServer(ctx context.Context) error {
 }
 
 type driverHandler struct {
-	secret []byte
-	use    *service.DriverService
+	use *service.DriverService
 }
 
 func (h *driverHandler) driverOnline(w http.ResponseWriter, r *http.Request) {
-	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
-	if !ok {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
-		return
-	}
 	id := r.PathValue("driver_id")
-	if claim.UserID != id {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("driver id != token's id"))
-		return
-	}
 	loc := new(domain.Location)
 	err := json.NewDecoder(r.Body).Decode(loc)
 	if err != nil {
@@ -79,11 +71,11 @@ func (h *driverHandler) driverOnline(w http.ResponseWriter, r *http.Request) {
 
 	sessionID, err := h.use.SetToOnline(r.Context(), uid, loc)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	res := &domain.DriverOnlineResponse{
-		Status:    "AVAILABLE",
+		Status:    domain.DriverAvailable,
 		SessionID: sessionID.String(),
 		Message:   "You are now online and ready to accept rides",
 	}
@@ -92,19 +84,10 @@ func (h *driverHandler) driverOnline(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *driverHandler) driverOffline(w http.ResponseWriter, r *http.Request) {
-	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
-	if !ok {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
-		return
-	}
 	id := r.PathValue("driver_id")
-	if claim.UserID != id {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("driver id != token's id"))
-		return
-	}
 	res, err := h.use.SetToOffline(r.Context(), id)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -112,16 +95,7 @@ func (h *driverHandler) driverOffline(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *driverHandler) driverLocationUpdate(w http.ResponseWriter, r *http.Request) {
-	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
-	if !ok {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
-		return
-	}
 	id := r.PathValue("driver_id")
-	if claim.UserID != id {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("driver id != token's id"))
-		return
-	}
 	loc := new(domain.LocationUpdate)
 	err := json.NewDecoder(r.Body).Decode(loc)
 	if err != nil {
@@ -135,7 +109,7 @@ func (h *driverHandler) driverLocationUpdate(w http.ResponseWriter, r *http.Requ
 	}
 	res, err := h.use.UpdateDriverLocation(r.Context(), id, loc)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -143,16 +117,7 @@ func (h *driverHandler) driverLocationUpdate(w http.ResponseWriter, r *http.Requ
 }
 
 func (h *driverHandler) driverEnRoute(w http.ResponseWriter, r *http.Request) {
-	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
-	if !ok {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
-		return
-	}
 	id := r.PathValue("driver_id")
-	if claim.UserID != id {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("driver id != token's id"))
-		return
-	}
 
 	req := new(domain.DriverLocationMessage)
 	err := json.NewDecoder(r.Body).Decode(req)
@@ -163,24 +128,33 @@ func (h *driverHandler) driverEnRoute(w http.ResponseWriter, r *http.Request) {
 
 	res, err := h.use.EnRoute(r.Context(), id, req)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(res)
 }
 
-func (h *driverHandler) driverStart(w http.ResponseWriter, r *http.Request) {
-	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
-	if !ok {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
+func (h *driverHandler) driverArrived(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("driver_id")
+
+	req := new(domain.DriverLocationMessage)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
-	id := r.PathValue("driver_id")
-	if claim.UserID != id {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("driver id != token's id"))
+	res, err := h.use.Arrived(r.Context(), id, req)
+	if err != nil {
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *driverHandler) driverStart(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("driver_id")
 
 	req := new(domain.DriverLocationMessage)
 	err := json.NewDecoder(r.Body).Decode(req)
@@ -190,7 +164,7 @@ func (h *driverHandler) driverStart(w http.ResponseWriter, r *http.Request) {
 	}
 	res, err := h.use.Start(r.Context(), id, req)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -198,16 +172,7 @@ func (h *driverHandler) driverStart(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *driverHandler) driverComplete(w http.ResponseWriter, r *http.Request) {
-	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
-	if !ok {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
-		return
-	}
 	id := r.PathValue("driver_id")
-	if claim.UserID != id {
-		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("driver id != token's id"))
-		return
-	}
 	req := new(domain.CompleteRideRequest)
 	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
@@ -216,7 +181,7 @@ func (h *driverHandler) driverComplete(w http.ResponseWriter, r *http.Request) {
 	}
 	res, err := h.use.Complete(r.Context(), id, req)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
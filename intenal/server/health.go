@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// HealthCheck is one dependency the service needs to take traffic, like the db pool or rabbit
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// healthRoutes adds the probes. /healthz only says the process serves http,
+// /readyz runs every check and answers 503 if one fails, so the load balancer stops routing here.
+func healthRoutes(mux *http.ServeMux, checks []HealthCheck) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, &healthResponse{Status: "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		res, ok := runChecks(r.Context(), checks)
+		if !ok {
+			writeHealth(w, http.StatusServiceUnavailable, res)
+			return
+		}
+		writeHealth(w, http.StatusOK, res)
+	})
+}
+
+// runChecks runs the checks in parallel, each with its own timeout
+func runChecks(ctx context.Context, checks []HealthCheck) (*healthResponse, bool) {
+	res := &healthResponse{Status: "ready", Checks: make(map[string]string, len(checks))}
+	ok := true
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			err := c.Check(cctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.Checks[c.Name] = err.Error()
+				ok = false
+				return
+			}
+			res.Checks[c.Name] = "ok"
+		}()
+	}
+	wg.Wait()
+	if !ok {
+		res.Status = "not ready"
+	}
+	return res, ok
+}
+
+func writeHealth(w http.ResponseWriter, code int, res *healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(res)
+}
@@ -4,20 +4,37 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
 	"taxi-hailing/pkg"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ctxKey string
 
 const userCtxKey ctxKey = "user"
 
-// for both services(driver and passenger)
-func authMiddleware(next http.Handler, secret []byte) http.Handler {
+// protect authenticates the request and checks the route's rule before next runs.
+// Every server answers the same way: 401 without a valid session, 403 when the rule denies.
+func protect(auth authz.Authenticator, rule authz.Rule, next http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		claim, err := getClaim(r, secret)
+		token, err := bearerToken(r)
+		if err != nil {
+			authError(w, err)
+			return
+		}
+		claim, err := authz.Authorize(r.Context(), auth, token, rule, r.PathValue)
 		if err != nil {
-			errorWrite(w, http.StatusBadRequest, err)
+			authError(w, err)
 			return
 		}
 		// кладем userID в контекст
@@ -27,21 +44,86 @@ func authMiddleware(next http.Handler, secret []byte) http.Handler {
 	})
 }
 
-func getClaim(r *http.Request, secret []byte) (*pkg.MyClaims, error) {
+func bearerToken(r *http.Request) (string, error) {
 	// 1. Получаем заголовок Authorization
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
-		return nil, fmt.Errorf("missing Authorization header")
+		return "", fmt.Errorf("%w: missing Authorization header", domain.ErrUnauthorized)
 	}
 
 	// 2. Проверяем что формат Bearer TOKEN
 	parts := strings.Split(auth, " ")
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid Authorization header")
+		return "", fmt.Errorf("%w: invalid Authorization header", domain.ErrUnauthorized)
+	}
+	return parts[1], nil
+}
+
+func authError(w http.ResponseWriter, err error) {
+	code := authz.Status(err)
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ride-hail"`)
 	}
+	errorWrite(w, code, err)
+}
+
+// traceMiddleware is the edge of every request: it continues the caller's trace (traceparent header)
+// or starts a new one, takes a valid X-Correlation-ID from the client or mints it, puts both into context
+// and echoes the correlation id in the response
+func traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := pkg.Tracer().Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		id := r.Header.Get(pkg.CorrelationHeader)
+		if !pkg.ValidCorrelationID(id) {
+			id = pkg.NewCorrelationID(ctx)
+		}
+		ctx = pkg.WithCorrelationID(ctx, id)
+		span.SetAttributes(pkg.CorrelationAttr(id), attribute.String("http.method", r.Method))
+		w.Header().Set(pkg.CorrelationHeader, id)
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		req := r.WithContext(ctx)
+		next.ServeHTTP(rec, req)
 
-	tokenStr := parts[1]
+		if req.Pattern != "" {
+			span.SetName(req.Pattern)
+		}
+		span.SetAttributes(attribute.Int("http.status_code", rec.code))
+		if rec.code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.code))
+		}
+	})
+}
+
+// metricsMiddleware records the latency of the request by route pattern, must wrap the mux directly
+// so the pattern set by the mux is seen here
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequestDuration.WithLabelValues(route, strconv.Itoa(rec.code)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers the response code for the span and the metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
 
-	// 3. Парсим токен
-	return pkg.ParseTokenMyClaims(tokenStr, secret)
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
 }
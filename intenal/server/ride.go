@@ -3,30 +3,37 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"taxi-hailing/intenal/authz"
 	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
 	"taxi-hailing/intenal/service"
 	"taxi-hailing/pkg"
+
+	"github.com/google/uuid"
 )
 
 type rideServer struct {
 	srv http.Server
 }
 
-func NewRideServer(port uint16, sec string, use *service.RideService) *rideServer {
+func NewRideServer(port uint16, auth *service.AuthService, use *service.RideService, checks ...HealthCheck) *rideServer {
 	mux := http.NewServeMux()
-	hand := &rideHandler{[]byte(sec), use}
-	mux.HandleFunc("POST /register", hand.registerPassenger)
-	mux.HandleFunc("POST /login", hand.loginPassenger)
-	mux.HandleFunc("GET /user/info", hand.infoUser)
-	mux.Handle("POST /rides", authMiddleware(http.HandlerFunc(hand.createRide), []byte(sec)))
-	mux.HandleFunc("POST /rides/{ride_id}/cancel", hand.cancelRide)
+	mux.Handle("GET /metrics", metrics.Handler())
+	healthRoutes(mux, checks)
+	hand := &rideHandler{use}
+	passenger := authz.Allow(authz.RolePassenger)
+	mux.Handle("GET /rides/estimate", protect(auth, passenger, hand.estimate))
+	mux.Handle("POST /rides/estimate", protect(auth, passenger, hand.estimate))
+	mux.Handle("POST /rides", protect(auth, passenger, hand.createRide))
+	mux.Handle("POST /rides/{ride_id}/cancel", protect(auth, passenger, hand.cancelRide))
 	return &rideServer{
 		srv: http.Server{
 			Addr:    fmt.Sprintf(":%d", port),
-			Handler: mux,
+			Handler: traceMiddleware(metricsMiddleware(mux)),
 		},
 	}
 }
@@ -40,147 +47,147 @@ func (s *rideServer) ShutDownServer(ctx context.Context) error {
 }
 
 type rideHandler struct {
-	secret []byte
-	use    *service.RideService
+	use *service.RideService
 }
 
-func (h *rideHandler) registerPassenger(w http.ResponseWriter, r *http.Request) {
-	user := new(domain.User)
-	err := json.NewDecoder(r.Body).Decode(user)
-	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+func (h *rideHandler) createRide(w http.ResponseWriter, r *http.Request) {
+	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
+	if !ok {
+		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
 		return
 	}
-	err = validateUserInput(user, true)
+
+	ride := new(domain.RideRequest)
+	err := json.NewDecoder(r.Body).Decode(ride)
 	if err != nil {
 		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
-	user.PasswordHash, err = pkg.HashPassword(user.PasswordHash, h.secret)
+	err = validatorRide(ride)
 	if err != nil {
-		errorWrite(w, http.StatusInternalServerError, err)
+		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
-	id, err := h.use.RegisterPassenger(r.Context(), user)
-	if err != nil {
-		errorWrite(w, http.StatusInternalServerError, err)
+	// ownership of a body field, the route rule only sees path values
+	if ride.PassengerID != claim.UserID {
+		authError(w, fmt.Errorf("%w: passenger_id does not belong to the token's user", domain.ErrForbidden))
 		return
 	}
 
-	claims := &pkg.MyClaims{
-		UserID: id,
-		Name:   user.Name,
-		Email:  user.Email,
-		Role:   user.Role,
-	}
-
-	token, err := pkg.GenerateTokenMyClaims(claims, h.secret)
+	res, err := h.use.CreateRide(r.Context(), ride)
 	if err != nil {
-		errorWrite(w, http.StatusInternalServerError, err)
+		errorWrite(w, errorCode(err, http.StatusBadRequest), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pkg.RegistrationResponse{ID: id, Token: token})
+	json.NewEncoder(w).Encode(res)
+
 }
 
-func (h *rideHandler) loginPassenger(w http.ResponseWriter, r *http.Request) {
-	user := new(domain.User)
-	err := json.NewDecoder(r.Body).Decode(user)
-	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
-		return
-	}
-	err = validateUserInput(user, false)
-	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+// estimate takes the route as query parameters (GET) or as a json body (POST)
+func (h *rideHandler) estimate(w http.ResponseWriter, r *http.Request) {
+	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
+	if !ok {
+		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
 		return
 	}
 
-	ourUser, err := h.use.GetUserByEmail(r.Context(), user.Email)
-	if err != nil {
-		if errors.Is(err, domain.ErrNotFound) {
-			errorWrite(w, http.StatusNotFound, err)
-		} else {
-			errorWrite(w, http.StatusBadRequest, err)
-		}
-		return
+	req := new(domain.FareEstimateRequest)
+	var err error
+	if r.Method == http.MethodGet {
+		err = estimateQuery(r.URL.Query(), req)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(req)
 	}
-	check, err := pkg.CheckPassword(user.PasswordHash, ourUser.PasswordHash, h.secret)
 	if err != nil {
-		errorWrite(w, http.StatusInternalServerError, err)
-		return
-	}
-	if !check {
-		errorWrite(w, http.StatusBadRequest, fmt.Errorf("wrong password"))
+		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
-
-	if ourUser.Status == "BANNED" {
-		errorWrite(w, http.StatusBadRequest, fmt.Errorf("wrong status: %s", ourUser.Status))
+	err = validatorEstimate(req)
+	if err != nil {
+		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
 
-	claims := &pkg.MyClaims{
-		UserID: ourUser.ID,
-		Name:   ourUser.Name,
-		Email:  user.Email,
-		Role:   ourUser.Role,
-	}
-
-	token, err := pkg.GenerateTokenMyClaims(claims, h.secret)
+	res, err := h.use.Estimate(r.Context(), claim.UserID, req)
 	if err != nil {
-		errorWrite(w, http.StatusInternalServerError, err)
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pkg.RegistrationResponse{ID: ourUser.ID, Token: token})
+	json.NewEncoder(w).Encode(res)
 }
 
-func (h *rideHandler) infoUser(w http.ResponseWriter, r *http.Request) {
-	claim, err := getClaim(r, h.secret)
-	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
-		return
+func estimateQuery(q url.Values, req *domain.FareEstimateRequest) error {
+	fields := []struct {
+		name string
+		dst  *float64
+	}{
+		{"pickup_latitude", &req.PickupLatitude},
+		{"pickup_longitude", &req.PickupLongitude},
+		{"destination_latitude", &req.DestinationLatitude},
+		{"destination_longitude", &req.DestinationLongitude},
+	}
+	for _, f := range fields {
+		v := q.Get(f.name)
+		if v == "" {
+			return fmt.Errorf("%s is required", f.name)
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number", f.name)
+		}
+		*f.dst = n
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(claim)
+	return nil
 }
 
-func (h *rideHandler) createRide(w http.ResponseWriter, r *http.Request) {
+func (h *rideHandler) cancelRide(w http.ResponseWriter, r *http.Request) {
 	claim, ok := r.Context().Value(userCtxKey).(*pkg.MyClaims)
 	if !ok {
 		errorWrite(w, http.StatusInternalServerError, fmt.Errorf("context error"))
 		return
 	}
-
-	ride := new(domain.RideRequest)
-	err := json.NewDecoder(r.Body).Decode(ride)
-	if err != nil {
+	rideID := r.PathValue("ride_id")
+	if _, err := uuid.Parse(rideID); err != nil {
 		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
-	err = validatorRide(ride)
+
+	req := new(domain.CancelRideRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
 		errorWrite(w, http.StatusBadRequest, err)
 		return
 	}
-	if ride.PassengerID != claim.UserID {
-		errorWrite(w, http.StatusBadRequest, fmt.Errorf("wrong id"))
+	if len(req.Reason) > 500 {
+		errorWrite(w, http.StatusBadRequest, fmt.Errorf("reason too long, maximum 500 characters"))
 		return
 	}
 
-	res, err := h.use.CreateRide(r.Context(), ride)
+	res, err := h.use.CancelRide(r.Context(), claim.UserID, rideID, req)
 	if err != nil {
-		errorWrite(w, http.StatusBadRequest, err)
+		errorWrite(w, errorCode(err, http.StatusInternalServerError), err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(res)
-
 }
 
-func (h *rideHandler) cancelRide(w http.ResponseWriter, r *http.Request) {
-
+func validatorEstimate(req *domain.FareEstimateRequest) error {
+	if req.PickupLatitude < -90 || req.PickupLatitude > 90 {
+		return fmt.Errorf("pickup_latitude must be between -90 and 90")
+	}
+	if req.PickupLongitude < -180 || req.PickupLongitude > 180 {
+		return fmt.Errorf("pickup_longitude must be between -180 and 180")
+	}
+	if req.DestinationLatitude < -90 || req.DestinationLatitude > 90 {
+		return fmt.Errorf("destination_latitude must be between -90 and 90")
+	}
+	if req.DestinationLongitude < -180 || req.DestinationLongitude > 180 {
+		return fmt.Errorf("destination_longitude must be between -180 and 180")
+	}
+	return nil
 }
 
 func validatorRide(ride *domain.RideRequest) error {
@@ -2,7 +2,9 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"taxi-hailing/intenal/domain"
 )
 
 type myErr struct {
@@ -17,3 +19,18 @@ func errorWrite(w http.ResponseWriter, code int, err error) {
 	}
 	json.NewEncoder(w).Encode(msg)
 }
+
+// errorCode maps typed domain errors to http codes, anything else gets fallback
+func errorCode(err error, fallback int) int {
+	switch {
+	case errors.Is(err, domain.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, domain.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, domain.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, domain.Errconflict):
+		return http.StatusConflict
+	}
+	return fallback
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"taxi-hailing/intenal/domain"
+	"time"
 )
 
 // ValidateUserInput валидирует name, email и пароль
@@ -34,6 +35,35 @@ func validateUserInput(user *domain.User, register bool) error {
 	return nil
 }
 
+func validateDriverInput(req *domain.DriverRegisterRequest) error {
+	user := &domain.User{
+		Name:         req.Name,
+		Email:        req.Email,
+		PasswordHash: req.Password,
+		Role:         "DRIVER",
+	}
+	err := validateUserInput(user, true)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(req.LicenseNumber)) == 0 {
+		return errors.New("license_number cannot be empty")
+	}
+	switch req.VehicleType {
+	case "ECONOMY", "PREMIUM", "XL":
+	default:
+		return fmt.Errorf("invalid vehicle_type: %s", req.VehicleType)
+	}
+	v := req.VehicleAttrs
+	if v.Make == "" || v.Model == "" || v.Color == "" || v.Plate == "" {
+		return errors.New("vehicle_attrs make, model, color and plate are required")
+	}
+	if v.VehicleYear != 0 && (v.VehicleYear < 1980 || int(v.VehicleYear) > time.Now().Year()+1) {
+		return fmt.Errorf("invalid vehicle_year: %d", v.VehicleYear)
+	}
+	return nil
+}
+
 func validateLocation(lat, lng float64) error {
 	if lat < -90 || lat > 90 {
 		return fmt.Errorf("latitude must be between -90 and 90")
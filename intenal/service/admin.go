@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"taxi-hailing/intenal/broker"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/repo"
+	"time"
+)
+
+type AdminService struct {
+	slogger *slog.Logger
+	db      *repo.AdminRepo
+	rabbit  *broker.AdminBroker
+}
+
+func NewAdminService(slogger *slog.Logger, db *repo.AdminRepo, rabbit *broker.AdminBroker) *AdminService {
+	return &AdminService{
+		slogger: slogger,
+		db:      db,
+		rabbit:  rabbit,
+	}
+}
+
+func (a *AdminService) Overview(ctx context.Context) (*domain.SystemOverview, error) {
+	metrics, err := a.db.GetOverview(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.SystemOverview{
+		Timestamp: time.Now().UTC(),
+		Metrics:   *metrics,
+	}, nil
+}
+
+func (a *AdminService) ActiveRides(ctx context.Context, page, pageSize int) (*domain.ActiveRidesResponse, error) {
+	rides, total, err := a.db.GetActiveRides(ctx, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.ActiveRidesResponse{
+		Rides:      rides,
+		TotalCount: total,
+		Page:       page,
+		PageSize:   pageSize,
+	}, nil
+}
+
+func (a *AdminService) OnlineDrivers(ctx context.Context) (*domain.OnlineDriversResponse, error) {
+	drivers, err := a.db.GetOnlineDrivers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.OnlineDriversResponse{
+		Drivers:    drivers,
+		TotalCount: len(drivers),
+	}, nil
+}
+
+func (a *AdminService) Revenue(ctx context.Context, from, to time.Time) (*domain.RevenueReport, error) {
+	return a.db.GetRevenue(ctx, from, to)
+}
+
+func (a *AdminService) RideEvents(ctx context.Context, rideID string) ([]domain.RideEvent, error) {
+	return a.db.GetRideEvents(ctx, rideID)
+}
+
+func (a *AdminService) DeadLetters(queue string, limit int) (*domain.DeadLettersResponse, error) {
+	return a.rabbit.DeadLetters(queue, limit)
+}
+
+func (a *AdminService) Redrive(ctx context.Context, queue string, limit int) (*domain.RedriveResponse, error) {
+	return a.rabbit.Redrive(ctx, queue, limit)
+}
+
+func (a *AdminService) Tariffs(ctx context.Context, vehicleType string) (*domain.TariffsResponse, error) {
+	tariffs, err := a.db.ListTariffs(ctx, vehicleType)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.TariffsResponse{Tariffs: tariffs}, nil
+}
+
+// CreateTariff schedules a new version of the vehicle type's prices, rides already booked keep theirs
+func (a *AdminService) CreateTariff(ctx context.Context, t *domain.Tariff) (*domain.Tariff, error) {
+	err := a.db.CreateTariff(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	t.Active = false
+	a.slogger.InfoContext(ctx, "tariff created", "action", "create tariff", "tariff_id", t.ID, "vehicle_type", t.VehicleType, "version", t.Version, "effective_from", t.EffectiveFrom)
+	return t, nil
+}
+
+func (a *AdminService) DeleteTariff(ctx context.Context, id string) error {
+	err := a.db.DeleteTariff(ctx, id)
+	if err != nil {
+		return err
+	}
+	a.slogger.InfoContext(ctx, "tariff deleted", "action", "delete tariff", "tariff_id", id)
+	return nil
+}
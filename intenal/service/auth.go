@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/pkg"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	revocationRetryMin = time.Second
+	revocationRetryMax = 30 * time.Second
+)
+
+// TokenConfig is how a service signs and verifies access tokens
+type TokenConfig struct {
+	Keys     jwks.Keys   // public keys tokens are verified with
+	Signer   jwks.Signer // only the auth service has one, the other services cannot mint tokens
+	Issuer   string
+	Audience string // this service, tokens issued for other services are rejected
+	Secret   []byte // keys legacy password hashes, not tokens
+}
+
+// AuthService issues access and refresh tokens for login sessions and checks every
+// access token against the revocation list, so logout and bans work before the token expires
+type AuthService struct {
+	slogger *slog.Logger
+	db      repo.SessionStore
+	cfg     TokenConfig
+
+	mu       sync.RWMutex
+	onRevoke []func(userID, sessionID string)
+}
+
+func NewAuthService(ctx context.Context, slogger *slog.Logger, db repo.SessionStore, tokens TokenConfig) *AuthService {
+	s := &AuthService{
+		slogger: slogger,
+		db:      db,
+		cfg:     tokens,
+	}
+	go s.watchRevocations(ctx)
+	return s
+}
+
+// CheckPassword also accepts legacy HMAC hashes, which are keyed by the jwt secret
+func (s *AuthService) CheckPassword(password, storedHash string) (ok, rehash bool, err error) {
+	return pkg.CheckPassword(password, storedHash, s.cfg.Secret)
+}
+
+// Login opens a new session for an already authenticated user
+func (s *AuthService) Login(ctx context.Context, claims *pkg.MyClaims) (*pkg.RegistrationResponse, error) {
+	refresh, hash, err := pkg.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	session := &domain.Session{
+		UserID:      claims.UserID,
+		RefreshHash: hash,
+		ExpiresAt:   time.Now().Add(pkg.RefreshTokenTTL),
+	}
+	err = s.db.CreateSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokens(claims, session.ID, refresh)
+}
+
+// Refresh rotates the refresh token and issues a new access token with the current name and role
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (*pkg.RegistrationResponse, error) {
+	if refreshToken == "" {
+		return nil, fmt.Errorf("%w: refresh_token is required", domain.ErrUnauthorized)
+	}
+	refresh, hash, err := pkg.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.db.RotateSession(ctx, pkg.HashRefreshToken(refreshToken), hash, time.Now().Add(pkg.RefreshTokenTTL))
+	if err != nil {
+		if errors.Is(err, domain.ErrUnauthorized) {
+			s.slogger.WarnContext(ctx, "refresh rejected", "action", "refresh token", "error", err)
+		}
+		return nil, err
+	}
+	claims := &pkg.MyClaims{
+		UserID: user.UserID,
+		Name:   user.Name,
+		Email:  user.Email,
+		Role:   user.Role,
+	}
+	return s.tokens(claims, user.SessionID, refresh)
+}
+
+func (s *AuthService) tokens(claims *pkg.MyClaims, sessionID, refresh string) (*pkg.RegistrationResponse, error) {
+	if s.cfg.Signer == nil {
+		return nil, fmt.Errorf("this service does not issue tokens")
+	}
+	kid, key, err := s.cfg.Signer.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+	claims.SessionID = sessionID
+	token, err := pkg.GenerateTokenMyClaims(claims, kid, key, s.cfg.Issuer, authz.Audiences(claims.Role))
+	if err != nil {
+		return nil, err
+	}
+	return &pkg.RegistrationResponse{
+		ID:           claims.UserID,
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int(pkg.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Authenticate parses the access token and checks that its session is still active
+func (s *AuthService) Authenticate(ctx context.Context, token string) (*pkg.MyClaims, error) {
+	claim, err := pkg.ParseTokenMyClaims(token, func(kid string) (ed25519.PublicKey, error) {
+		return s.cfg.Keys.PublicKey(ctx, kid)
+	}, s.cfg.Issuer, s.cfg.Audience)
+	if err != nil {
+		// not the token's fault, the keys could not be fetched from the auth service
+		if errors.Is(err, jwks.ErrKeysUnavailable) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", domain.ErrUnauthorized, err)
+	}
+	// tokens issued before sessions existed have none
+	if _, err := uuid.Parse(claim.SessionID); err != nil {
+		return nil, fmt.Errorf("%w: token has no session, log in again", domain.ErrUnauthorized)
+	}
+	err = s.db.CheckSession(ctx, claim.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// Logout revokes the session of the token
+func (s *AuthService) Logout(ctx context.Context, claim *pkg.MyClaims) error {
+	err := s.db.RevokeSession(ctx, claim.UserID, claim.SessionID, domain.RevokeLogout)
+	if err != nil {
+		return err
+	}
+	s.slogger.InfoContext(ctx, "logged out", "action", "logout", "user_id", claim.UserID, "session_id", claim.SessionID)
+	return nil
+}
+
+// LogoutAll revokes every session of the user, e.g. after a phone was stolen
+func (s *AuthService) LogoutAll(ctx context.Context, userID string) (int64, error) {
+	return s.RevokeAll(ctx, userID, domain.RevokeLogout)
+}
+
+func (s *AuthService) RevokeAll(ctx context.Context, userID, reason string) (int64, error) {
+	n, err := s.db.RevokeUserSessions(ctx, userID, reason)
+	if err != nil {
+		return 0, err
+	}
+	s.slogger.InfoContext(ctx, "all sessions revoked", "action", "logout", "user_id", userID, "sessions", n, "reason", reason)
+	return n, nil
+}
+
+// OnRevoke registers fn to be called for every revoked session, in any service instance
+func (s *AuthService) OnRevoke(fn func(userID, sessionID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRevoke = append(s.onRevoke, fn)
+}
+
+func (s *AuthService) revoked(userID, sessionID string) {
+	s.slogger.Info("session revoked", "action", "watch revocations", "user_id", userID, "session_id", sessionID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, fn := range s.onRevoke {
+		fn(userID, sessionID)
+	}
+}
+
+// watchRevocations keeps listening for revoked sessions, reconnecting with backoff
+func (s *AuthService) watchRevocations(ctx context.Context) {
+	delay := revocationRetryMin
+	for {
+		started := time.Now()
+		err := s.db.WatchRevocations(ctx, s.revoked)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > revocationRetryMax {
+			delay = revocationRetryMin
+		}
+		s.slogger.Error("session revocation listener stopped", "action", "watch revocations", "retry_in", delay.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, revocationRetryMax)
+	}
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/jwks"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/pkg"
+	"testing"
+	"time"
+)
+
+func newAuthWorld(t *testing.T) (*AuthService, *repo.MemoryStore, *pkg.MyClaims) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	slogger := slog.New(slog.DiscardHandler)
+
+	ring, err := jwks.NewKeyRing(ctx, slogger, t.TempDir())
+	if err != nil {
+		t.Fatalf("key ring: %v", err)
+	}
+	store := repo.NewMemoryStore()
+	userID, err := store.RegisterPassenger(ctx, &domain.User{Name: "Passenger", Email: "passenger@example.com"})
+	if err != nil {
+		t.Fatalf("register passenger: %v", err)
+	}
+	s := NewAuthService(ctx, slogger, store, TokenConfig{
+		Keys:     ring,
+		Signer:   ring,
+		Issuer:   "auth-test",
+		Audience: authz.AudienceRide,
+	})
+	return s, store, &pkg.MyClaims{UserID: userID, Name: "Passenger", Email: "passenger@example.com", Role: "PASSENGER"}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	ctx := context.Background()
+	s, _, claims := newAuthWorld(t)
+
+	first, err := s.Login(ctx, claims)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	second, err := s.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token was not rotated")
+	}
+	_, err = s.Authenticate(ctx, second.Token)
+	if err != nil {
+		t.Fatalf("authenticate the refreshed token: %v", err)
+	}
+	third, err := s.Refresh(ctx, second.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh the rotated token: %v", err)
+	}
+	_, err = s.Authenticate(ctx, third.Token)
+	if err != nil {
+		t.Fatalf("authenticate after two rotations: %v", err)
+	}
+
+	_, err = s.Refresh(ctx, "not-a-refresh-token")
+	if !errors.Is(err, domain.ErrUnauthorized) {
+		t.Errorf("refresh with an unknown token = %v, want %v", err, domain.ErrUnauthorized)
+	}
+	// an unknown token is not a reuse, the session stays active
+	_, err = s.Authenticate(ctx, third.Token)
+	if err != nil {
+		t.Errorf("authenticate after an unknown refresh token: %v", err)
+	}
+}
+
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	cases := []struct {
+		name  string
+		reuse int // which of the rotated away refresh tokens is presented again
+	}{
+		{"previous token", 1},
+		{"older token", 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, _, claims := newAuthWorld(t)
+
+			login, err := s.Login(ctx, claims)
+			if err != nil {
+				t.Fatalf("login: %v", err)
+			}
+			// another session of the same user, e.g. on a second phone
+			other, err := s.Login(ctx, claims)
+			if err != nil {
+				t.Fatalf("second login: %v", err)
+			}
+
+			tokens := []*pkg.RegistrationResponse{login}
+			for range 2 {
+				next, err := s.Refresh(ctx, tokens[len(tokens)-1].RefreshToken)
+				if err != nil {
+					t.Fatalf("refresh: %v", err)
+				}
+				tokens = append(tokens, next)
+			}
+			latest := tokens[len(tokens)-1]
+
+			_, err = s.Refresh(ctx, tokens[tc.reuse].RefreshToken)
+			if !errors.Is(err, domain.ErrUnauthorized) {
+				t.Fatalf("reused refresh token = %v, want %v", err, domain.ErrUnauthorized)
+			}
+			// the legitimate holder is logged out too, the reuse cannot tell who copied the token
+			_, err = s.Refresh(ctx, latest.RefreshToken)
+			if !errors.Is(err, domain.ErrUnauthorized) {
+				t.Errorf("refresh with the latest token after a reuse = %v, want %v", err, domain.ErrUnauthorized)
+			}
+			_, err = s.Authenticate(ctx, latest.Token)
+			if !errors.Is(err, domain.ErrUnauthorized) {
+				t.Errorf("access token of the revoked session = %v, want %v", err, domain.ErrUnauthorized)
+			}
+
+			_, err = s.Authenticate(ctx, other.Token)
+			if err != nil {
+				t.Errorf("other session was revoked by the reuse: %v", err)
+			}
+			_, err = s.Refresh(ctx, other.RefreshToken)
+			if err != nil {
+				t.Errorf("refresh the other session: %v", err)
+			}
+		})
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	ctx := context.Background()
+	s, _, claims := newAuthWorld(t)
+
+	var sessions []*pkg.RegistrationResponse
+	for range 2 {
+		login, err := s.Login(ctx, claims)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		sessions = append(sessions, login)
+	}
+	n, err := s.LogoutAll(ctx, claims.UserID)
+	if err != nil {
+		t.Fatalf("logout all: %v", err)
+	}
+	if n != int64(len(sessions)) {
+		t.Errorf("revoked %d sessions, want %d", n, len(sessions))
+	}
+	for _, login := range sessions {
+		_, err = s.Authenticate(ctx, login.Token)
+		if !errors.Is(err, domain.ErrUnauthorized) {
+			t.Errorf("access token after logout all = %v, want %v", err, domain.ErrUnauthorized)
+		}
+		_, err = s.Refresh(ctx, login.RefreshToken)
+		if !errors.Is(err, domain.ErrUnauthorized) {
+			t.Errorf("refresh after logout all = %v, want %v", err, domain.ErrUnauthorized)
+		}
+	}
+}
+
+// TestLoginUnknownEmail checks an unknown email fails like a wrong password and costs a password check too
+func TestLoginUnknownEmail(t *testing.T) {
+	ctx := context.Background()
+	auth, store, _ := newAuthWorld(t)
+	users := NewUserService(slog.New(slog.DiscardHandler), store, auth)
+	_, err := users.Register(ctx, &domain.RegisterRequest{
+		Role: "PASSENGER",
+		DriverRegisterRequest: domain.DriverRegisterRequest{
+			Name:     "Rider",
+			Email:    "rider@example.com",
+			Password: "correct horse",
+		},
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	started := time.Now()
+	_, wrongErr := users.Login(ctx, &domain.LoginRequest{Email: "rider@example.com", Password: "wrong"})
+	wrong := time.Since(started)
+	started = time.Now()
+	_, unknownErr := users.Login(ctx, &domain.LoginRequest{Email: "nobody@example.com", Password: "wrong"})
+	unknown := time.Since(started)
+
+	if !errors.Is(wrongErr, errBadCredentials) || !errors.Is(unknownErr, errBadCredentials) {
+		t.Fatalf("wrong password = %v, unknown email = %v, want both %v", wrongErr, unknownErr, errBadCredentials)
+	}
+	// without the dummy check the unknown email is a map lookup, thousands of times faster
+	if unknown < wrong/4 {
+		t.Errorf("unknown email took %v, a wrong password %v", unknown, wrong)
+	}
+}
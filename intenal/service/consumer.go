@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ackable is a rabbit message which must be settled after it is handled
+type ackable interface {
+	Headers() map[string]string
+	Ack() error
+	Nack(cause error) error
+	Reject(cause error) error
+}
+
+// consume continues the trace and the correlation id of the message in ctx.
+// The consumer span ends when the message is settled or rejected.
+func consume(ctx context.Context, msg ackable, name string) context.Context {
+	ctx = pkg.ExtractHeaders(ctx, msg.Headers())
+	ctx, span := pkg.Tracer().Start(ctx, "consume "+name, trace.WithSpanKind(trace.SpanKindConsumer))
+	span.SetAttributes(pkg.CorrelationAttr(pkg.CorrelationID(ctx)))
+	return ctx
+}
+
+// settle acks the handled message. A failed one goes to retry and after the last retry to the dead letter queue,
+// unless the error is permanent: then retries cannot help and it is dead lettered at once.
+// A message cut off by the shutdown is left unsettled, rabbit redelivers it without counting a retry.
+func settle(ctx context.Context, slogger *slog.Logger, msg ackable, err error) {
+	endSpan(ctx, err)
+	switch {
+	case ctx.Err() != nil && errors.Is(err, context.Canceled):
+		slogger.InfoContext(ctx, "shutting down, the message is redelivered", "action", "ack message")
+		return
+	case err == nil:
+		err = msg.Ack()
+	case permanent(err):
+		err = msg.Reject(err)
+	default:
+		err = msg.Nack(err)
+	}
+	if err != nil {
+		slogger.ErrorContext(ctx, "cannot settle the message", "action", "ack message", "error", err)
+	}
+}
+
+// reject dead letters the message which can never be handled, e.g. with a broken body
+func reject(ctx context.Context, slogger *slog.Logger, msg ackable, cause error) {
+	endSpan(ctx, cause)
+	err := msg.Reject(cause)
+	if err != nil {
+		slogger.ErrorContext(ctx, "cannot reject the message", "action", "ack message", "error", err)
+	}
+}
+
+// permanent errors come from the state of the ride or driver, not from an outage: the ride is gone,
+// or it is already at or past the status or finished and the message is stale (domain.ErrInvalidTransition
+// wraps Errconflict). A status ahead of the ride is not, the statuses before it are retried into place.
+func permanent(err error) bool {
+	return errors.Is(err, domain.ErrNotFound) || errors.Is(err, domain.Errconflict)
+}
+
+func endSpan(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// correlationID is the id of the request in ctx, minted here if the caller has none (e.g. a test)
+func correlationID(ctx context.Context) string {
+	if id := pkg.CorrelationID(ctx); id != "" {
+		return id
+	}
+	return pkg.NewCorrelationID(ctx)
+}
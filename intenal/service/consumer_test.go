@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"taxi-hailing/intenal/domain"
+	"testing"
+)
+
+// settledMsg records how the message was settled, empty if it was not
+type settledMsg struct {
+	settled string
+}
+
+func (m *settledMsg) Headers() map[string]string { return nil }
+func (m *settledMsg) Ack() error                 { m.settled = "ack"; return nil }
+func (m *settledMsg) Nack(error) error           { m.settled = "nack"; return nil }
+func (m *settledMsg) Reject(error) error         { m.settled = "reject"; return nil }
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name     string
+		shutdown bool
+		err      error
+		want     string
+	}{
+		{"handled", false, nil, "ack"},
+		{"outage", false, errors.New("connection refused"), "nack"},
+		{"ride is gone", false, domain.ErrNotFound, "reject"},
+		{"stale status", false, fmt.Errorf("%w: ride IN_PROGRESS -> ARRIVED", domain.ErrInvalidTransition), "reject"},
+		{"another driver", false, fmt.Errorf("%w: invalid driver id", domain.Errconflict), "reject"},
+		{"status ahead of the ride", false, fmt.Errorf("%w: ride MATCHED -> ARRIVED", domain.ErrStatusAhead), "nack"},
+		{"cut by the shutdown", true, fmt.Errorf("cannot match: %w", context.Canceled), ""},
+		{"cancelled while running", false, context.Canceled, "nack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.shutdown {
+				cancel()
+			}
+			msg := new(settledMsg)
+			settle(ctx, slog.New(slog.DiscardHandler), msg, tt.err)
+			if msg.settled != tt.want {
+				t.Errorf("settled with %s, want %s", msg.settled, tt.want)
+			}
+		})
+	}
+}
@@ -2,11 +2,14 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"sync"
 	"taxi-hailing/intenal/broker"
 	"taxi-hailing/intenal/domain"
 	"taxi-hailing/intenal/repo"
 	"taxi-hailing/intenal/ws"
+	"taxi-hailing/pkg"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,18 +17,79 @@ import (
 
 type DriverService struct {
 	slogger *slog.Logger
-	db      *repo.DriverRepo
-	rabbit  *broker.DriverBroker
+	db      repo.DriverStore
+	rabbit  broker.DriverRabbit
 	ws      *ws.DriverHub
+	// driverID -> reservation, drivers picked by matcher but not yet written to rides
+	reserved sync.Map
+	// rideID -> struct{}, ride requests being matched right now
+	matching  sync.Map
+	locations *locationThrottler
 }
 
-func NewDriverService(slogger *slog.Logger, db *repo.DriverRepo, rabbit *broker.DriverBroker, ws *ws.DriverHub) *DriverService {
-	return &DriverService{
+func NewDriverService(ctx context.Context, slogger *slog.Logger, db repo.DriverStore, rabbit broker.DriverRabbit, ws *ws.DriverHub) *DriverService {
+	service := &DriverService{
 		slogger: slogger,
 		db:      db,
 		rabbit:  rabbit,
 		ws:      ws,
 	}
+	service.locations = newLocationThrottler(locationPublishInterval, rabbit.PublishLocation, func(loc *domain.DriverLocationUpdate, err error) {
+		slogger.Error("cannot publish driver location", "action", "publish location", "driver_id", loc.DriverID, "ride_id", loc.RideID, "error", err)
+	})
+	go service.rideMatcher(ctx)
+	go service.statusUpdater(ctx)
+	go service.sweepReservations(ctx)
+	return service
+}
+
+// statusUpdater handles ride changes made on the passenger side
+func (d *DriverService) statusUpdater(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-d.rabbit.GiveStatusChannel():
+			mctx := consume(ctx, v, "driver status")
+			status, err := v.GiveBody()
+			if err != nil {
+				d.slogger.ErrorContext(mctx, "canot get the body of status ride", "action", "get body", "error", err)
+				reject(mctx, d.slogger, v, err)
+				continue
+			}
+			err = d.statusUpdate(mctx, status)
+			if err != nil {
+				d.slogger.ErrorContext(mctx, "cannot handle status "+status.Status, "action", "update status", "ride_id", status.RideID, "error", err)
+			}
+			settle(mctx, d.slogger, v, err)
+		}
+	}
+}
+
+func (d *DriverService) statusUpdate(ctx context.Context, status *domain.RideStatusUpdate) error {
+	switch status.Status {
+	case domain.RideCancelled:
+		uid, err := uuid.Parse(status.DriverID)
+		if err != nil {
+			return err
+		}
+		err = d.db.ReleaseDriver(ctx, uid, status.RideID)
+		if err != nil {
+			return err
+		}
+		d.unreserve(status.DriverID, status.RideID)
+		d.locations.forget(status.DriverID)
+		go d.ws.GiveToDriver(status.DriverID, &domain.RideCancelledMessage{
+			Type:          "ride_cancelled",
+			RideID:        status.RideID,
+			Reason:        status.Reason,
+			CorrelationID: status.CorrelationID,
+		})
+		d.slogger.InfoContext(ctx, "ride cancelled for the driver", "action", "cancel ride", "ride_id", status.RideID, "driver_id", status.DriverID, "reason", status.Reason)
+		return nil
+	default:
+		return fmt.Errorf("%w: invalid status: %s", domain.Errconflict, status.Status)
+	}
 }
 
 func (d *DriverService) SetToOnline(ctx context.Context, id uuid.UUID, loc *domain.Location) (uuid.UUID, error) {
@@ -48,7 +112,7 @@ func (d *DriverService) SetToOffline(ctx context.Context, id string) (*domain.Dr
 	}
 
 	return &domain.DriverOfflineResponse{
-		Status:         "OFFLINE",
+		Status:         domain.DriverOffline,
 		SessionID:      uid.String(),
 		SessionSummary: *summary,
 		Message:        "You are now offline",
@@ -61,10 +125,23 @@ func (d *DriverService) UpdateDriverLocation(ctx context.Context, id string, loc
 		return nil, err
 	}
 
-	hisID, err := d.db.UpdateDriverLocation(ctx, uid, loc)
+	hisID, rideID, err := d.db.UpdateDriverLocation(ctx, uid, loc)
 	if err != nil {
 		return nil, err
 	}
+	if rideID != uuid.Nil {
+		update := &domain.DriverLocationUpdate{
+			DriverID:       id,
+			RideID:         rideID.String(),
+			SpeedKmh:       loc.SpeedKmh,
+			HeadingDegrees: loc.HeadingDegrees,
+			Timestamp:      time.Now().UTC(),
+			CorrelationID:  pkg.CorrelationID(ctx),
+		}
+		update.Location.Lat = loc.Latitude
+		update.Location.Lng = loc.Longitude
+		d.locations.push(update)
+	}
 
 	return &domain.DriverCoordinateUpdate{
 		CoordinateID: hisID.String(),
@@ -78,30 +155,53 @@ func (d *DriverService) EnRoute(ctx context.Context, id string, req *domain.Driv
 		return nil, err
 	}
 
-	err = d.db.UpdateDriverToEnRoute(ctx, uid, req)
+	update := newRideStatus(req.RideID, id, domain.RideEnRoute)
+	err = d.db.UpdateDriverToEnRoute(ctx, uid, req, update)
 	if err != nil {
 		return nil, err
 	}
+	d.statusQueued(ctx, update)
 	return &domain.DriverStartRideResponse{
 		RideID:    req.RideID,
-		Status:    "EN_ROUTE",
+		Status:    domain.DriverEnRoute,
 		StartedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
 		Message:   "Ride enroute successfully",
 	}, nil
 }
 
+func (d *DriverService) Arrived(ctx context.Context, id string, req *domain.DriverLocationMessage) (*domain.DriverStartRideResponse, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	update := newRideStatus(req.RideID, id, domain.RideArrived)
+	err = d.db.UpdateDriverToArrived(ctx, uid, req, update)
+	if err != nil {
+		return nil, err
+	}
+	d.statusQueued(ctx, update)
+	return &domain.DriverStartRideResponse{
+		RideID:    req.RideID,
+		Status:    domain.RideArrived,
+		StartedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		Message:   "Arrived at pickup location",
+	}, nil
+}
+
 func (d *DriverService) Start(ctx context.Context, id string, req *domain.DriverLocationMessage) (*domain.DriverStartRideResponse, error) {
 	uid, err := uuid.Parse(id)
 	if err != nil {
 		return nil, err
 	}
-	err = d.db.UpdateDriverToBusy(ctx, uid, req)
+	update := newRideStatus(req.RideID, id, domain.RideInProgress)
+	err = d.db.UpdateDriverToBusy(ctx, uid, req, update)
 	if err != nil {
 		return nil, err
 	}
+	d.statusQueued(ctx, update)
 	return &domain.DriverStartRideResponse{
 		RideID:    req.RideID,
-		Status:    "BUSY",
+		Status:    domain.DriverBusy,
 		StartedAt: time.Now().UTC().Format("2006-01-02T15:04:05Z"),
 		Message:   "Ride started successfully",
 	}, nil
@@ -112,17 +212,34 @@ func (d *DriverService) Complete(ctx context.Context, id string, req *domain.Com
 	if err != nil {
 		return nil, err
 	}
-	fare, err := d.db.CompleteRide(ctx, uid, req)
+	update := newRideStatus(req.RideID, id, domain.RideCompleted)
+	fare, err := d.db.CompleteRide(ctx, uid, req, update)
 	if err != nil {
 		return nil, err
 	}
+	d.locations.forget(id)
+	d.statusQueued(ctx, update)
 	return &domain.DriverCompleteRideResponse{
 		RideID:         req.RideID,
-		Status:         "AVAILABLE",
+		Status:         domain.DriverAvailable,
 		CompletedAt:    time.Now().UTC().Format("2006-01-02T15:04:05Z"),
 		DriverEarnings: fare,
 		Message:        "Ride completed successfully",
 	}, nil
 }
 
-// func (d *DriverService) 
\ No newline at end of file
+// newRideStatus is the message for the ride service about the driver side transition,
+// the repo sets the correlation id of the ride and saves it to the outbox together with the transition
+func newRideStatus(rideID, driverID, status string) *domain.RideStatusUpdate {
+	return &domain.RideStatusUpdate{
+		RideID:    rideID,
+		Status:    status,
+		Timestamp: time.Now().UTC(),
+		DriverID:  driverID,
+	}
+}
+
+// statusQueued logs under the ride's correlation id, the request id of the driver is the request_id
+func (d *DriverService) statusQueued(ctx context.Context, update *domain.RideStatusUpdate) {
+	d.slogger.InfoContext(pkg.WithCorrelationID(ctx, update.CorrelationID), "ride status queued", "action", "publish status", "ride_id", update.RideID, "driver_id", update.DriverID, "status", update.Status, "request_id", pkg.CorrelationID(ctx))
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"taxi-hailing/intenal/domain"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	quoteTTL = 5 * time.Minute
+	// quotes are not access tokens, the audience keeps one from being mistaken for the other
+	quoteAudience = "ride-quote"
+	// coordinates of the ride must match the quoted route, about 10 cm
+	quoteCoordTolerance = 1e-6
+)
+
+// routeEstimate is the straight line route between pickup and destination
+type routeEstimate struct {
+	distanceKM  float64
+	durationMin float64
+}
+
+func estimateRoute(pickupLat, pickupLng, destLat, destLng float64) routeEstimate {
+	distance := distanceKM(pickupLat, pickupLng, destLat, destLng)
+	return routeEstimate{
+		distanceKM:  distance,
+		durationMin: distance / avgSpeed * 60,
+	}
+}
+
+// quoteClaims is the signed content of a fare quote
+type quoteClaims struct {
+	PickupLat  float64               `json:"pickup_lat"`
+	PickupLng  float64               `json:"pickup_lng"`
+	DestLat    float64               `json:"dest_lat"`
+	DestLng    float64               `json:"dest_lng"`
+	DistanceKM float64               `json:"distance_km"`
+	Fares      map[string]quotedFare `json:"fares"`
+	jwt.RegisteredClaims
+}
+
+// quotedFare is the fare of a ride type and the tariff version which priced it
+type quotedFare struct {
+	Fare     float64 `json:"fare"`
+	TariffID string  `json:"tariff_id"`
+}
+
+// quoter signs fare quotes with a key only the ride service knows
+type quoter struct {
+	secret []byte
+}
+
+func (q *quoter) sign(passengerID string, req *domain.FareEstimateRequest, route routeEstimate, fares map[string]quotedFare) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(quoteTTL)
+	claims := &quoteClaims{
+		PickupLat:  req.PickupLatitude,
+		PickupLng:  req.PickupLongitude,
+		DestLat:    req.DestinationLatitude,
+		DestLng:    req.DestinationLongitude,
+		DistanceKM: route.distanceKM,
+		Fares:      fares,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   passengerID,
+			Audience:  jwt.ClaimStrings{quoteAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(q.secret)
+	return token, expiresAt, err
+}
+
+// fare returns the quoted fare of the ride and its tariff. The quote must be unexpired, issued to the
+// passenger and for the same route; an expired one is a conflict, the client should estimate again.
+func (q *quoter) fare(quote string, ride *domain.RideRequest) (quotedFare, error) {
+	claims := new(quoteClaims)
+	_, err := jwt.ParseWithClaims(quote, claims, func(t *jwt.Token) (any, error) {
+		return q.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(quoteAudience),
+		jwt.WithSubject(ride.PassengerID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return quotedFare{}, fmt.Errorf("%w: quote expired, estimate again", domain.Errconflict)
+		}
+		return quotedFare{}, fmt.Errorf("invalid quote: %v", err)
+	}
+	if !near(claims.PickupLat, ride.PickupLatitude) || !near(claims.PickupLng, ride.PickupLongitude) ||
+		!near(claims.DestLat, ride.DestinationLatitude) || !near(claims.DestLng, ride.DestinationLongitude) {
+		return quotedFare{}, fmt.Errorf("invalid quote: route differs from the quoted one")
+	}
+	fare, ok := claims.Fares[ride.RideType]
+	if !ok {
+		return quotedFare{}, fmt.Errorf("invalid quote: no fare for ride type %s", ride.RideType)
+	}
+	return fare, nil
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) <= quoteCoordTolerance
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"taxi-hailing/intenal/domain"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	testQuoteSecret = []byte("quote-secret")
+	testQuoteFares  = map[string]quotedFare{
+		"ECONOMY": {Fare: 1450, TariffID: "economy-v1"},
+		"PREMIUM": {Fare: 2100, TariffID: "premium-v1"},
+	}
+)
+
+func quoteRoute() *domain.FareEstimateRequest {
+	return &domain.FareEstimateRequest{
+		PickupLatitude:       43.238949,
+		PickupLongitude:      76.889709,
+		DestinationLatitude:  43.222015,
+		DestinationLongitude: 76.851511,
+	}
+}
+
+func quotedRide(passengerID, rideType string) *domain.RideRequest {
+	route := quoteRoute()
+	return &domain.RideRequest{
+		PassengerID:          passengerID,
+		PickupLatitude:       route.PickupLatitude,
+		PickupLongitude:      route.PickupLongitude,
+		DestinationLatitude:  route.DestinationLatitude,
+		DestinationLongitude: route.DestinationLongitude,
+		RideType:             rideType,
+	}
+}
+
+func signTestQuote(t *testing.T, q *quoter, passengerID string) string {
+	t.Helper()
+	route := quoteRoute()
+	quote, expiresAt, err := q.sign(passengerID, route, estimateRoute(route.PickupLatitude, route.PickupLongitude, route.DestinationLatitude, route.DestinationLongitude), testQuoteFares)
+	if err != nil {
+		t.Fatalf("sign quote: %v", err)
+	}
+	if time.Until(expiresAt) > quoteTTL || time.Until(expiresAt) < quoteTTL-time.Minute {
+		t.Fatalf("quote expires at %v, want in %v", expiresAt, quoteTTL)
+	}
+	return quote
+}
+
+// resignQuote is a quote signed with secret whose claims were changed by edit
+func resignQuote(t *testing.T, quote string, method jwt.SigningMethod, secret any, edit func(*quoteClaims)) string {
+	t.Helper()
+	claims := new(quoteClaims)
+	_, _, err := jwt.NewParser().ParseUnverified(quote, claims)
+	if err != nil {
+		t.Fatalf("parse quote: %v", err)
+	}
+	edit(claims)
+	signed, err := jwt.NewWithClaims(method, claims).SignedString(secret)
+	if err != nil {
+		t.Fatalf("sign quote: %v", err)
+	}
+	return signed
+}
+
+// tamperQuote changes the claims but keeps the original signature
+func tamperQuote(t *testing.T, quote string, edit func(*quoteClaims)) string {
+	t.Helper()
+	parts := strings.Split(quote, ".")
+	claims := new(quoteClaims)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("decode quote: %v", err)
+	}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		t.Fatalf("unmarshal quote: %v", err)
+	}
+	edit(claims)
+	payload, err = json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal quote: %v", err)
+	}
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestQuoteFare(t *testing.T) {
+	q := &quoter{secret: testQuoteSecret}
+	quote := signTestQuote(t, q, "p1")
+	cheaper := func(c *quoteClaims) {
+		c.Fares["ECONOMY"] = quotedFare{Fare: 1, TariffID: "economy-v1"}
+	}
+
+	tests := []struct {
+		name     string
+		quoter   *quoter
+		quote    string
+		ride     *domain.RideRequest
+		want     quotedFare
+		conflict bool // expired, the client estimates again
+		invalid  bool
+	}{
+		{name: "economy", quoter: q, quote: quote, ride: quotedRide("p1", "ECONOMY"), want: testQuoteFares["ECONOMY"]},
+		{name: "premium", quoter: q, quote: quote, ride: quotedRide("p1", "PREMIUM"), want: testQuoteFares["PREMIUM"]},
+		{
+			name: "rounded coordinates", quoter: q, quote: quote,
+			ride: func() *domain.RideRequest {
+				ride := quotedRide("p1", "ECONOMY")
+				ride.PickupLatitude += quoteCoordTolerance / 2
+				return ride
+			}(),
+			want: testQuoteFares["ECONOMY"],
+		},
+
+		{
+			name: "expired", quoter: q, ride: quotedRide("p1", "ECONOMY"), conflict: true,
+			quote: resignQuote(t, quote, jwt.SigningMethodHS256, testQuoteSecret, func(c *quoteClaims) {
+				c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-quoteTTL - time.Minute))
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+			}),
+		},
+		{
+			name: "no expiry", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true,
+			quote: resignQuote(t, quote, jwt.SigningMethodHS256, testQuoteSecret, func(c *quoteClaims) {
+				c.ExpiresAt = nil
+			}),
+		},
+		{
+			name: "expiry extended without the key", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true,
+			quote: tamperQuote(t, quote, func(c *quoteClaims) {
+				c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(24 * time.Hour))
+			}),
+		},
+		{name: "fare lowered without the key", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true, quote: tamperQuote(t, quote, cheaper)},
+		{
+			name: "route changed without the key", quoter: q, invalid: true,
+			quote: tamperQuote(t, quote, func(c *quoteClaims) { c.DestLat += 1 }),
+			ride: func() *domain.RideRequest {
+				ride := quotedRide("p1", "ECONOMY")
+				ride.DestinationLatitude += 1
+				return ride
+			}(),
+		},
+		{name: "bad signature", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true, quote: quote[:len(quote)-4] + "AAAA"},
+		{name: "not a token", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true, quote: "quote"},
+
+		{name: "signed with another key", quoter: &quoter{secret: []byte("other-secret")}, quote: quote, ride: quotedRide("p1", "ECONOMY"), invalid: true},
+		{
+			name: "fare lowered with another key", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true,
+			quote: resignQuote(t, quote, jwt.SigningMethodHS256, []byte("other-secret"), cheaper),
+		},
+		{
+			name: "other HMAC algorithm", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true,
+			quote: resignQuote(t, quote, jwt.SigningMethodHS512, testQuoteSecret, func(*quoteClaims) {}),
+		},
+		{
+			name: "unsigned", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true,
+			quote: resignQuote(t, quote, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, cheaper),
+		},
+		{
+			name: "other audience", quoter: q, ride: quotedRide("p1", "ECONOMY"), invalid: true,
+			quote: resignQuote(t, quote, jwt.SigningMethodHS256, testQuoteSecret, func(c *quoteClaims) {
+				c.Audience = jwt.ClaimStrings{"ride-service"}
+			}),
+		},
+
+		{name: "another passenger", quoter: q, quote: quote, ride: quotedRide("p2", "ECONOMY"), invalid: true},
+		{
+			name: "other route", quoter: q, quote: quote, invalid: true,
+			ride: func() *domain.RideRequest {
+				ride := quotedRide("p1", "ECONOMY")
+				ride.DestinationLongitude += 0.01
+				return ride
+			}(),
+		},
+		{name: "ride type not quoted", quoter: q, quote: quote, ride: quotedRide("p1", "MINIVAN"), invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.quoter.fare(tt.quote, tt.ride)
+			switch {
+			case tt.conflict:
+				if !errors.Is(err, domain.Errconflict) {
+					t.Errorf("err = %v, want %v", err, domain.Errconflict)
+				}
+			case tt.invalid:
+				if err == nil || errors.Is(err, domain.Errconflict) {
+					t.Errorf("err = %v, want an invalid quote", err)
+				}
+			case err != nil:
+				t.Errorf("fare: %v", err)
+			case got != tt.want:
+				t.Errorf("fare = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
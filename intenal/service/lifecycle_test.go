@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"taxi-hailing/intenal/broker"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/intenal/ws"
+	"taxi-hailing/pkg"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// stepTimeout covers a relay tick and the consumer on the other side
+const stepTimeout = 10 * time.Second
+
+// tokenAuth accepts the token "driver:<id>" or "passenger:<id>" as that user
+type tokenAuth struct{}
+
+func (tokenAuth) Authenticate(ctx context.Context, token string) (*pkg.MyClaims, error) {
+	role, id, ok := strings.Cut(token, ":")
+	if !ok || (role != "driver" && role != "passenger") {
+		return nil, fmt.Errorf("%w: bad test token %q", domain.ErrUnauthorized, token)
+	}
+	return &pkg.MyClaims{UserID: id, Role: strings.ToUpper(role), SessionID: uuid.NewString()}, nil
+}
+
+// rideWorld is both services wired through the memory store and broker, like the binaries are through postgres and rabbit
+type rideWorld struct {
+	store  *repo.MemoryStore
+	mb     *broker.MemoryBroker
+	rides  *RideService
+	driver *DriverService
+	port   uint16
+}
+
+func newRideWorld(t *testing.T) *rideWorld {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	slogger := slog.New(slog.DiscardHandler)
+
+	w := &rideWorld{
+		store: repo.NewMemoryStore(),
+		mb:    broker.NewMemoryBroker(),
+		port:  freePort(t),
+	}
+	hub := ws.NewDriverWebSocket(slogger, tokenAuth{}, w.port)
+	go hub.StartServer()
+	t.Cleanup(func() { hub.CloseServer() })
+	eventually(t, "driver hub is listening", func() bool { return hub.Ready(ctx) == nil })
+
+	w.rides = NewRideService(ctx, slogger, w.store, w.mb.Ride(), ws.NewWebSocket(slogger, tokenAuth{}, 0), []byte("quote-secret"))
+	w.driver = NewDriverService(ctx, slogger, w.store, w.mb.Driver(), hub)
+	NewOutboxRelay(ctx, slogger, w.store, w.mb.PublishOutbox)
+	t.Cleanup(func() { w.mb.CloseRabbit() })
+	return w
+}
+
+// connectDriver opens the driver's websocket and accepts every offer it gets
+func (w *rideWorld) connectDriver(t *testing.T, driverID string, at domain.Location) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/ws/drivers/%s", w.port, driverID), nil)
+	if err != nil {
+		t.Fatalf("dial driver websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	err = conn.WriteJSON(map[string]string{"type": "auth", "token": "driver:" + driverID})
+	if err != nil {
+		t.Fatalf("send auth: %v", err)
+	}
+	hello := make(map[string]any)
+	err = conn.ReadJSON(&hello)
+	if err != nil || hello["msg"] == nil {
+		t.Fatalf("driver not connected: %v %v", hello, err)
+	}
+
+	go func() {
+		for {
+			offer := new(domain.RideOffer)
+			if conn.ReadJSON(offer) != nil {
+				return
+			}
+			if offer.Type != "ride_offer" {
+				continue
+			}
+			conn.WriteJSON(&domain.RideOfferResponse{
+				Type:            "ride_response",
+				OfferID:         offer.OfferID,
+				RideID:          offer.RideID,
+				Accepted:        true,
+				CurrentLocation: domain.OfferLocation{Latitude: at.Lat, Longitude: at.Lng},
+			})
+		}
+	}()
+}
+
+func (w *rideWorld) waitRide(t *testing.T, rideID, status string) {
+	t.Helper()
+	eventually(t, "ride is "+status, func() bool {
+		got, err := w.store.GetRideStatus(context.Background(), rideID)
+		return err == nil && got == status
+	})
+}
+
+func TestRideLifecycle(t *testing.T) {
+	ctx := context.Background()
+	w := newRideWorld(t)
+	pickup := domain.Location{Lat: 43.238949, Lng: 76.889709}
+
+	passengerID, err := w.store.RegisterPassenger(ctx, &domain.User{Name: "Passenger", Email: "passenger@example.com"})
+	if err != nil {
+		t.Fatalf("register passenger: %v", err)
+	}
+	driver := &domain.Driver{Name: "Driver", Email: "driver@example.com", LicenseNumber: "KZ-001", VehicleType: "ECONOMY"}
+	err = w.store.CreateDriver(ctx, driver)
+	if err != nil {
+		t.Fatalf("create driver: %v", err)
+	}
+	driverID := uuid.MustParse(driver.ID)
+	_, err = w.driver.SetToOnline(ctx, driverID, &pickup)
+	if err != nil {
+		t.Fatalf("driver online: %v", err)
+	}
+	w.connectDriver(t, driver.ID, pickup)
+
+	ride, err := w.rides.CreateRide(ctx, &domain.RideRequest{
+		PassengerID:          passengerID,
+		PickupLatitude:       pickup.Lat,
+		PickupLongitude:      pickup.Lng,
+		PickupAddress:        "Abay 10",
+		DestinationLatitude:  43.222015,
+		DestinationLongitude: 76.851248,
+		DestinationAddress:   "Dostyk 5",
+		RideType:             "ECONOMY",
+	})
+	if err != nil {
+		t.Fatalf("create ride: %v", err)
+	}
+	w.waitRide(t, ride.RideID, domain.RideMatched)
+
+	loc := &domain.DriverLocationMessage{RideID: ride.RideID}
+	loc.DriverLocation.Latitude = pickup.Lat
+	loc.DriverLocation.Longitude = pickup.Lng
+	steps := []struct {
+		status string
+		do     func() error
+	}{
+		{domain.RideEnRoute, func() error { _, err := w.driver.EnRoute(ctx, driver.ID, loc); return err }},
+		{domain.RideArrived, func() error { _, err := w.driver.Arrived(ctx, driver.ID, loc); return err }},
+		{domain.RideInProgress, func() error { _, err := w.driver.Start(ctx, driver.ID, loc); return err }},
+		{domain.RideCompleted, func() error {
+			_, err := w.driver.Complete(ctx, driver.ID, &domain.CompleteRideRequest{
+				RideID:                ride.RideID,
+				FinalLocation:         domain.Location{Lat: 43.222015, Lng: 76.851248},
+				ActualDistanceKm:      3.5,
+				ActualDurationMinutes: 10,
+			})
+			return err
+		}},
+	}
+	for _, step := range steps {
+		err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.status, err)
+		}
+		w.waitRide(t, ride.RideID, step.status)
+	}
+
+	passenger, err := w.store.GetUserByID(ctx, passengerID)
+	if err != nil {
+		t.Fatalf("get passenger: %v", err)
+	}
+	if passenger.Status != "INACTIVE" {
+		t.Errorf("passenger status = %s, want INACTIVE after the ride", passenger.Status)
+	}
+	for _, queue := range []string{broker.QueueRideRequests, broker.QueueDriverResponses, broker.QueueRideStatus, broker.QueueDriverStatus} {
+		if dead := w.mb.DeadLetters(queue); len(dead) > 0 {
+			t.Errorf("%s has dead letters: %+v", queue, dead)
+		}
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(stepTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("free port: %v", err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
+	"time"
+)
+
+const (
+	locationPublishInterval = 3 * time.Second
+	locationPublishTimeout  = 5 * time.Second
+)
+
+// locationThrottler publishes at most one location per driver per interval.
+// Updates that come in between are coalesced, only the latest one is sent when the interval ends.
+type locationThrottler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	drivers  map[string]*driverLocationState
+	publish  func(ctx context.Context, loc *domain.DriverLocationUpdate) error
+	onError  func(loc *domain.DriverLocationUpdate, err error)
+}
+
+type driverLocationState struct {
+	lastSent time.Time
+	pending  *domain.DriverLocationUpdate
+	timer    *time.Timer
+}
+
+func newLocationThrottler(interval time.Duration, publish func(ctx context.Context, loc *domain.DriverLocationUpdate) error, onError func(loc *domain.DriverLocationUpdate, err error)) *locationThrottler {
+	return &locationThrottler{
+		interval: interval,
+		drivers:  make(map[string]*driverLocationState),
+		publish:  publish,
+		onError:  onError,
+	}
+}
+
+func (t *locationThrottler) push(loc *domain.DriverLocationUpdate) {
+	t.mu.Lock()
+	st, ok := t.drivers[loc.DriverID]
+	if !ok {
+		st = new(driverLocationState)
+		t.drivers[loc.DriverID] = st
+	}
+	wait := t.interval - time.Since(st.lastSent)
+	if wait <= 0 && st.timer == nil {
+		st.lastSent = time.Now()
+		t.mu.Unlock()
+		t.send(loc)
+		return
+	}
+	st.pending = loc
+	if st.timer == nil {
+		st.timer = time.AfterFunc(wait, func() { t.flush(loc.DriverID) })
+	}
+	t.mu.Unlock()
+}
+
+func (t *locationThrottler) flush(driverID string) {
+	t.mu.Lock()
+	st, ok := t.drivers[driverID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	loc := st.pending
+	st.pending = nil
+	st.timer = nil
+	st.lastSent = time.Now()
+	t.mu.Unlock()
+	if loc != nil {
+		t.send(loc)
+	}
+}
+
+// forget drops the driver state, e.g. when the ride is over
+func (t *locationThrottler) forget(driverID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.drivers[driverID]
+	if !ok {
+		return
+	}
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	delete(t.drivers, driverID)
+}
+
+func (t *locationThrottler) send(loc *domain.DriverLocationUpdate) {
+	ctx, cancel := context.WithTimeout(pkg.WithCorrelationID(context.Background(), loc.CorrelationID), locationPublishTimeout)
+	defer cancel()
+	err := t.publish(ctx, loc)
+	if err != nil {
+		t.onError(loc, err)
+	}
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSearchRadiusKM = 5.0
+	candidateLimit        = 10
+	matchRetryInterval    = 5 * time.Second
+	matchingWindow        = 2 * time.Minute
+	defaultOfferTimeout   = 30 * time.Second
+	reservationTTL        = 45 * time.Second
+	driverShare           = 0.8
+)
+
+// match results of the metric
+const (
+	matchMatched   = "matched"
+	matchCancelled = "cancelled"
+	matchFailed    = "failed"
+)
+
+func (d *DriverService) rideMatcher(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-d.rabbit.GiveReqChannel():
+			mctx := consume(ctx, v, "ride request")
+			req, err := v.GiveBody()
+			if err != nil {
+				d.slogger.ErrorContext(mctx, "canot get the body of ride request", "action", "get body", "error", err)
+				reject(mctx, d.slogger, v, err)
+				continue
+			}
+			// a re-delivered request must not start a second matcher for the ride
+			if _, running := d.matching.LoadOrStore(req.RideID, struct{}{}); running {
+				d.slogger.InfoContext(mctx, "ride is already being matched", "action", "match ride", "ride_id", req.RideID)
+				settle(mctx, d.slogger, v, nil)
+				continue
+			}
+			// the request is acked only when matching is over: matched, or cancelled for no driver
+			go func() {
+				defer d.matching.Delete(req.RideID)
+				err := d.matchRide(mctx, req)
+				if err != nil {
+					d.slogger.ErrorContext(mctx, "cannot match the ride", "action", "match ride", "ride_id", req.RideID, "error", err)
+				}
+				settle(mctx, d.slogger, v, err)
+			}()
+		}
+	}
+}
+
+// matchRide offers the ride to candidates one by one until somebody accepts
+// or the matching window is over, then the ride is cancelled for no driver
+func (d *DriverService) matchRide(ctx context.Context, req *domain.RideRequestRabbit) error {
+	// a request re-delivered after its ride was matched or cancelled has nothing to do
+	status, err := d.db.GetRideStatus(ctx, req.RideID)
+	if err != nil {
+		return err
+	}
+	if status != domain.RideRequested {
+		d.slogger.InfoContext(ctx, "ride is no longer requested, skip the request", "action", "match ride", "ride_id", req.RideID, "status", status)
+		return nil
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, matchingWindow)
+	defer cancel()
+	start := time.Now()
+	result := matchFailed
+	defer func() {
+		metrics.MatchDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	declined := make(map[string]struct{})
+	ticker := time.NewTicker(matchRetryInterval)
+	defer ticker.Stop()
+	for {
+		candidates, err := d.findCandidates(ctx, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return d.noDriver(parent, req)
+			}
+			return err
+		}
+		for i := range candidates {
+			c := &candidates[i]
+			if _, ok := declined[c.DriverID]; ok {
+				continue
+			}
+			// passenger may cancel while we are looking for a driver
+			status, err := d.db.GetRideStatus(ctx, req.RideID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return d.noDriver(parent, req)
+				}
+				return err
+			}
+			if status != domain.RideRequested {
+				d.slogger.InfoContext(ctx, "ride is no longer requested, stop matching", "action", "match ride", "ride_id", req.RideID, "status", status)
+				result = matchCancelled
+				return nil
+			}
+			if !d.reserve(c.DriverID, req.RideID) {
+				continue
+			}
+			res, err := d.offerRide(ctx, req, c)
+			metrics.RideOffers.WithLabelValues(offerResult(res, err)).Inc()
+			if err == nil && res.Accepted {
+				// keep him reserved until the ride service writes rides.driver_id
+				d.reserved.Store(c.DriverID, reservation{rideID: req.RideID, at: time.Now()})
+				if res.CurrentLocation.Latitude != 0 || res.CurrentLocation.Longitude != 0 {
+					c.Location = domain.Location{Lat: res.CurrentLocation.Latitude, Lng: res.CurrentLocation.Longitude}
+				}
+				// the window may be over by now, the accept must still reach the ride service
+				err = d.publishMatch(parent, req, c)
+				if err == nil {
+					result = matchMatched
+				}
+				return err
+			}
+			d.unreserve(c.DriverID, req.RideID)
+			if ctx.Err() != nil {
+				return d.noDriver(parent, req)
+			}
+			switch {
+			case err == nil:
+				d.slogger.InfoContext(ctx, "driver declined the offer", "action", "offer ride", "ride_id", req.RideID, "driver_id", c.DriverID)
+				declined[c.DriverID] = struct{}{}
+			case errors.Is(err, domain.ErrOfferTimeout):
+				d.slogger.InfoContext(ctx, "driver did not answer the offer", "action", "offer ride", "ride_id", req.RideID, "driver_id", c.DriverID)
+				declined[c.DriverID] = struct{}{}
+			default:
+				d.slogger.DebugContext(ctx, "cannot offer the ride", "action", "offer ride", "ride_id", req.RideID, "driver_id", c.DriverID, "error", err)
+			}
+		}
+		d.slogger.InfoContext(ctx, "no driver accepted, retrying", "action", "match ride", "ride_id", req.RideID)
+		select {
+		case <-ctx.Done():
+			return d.noDriver(parent, req)
+		case <-ticker.C:
+		}
+	}
+}
+
+// noDriver asks the ride service to cancel the ride nobody accepted within the matching window.
+// A window cut short by the shutdown is not over, the request is redelivered to the next instance.
+func (d *DriverService) noDriver(ctx context.Context, req *domain.RideRequestRabbit) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	d.slogger.InfoContext(ctx, "no driver found, cancelling the ride", "action", "match ride", "ride_id", req.RideID)
+	return d.db.EnqueueNoDriver(ctx, &domain.RideStatusUpdate{
+		RideID:        req.RideID,
+		Status:        domain.RideCancelled,
+		Timestamp:     time.Now(),
+		CorrelationID: req.CorrelationID,
+		Reason:        domain.CancelReasonNoDriver,
+	})
+}
+
+// offerResult is the label of the offer metric
+func offerResult(res *domain.RideOfferResponse, err error) string {
+	switch {
+	case err == nil && res.Accepted:
+		return "accepted"
+	case err == nil:
+		return "declined"
+	case errors.Is(err, domain.ErrOfferTimeout):
+		return "timeout"
+	}
+	return "error"
+}
+
+func (d *DriverService) findCandidates(ctx context.Context, req *domain.RideRequestRabbit) ([]domain.DriverCandidate, error) {
+	radius := req.MaxDistanceKM
+	if radius <= 0 {
+		radius = defaultSearchRadiusKM
+	}
+	pickup := &domain.Location{Lat: req.PickupLocation.Lat, Lng: req.PickupLocation.Lng}
+	return d.db.FindNearbyDrivers(ctx, req.RideType, pickup, radius, candidateLimit)
+}
+
+func (d *DriverService) offerRide(ctx context.Context, req *domain.RideRequestRabbit, c *domain.DriverCandidate) (*domain.RideOfferResponse, error) {
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultOfferTimeout
+	}
+	offer := &domain.RideOffer{
+		Type:       "ride_offer",
+		OfferID:    uuid.NewString(),
+		RideID:     req.RideID,
+		RideNumber: req.RideNumber,
+		PickupLocation: domain.OfferLocation{
+			Latitude:  req.PickupLocation.Lat,
+			Longitude: req.PickupLocation.Lng,
+			Address:   req.PickupLocation.Address,
+		},
+		DestinationLocation: domain.OfferLocation{
+			Latitude:  req.DestinationLocation.Lat,
+			Longitude: req.DestinationLocation.Lng,
+			Address:   req.DestinationLocation.Address,
+		},
+		EstimatedFare:      req.EstimatedFare,
+		DriverEarnings:     req.EstimatedFare * driverShare,
+		DistanceToPickupKM: c.DistanceKM,
+		ExpiresAt:          time.Now().Add(timeout),
+		CorrelationID:      req.CorrelationID,
+	}
+	return d.ws.SendOffer(ctx, c.DriverID, offer)
+}
+
+// reservation holds a driver for one ride
+type reservation struct {
+	rideID string
+	at     time.Time
+}
+
+// reserve holds the driver while he has an offer, so parallel requests do not pick him
+func (d *DriverService) reserve(driverID, rideID string) bool {
+	now := reservation{rideID: rideID, at: time.Now()}
+	old, loaded := d.reserved.LoadOrStore(driverID, now)
+	if !loaded {
+		return true
+	}
+	if now.at.Sub(old.(reservation).at) < reservationTTL {
+		return false
+	}
+	return d.reserved.CompareAndSwap(driverID, old, now)
+}
+
+// unreserve frees the driver held for the ride, a reservation for another ride stays
+func (d *DriverService) unreserve(driverID, rideID string) {
+	old, ok := d.reserved.Load(driverID)
+	if ok && old.(reservation).rideID == rideID {
+		d.reserved.CompareAndDelete(driverID, old)
+	}
+}
+
+// sweepReservations drops reservations older than reservationTTL. reserve takes over a stale one anyway,
+// this only keeps drivers whose match never reached the ride (e.g. the ride was cancelled) from piling up.
+func (d *DriverService) sweepReservations(ctx context.Context) {
+	ticker := time.NewTicker(reservationTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.reserved.Range(func(driverID, r any) bool {
+				if now.Sub(r.(reservation).at) >= reservationTTL {
+					d.reserved.CompareAndDelete(driverID, r)
+				}
+				return true
+			})
+		}
+	}
+}
+
+func (d *DriverService) publishMatch(ctx context.Context, req *domain.RideRequestRabbit, c *domain.DriverCandidate) error {
+	pickupKM := distanceKM(c.Location.Lat, c.Location.Lng, req.PickupLocation.Lat, req.PickupLocation.Lng)
+	arrivalMin := int(pickupKM / avgSpeed * 60)
+	match := &domain.RideResponseMatch{
+		RideID:              req.RideID,
+		DriverID:            c.DriverID,
+		Accepted:            true,
+		EstimatedArrivalMin: arrivalMin,
+		DriverLocation:      c.Location,
+		DriverInfo: domain.DriverInfo{
+			Name:    c.Name,
+			Rating:  c.Rating,
+			Vehicle: c.Vehicle,
+		},
+		CorrelationID:    req.CorrelationID,
+		EstimatedArrival: time.Now().Add(time.Duration(arrivalMin) * time.Minute),
+	}
+	err := d.db.EnqueueMatch(ctx, match)
+	if err != nil {
+		d.unreserve(c.DriverID, req.RideID)
+		return err
+	}
+	d.slogger.InfoContext(ctx, "driver matched", "action", "match ride", "ride_id", req.RideID, "driver_id", c.DriverID, "distance_km", pickupKM)
+	return nil
+}
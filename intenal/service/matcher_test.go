@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"taxi-hailing/intenal/domain"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// noDriverStatuses returns the cancellations for no driver waiting in the outbox
+func (w *transitionWorld) noDriverStatuses(t *testing.T) []*domain.RideStatusUpdate {
+	t.Helper()
+	var statuses []*domain.RideStatusUpdate
+	for _, msg := range w.store.Pending() {
+		if msg.RoutingKey != "ride.status."+domain.RideCancelled {
+			continue
+		}
+		status := new(domain.RideStatusUpdate)
+		err := json.Unmarshal(msg.Payload, status)
+		if err != nil {
+			t.Fatalf("decode %s: %v", msg.RoutingKey, err)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func TestNoDriverCancelsRide(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		want error
+		to   string
+	}{
+		{"requested", domain.RideRequested, nil, domain.RideCancelled},
+		{"passenger cancelled meanwhile", domain.RideCancelled, nil, domain.RideCancelled},
+		{"matched meanwhile", domain.RideMatched, domain.ErrInvalidTransition, domain.RideMatched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTransitionWorld(t)
+			w.reach(t, tt.from)
+
+			err := w.drivers.noDriver(w.ctx, &domain.RideRequestRabbit{RideID: w.rideID})
+			if err != nil {
+				t.Fatalf("no driver: %v", err)
+			}
+			statuses := w.noDriverStatuses(t)
+			if len(statuses) != 1 || statuses[0].RideID != w.rideID || statuses[0].Reason != domain.CancelReasonNoDriver {
+				t.Fatalf("outbox has %+v, want one cancellation for %s", statuses, domain.CancelReasonNoDriver)
+			}
+			err = w.rides.statusUpdate(w.ctx, statuses[0])
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			w.checkRide(t, tt.to)
+			if tt.to != domain.RideCancelled {
+				return
+			}
+			// the passenger may book again
+			passenger, err := w.store.GetUserByID(w.ctx, w.passengerID)
+			if err != nil {
+				t.Fatalf("get passenger: %v", err)
+			}
+			if passenger.Status != "INACTIVE" {
+				t.Errorf("passenger is %s, want INACTIVE", passenger.Status)
+			}
+			// a redelivered cancellation is applied already
+			err = w.rides.statusUpdate(w.ctx, statuses[0])
+			if err != nil {
+				t.Errorf("redelivered cancellation: %v", err)
+			}
+		})
+	}
+}
+
+func TestShutdownIsNotNoDriver(t *testing.T) {
+	w := newTransitionWorld(t)
+	ctx, cancel := context.WithCancel(w.ctx)
+	cancel()
+
+	err := w.drivers.matchRide(ctx, &domain.RideRequestRabbit{
+		RideID:         w.rideID,
+		RideType:       "ECONOMY",
+		PickupLocation: domain.Coordinates{Lat: 43.238949, Lng: 76.889709},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("matching cut by the shutdown = %v, want %v", err, context.Canceled)
+	}
+	if statuses := w.noDriverStatuses(t); len(statuses) > 0 {
+		t.Errorf("shutdown cancelled the ride: %+v", statuses)
+	}
+	w.checkRide(t, domain.RideRequested)
+}
+
+// matchLostStatus is the release the ride service sent the driver for the ride
+func (w *transitionWorld) matchLostStatus(t *testing.T, driverID string) *domain.RideStatusUpdate {
+	t.Helper()
+	for _, msg := range w.store.Pending() {
+		status := new(domain.RideStatusUpdate)
+		if msg.RoutingKey == "driver.status."+driverID && json.Unmarshal(msg.Payload, status) == nil && status.RideID == w.rideID {
+			return status
+		}
+	}
+	t.Fatalf("driver %s was not told the accept lost", driverID)
+	return nil
+}
+
+func TestMatchLostFreesDriver(t *testing.T) {
+	w := newTransitionWorld(t)
+	loser := w.newDriver(t, 2)
+	if !w.drivers.reserve(loser, w.rideID) {
+		t.Fatalf("cannot reserve the driver")
+	}
+	w.reach(t, domain.RideMatched)
+
+	err := w.match(loser)
+	if !errors.Is(err, domain.ErrMatchLost) {
+		t.Fatalf("accept of the second driver = %v, want %v", err, domain.ErrMatchLost)
+	}
+	err = w.drivers.statusUpdate(w.ctx, w.matchLostStatus(t, loser))
+	if err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, held := w.drivers.reserved.Load(loser); held {
+		t.Errorf("driver is still reserved after the accept lost")
+	}
+	if !w.drivers.reserve(loser, uuid.NewString()) {
+		t.Errorf("driver cannot be offered another ride")
+	}
+}
+
+func TestReleaseIsRideScoped(t *testing.T) {
+	w := newTransitionWorld(t)
+	w.reach(t, domain.RideEnRoute)
+	other := uuid.NewString()
+	w.drivers.reserve(w.driverID, other)
+
+	// a late release for a ride the driver is not on
+	err := w.drivers.statusUpdate(w.ctx, &domain.RideStatusUpdate{
+		RideID:   other,
+		Status:   domain.RideCancelled,
+		DriverID: w.driverID,
+		Reason:   domain.CancelReasonMatchLost,
+	})
+	if err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	// still EN_ROUTE to the pickup, otherwise arriving fails
+	err = w.arrived(w.driverID)
+	if err != nil {
+		t.Errorf("driver was released from the own ride: %v", err)
+	}
+
+	w.drivers.reserve(w.driverID, w.rideID)
+	err = w.drivers.statusUpdate(w.ctx, &domain.RideStatusUpdate{RideID: uuid.NewString(), Status: domain.RideCancelled, DriverID: w.driverID})
+	if err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if r, held := w.drivers.reserved.Load(w.driverID); !held || r.(reservation).rideID != w.rideID {
+		t.Errorf("reservation for the ride was freed by the release of another one")
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/repo"
+	"time"
+)
+
+const (
+	outboxRelayInterval  = 500 * time.Millisecond
+	outboxBatchSize      = 100
+	outboxPublishTimeout = 5 * time.Second
+	outboxRetention      = 24 * time.Hour
+	outboxPurgeInterval  = time.Hour
+	// other relays skip a claimed batch for this long, well over publishing one
+	outboxLease = time.Minute
+)
+
+// OutboxRelay publishes messages saved in the outbox table, so rides and statuses
+// committed in db reach rabbit at least once even if rabbit was down at that moment
+type OutboxRelay struct {
+	slogger *slog.Logger
+	db      repo.OutboxStore
+	publish func(context.Context, *domain.OutboxMessage) error
+}
+
+func NewOutboxRelay(ctx context.Context, slogger *slog.Logger, db repo.OutboxStore, publish func(context.Context, *domain.OutboxMessage) error) *OutboxRelay {
+	relay := &OutboxRelay{
+		slogger: slogger,
+		db:      db,
+		publish: publish,
+	}
+	go relay.run(ctx)
+	return relay
+}
+
+func (o *OutboxRelay) run(ctx context.Context) {
+	ticker := time.NewTicker(outboxRelayInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(outboxPurgeInterval)
+	defer purge.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.relay(ctx)
+		case <-purge.C:
+			n, err := o.db.PurgeSent(ctx, outboxRetention)
+			if err != nil {
+				o.slogger.Error("cannot purge outbox", "action", "purge outbox", "error", err)
+				continue
+			}
+			o.slogger.Info("outbox purged", "action", "purge outbox", "deleted", n)
+		}
+	}
+}
+
+// relay drains the outbox batch by batch, on error the rest waits for the next tick
+func (o *OutboxRelay) relay(ctx context.Context) {
+	for {
+		n, err := o.db.Relay(ctx, outboxBatchSize, outboxLease, o.publishWithTimeout)
+		if err != nil {
+			o.slogger.Error("cannot relay outbox", "action", "relay outbox", "sent", n, "error", err)
+			return
+		}
+		if n < outboxBatchSize {
+			return
+		}
+	}
+}
+
+func (o *OutboxRelay) publishWithTimeout(ctx context.Context, msg *domain.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	defer cancel()
+	return o.publish(ctx, msg)
+}
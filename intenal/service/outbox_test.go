@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/repo"
+	"testing"
+	"time"
+)
+
+// enqueueMatches enqueues matches of the rides named by the letters
+func enqueueMatches(t *testing.T, store *repo.MemoryStore, rides string) {
+	t.Helper()
+	for _, ride := range rides {
+		err := store.EnqueueMatch(context.Background(), &domain.RideResponseMatch{RideID: string(ride)})
+		if err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+}
+
+// TestRelayPublishesOutsideTheLock checks a slow publish holds neither writers nor other relays,
+// and a claimed batch is not published twice
+func TestRelayPublishesOutsideTheLock(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryStore()
+	enqueueMatches(t, store, "ab")
+
+	publishing := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := store.Relay(ctx, 10, outboxLease, func(context.Context, *domain.OutboxMessage) error {
+			select {
+			case publishing <- struct{}{}:
+			default:
+			}
+			<-release
+			return nil
+		})
+		done <- err
+	}()
+	<-publishing
+
+	// a writer is not blocked by the publish
+	enqueueMatches(t, store, "c")
+	// another relay gets only the message the first one did not claim
+	var published []string
+	n, err := store.Relay(ctx, 10, outboxLease, func(_ context.Context, msg *domain.OutboxMessage) error {
+		published = append(published, msg.RoutingKey)
+		return nil
+	})
+	if err != nil || n != 1 || len(published) != 1 || published[0] != "driver.response.c" {
+		t.Errorf("second relay published %v (%d, %v), want only the new message", published, n, err)
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("first relay: %v", err)
+		}
+	case <-time.After(stepTimeout):
+		t.Fatalf("first relay did not finish")
+	}
+	if pending := store.Pending(); len(pending) != 0 {
+		t.Errorf("pending after both relays: %v", pending)
+	}
+}
+
+func TestRelayFailureKeepsOrder(t *testing.T) {
+	ctx := context.Background()
+	store := repo.NewMemoryStore()
+	enqueueMatches(t, store, "abc")
+
+	calls := 0
+	n, err := store.Relay(ctx, 10, outboxLease, func(context.Context, *domain.OutboxMessage) error {
+		calls++
+		if calls == 2 {
+			return errors.New("rabbit is down")
+		}
+		return nil
+	})
+	if err == nil || n != 1 {
+		t.Fatalf("relay = %d, %v, want 1 sent and the publish error", n, err)
+	}
+
+	// the failed message and the rest of the batch are not held by the lease
+	var published []string
+	n, err = store.Relay(ctx, 10, outboxLease, func(_ context.Context, msg *domain.OutboxMessage) error {
+		published = append(published, msg.RoutingKey)
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("retry relay = %d, %v", n, err)
+	}
+	want := []string{"driver.response.b", "driver.response.c"}
+	if len(published) != 2 || published[0] != want[0] || published[1] != want[1] {
+		t.Errorf("retry published %v, want %v", published, want)
+	}
+}
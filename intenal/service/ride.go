@@ -2,33 +2,43 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"math"
+	"slices"
 	"taxi-hailing/intenal/broker"
 	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
 	"taxi-hailing/intenal/repo"
 	"taxi-hailing/intenal/ws"
+	"taxi-hailing/pkg"
 	"time"
 )
 
 const (
-	avgSpeed = 40.0 // км/ч
+	avgSpeed            = 40.0 // км/ч
+	maxPickupDistanceKM = 5.0
+	offerTimeoutSeconds = 30
 )
 
 type RideService struct {
 	slogger *slog.Logger
-	db      *repo.RideRepo
-	rabbit  *broker.RideBroker
+	db      repo.RideStore
+	rabbit  broker.RideConsumer
 	ws      *ws.PassengerHub
+	quotes  *quoter
 }
 
-func NewRideService(ctx context.Context, slogger *slog.Logger, db *repo.RideRepo, rabbit *broker.RideBroker, ws *ws.PassengerHub) *RideService {
+// quoteSecret signs fare quotes, every ride service instance needs the same one
+func NewRideService(ctx context.Context, slogger *slog.Logger, db repo.RideStore, rabbit broker.RideConsumer, ws *ws.PassengerHub, quoteSecret []byte) *RideService {
 	service := &RideService{
 		slogger: slogger,
 		db:      db,
 		rabbit:  rabbit,
 		ws:      ws,
+		quotes:  &quoter{secret: quoteSecret},
 	}
 	go service.statusUpdater(ctx)
 	go service.rideMatcherService(ctx)
@@ -36,37 +46,61 @@ func NewRideService(ctx context.Context, slogger *slog.Logger, db *repo.RideRepo
 	return service
 }
 
-func (s *RideService) RegisterPassenger(ctx context.Context, user *domain.User) (string, error) {
-	defer s.slogger.Info("new passenger registred", "action", "registration passenger")
-	return s.db.RegisterPassenger(ctx, user)
-}
-
-func (s *RideService) GetUserByEmail(ctx context.Context, email string) (*domain.User, error) {
-	return s.db.GetUserByEmail(ctx, email)
+// Estimate prices the route for every ride type without booking anything. The signed quote
+// lets CreateRide charge exactly these fares while it is valid.
+func (s *RideService) Estimate(ctx context.Context, passengerID string, req *domain.FareEstimateRequest) (*domain.FareEstimateResponse, error) {
+	tariffs, err := s.db.ActiveTariffs(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	route := estimateRoute(req.PickupLatitude, req.PickupLongitude, req.DestinationLatitude, req.DestinationLongitude)
+	res := &domain.FareEstimateResponse{
+		EstimatedDistanceKM:      route.distanceKM,
+		EstimatedDurationMinutes: int(route.durationMin),
+		Estimates:                make([]domain.FareEstimate, 0, len(tariffs)),
+	}
+	fares := make(map[string]quotedFare, len(tariffs))
+	for _, rideType := range slices.Sorted(maps.Keys(tariffs)) {
+		t := tariffs[rideType]
+		fare := t.Estimate(route.distanceKM, route.durationMin)
+		fares[rideType] = quotedFare{Fare: fare, TariffID: t.ID}
+		res.Estimates = append(res.Estimates, domain.FareEstimate{
+			RideType:      rideType,
+			EstimatedFare: fare,
+			BaseFare:      t.BaseFare,
+			BookingFee:    t.BookingFee,
+			MinFare:       t.MinFare,
+			Currency:      t.Currency,
+			TariffVersion: t.Version,
+		})
+	}
+	res.Quote, res.ExpiresAt, err = s.quotes.sign(passengerID, req, route, fares)
+	if err != nil {
+		return nil, err
+	}
+	s.slogger.DebugContext(ctx, "fare estimated", "action", "estimate fare", "passenger_id", passengerID, "distance_km", route.distanceKM)
+	return res, nil
 }
 
 func (s *RideService) CreateRide(ctx context.Context, ride *domain.RideRequest) (*domain.RideResponse, error) {
-	distance_km := distanceKM(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	duration_min := distance_km / avgSpeed * 60
-	base_fare, rate_per_km, rate_per_min, priority := giveTypesFare(ride.RideType)
-	fare := base_fare + (distance_km * rate_per_km) + (duration_min * rate_per_min)
+	route := estimateRoute(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	tariff, fare, err := s.rideTariff(ctx, ride, route)
+	if err != nil {
+		return nil, err
+	}
 
-	ride.Priority = uint(priority)
+	ride.Priority = uint(tariff.Priority)
 	res := &domain.RideResponse{
-		EstimatedDistanceKM:      distance_km,
-		EstimatedDurationMinutes: int(duration_min),
+		EstimatedDistanceKM:      route.distanceKM,
+		EstimatedDurationMinutes: int(route.durationMin),
 		EstimatedFare:            fare,
-		BaseFare:                 base_fare,
-	}
-
-	err := s.db.CreateRideTx(ctx, ride, res)
-	if err != nil {
-		return nil, err
+		Currency:                 tariff.Currency,
+		TariffID:                 tariff.ID,
+		TariffVersion:            tariff.Version,
+		BaseFare:                 tariff.Start(),
 	}
 
 	req := &domain.RideRequestRabbit{
-		RideID:     res.RideID,
-		RideNumber: res.RideNumber,
 		PickupLocation: domain.Coordinates{
 			Lat:     ride.PickupLatitude,
 			Lng:     ride.PickupLongitude,
@@ -79,32 +113,80 @@ func (s *RideService) CreateRide(ctx context.Context, ride *domain.RideRequest)
 		},
 		RideType:       ride.RideType,
 		EstimatedFare:  fare,
-		MaxDistanceKM:  distance_km,
-		TimeoutSeconds: 2,
-		CorrelationID:  "dd",
+		MaxDistanceKM:  maxPickupDistanceKM,
+		TimeoutSeconds: offerTimeoutSeconds,
+		CorrelationID:  correlationID(ctx),
 	}
-	s.rabbit.PublishRide(ctx, priority, req)
+	// the request is published by the outbox relay after the ride is committed
+	err = s.db.CreateRideTx(ctx, ride, res, req)
+	if err != nil {
+		return nil, err
+	}
+	metrics.RidesCreated.WithLabelValues(vehicleLabel(ride.RideType)).Inc()
+	s.slogger.InfoContext(pkg.WithCorrelationID(ctx, req.CorrelationID), "ride requested", "action", "create ride", "ride_id", res.RideID, "ride_number", res.RideNumber)
 	return res, nil
 }
 
-func (s *RideService) statusUpdater(ctx context.Context) {
-	for v := range s.rabbit.GiveStatusChannel() {
-		status, err := v.GiveBody()
+// rideTariff is the tariff pricing a new ride and its estimated fare: the quoted ones if the
+// ride has a quote, otherwise the tariff in effect now
+func (s *RideService) rideTariff(ctx context.Context, ride *domain.RideRequest, route routeEstimate) (*domain.Tariff, float64, error) {
+	if ride.Quote != "" {
+		quoted, err := s.quotes.fare(ride.Quote, ride)
 		if err != nil {
-			s.slogger.Error("canot get the body of status ride", "action", "get body", "error", err)
-			continue
+			return nil, 0, err
 		}
-		err = s.statusUpdate(ctx, status)
+		tariff, err := s.db.GetTariff(ctx, quoted.TariffID)
 		if err != nil {
-			s.slogger.Error("cannot update status to "+status.Status, "action", "update status", "error", err)
+			return nil, 0, err
+		}
+		return tariff, quoted.Fare, nil
+	}
+	tariffs, err := s.db.ActiveTariffs(ctx, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	tariff, ok := tariffs[ride.RideType]
+	if !ok {
+		return nil, 0, fmt.Errorf("no tariff for ride type %s", ride.RideType)
+	}
+	return tariff, tariff.Estimate(route.distanceKM, route.durationMin), nil
+}
+
+func (s *RideService) statusUpdater(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-s.rabbit.GiveStatusChannel():
+			mctx := consume(ctx, v, "ride status")
+			status, err := v.GiveBody()
+			if err != nil {
+				s.slogger.ErrorContext(mctx, "canot get the body of status ride", "action", "get body", "error", err)
+				reject(mctx, s.slogger, v, err)
+				continue
+			}
+			err = s.statusUpdate(mctx, status)
+			if err != nil {
+				s.slogger.ErrorContext(mctx, "cannot update status to "+status.Status, "action", "update status", "error", err)
+			}
+			settle(mctx, s.slogger, v, err)
 		}
 	}
 }
 
 func (s *RideService) statusUpdate(ctx context.Context, status *domain.RideStatusUpdate) error {
+	current, err := s.db.GetRideStatus(ctx, status.RideID)
+	if err != nil {
+		return err
+	}
+	if current == status.Status {
+		// a re-delivered status: it is applied and the passenger knows already
+		s.slogger.InfoContext(ctx, "ride is already "+current, "action", "update status", "ride_id", status.RideID)
+		return nil
+	}
 	passengerID, err := s.db.GetPassengerIDByRideID(ctx, status.RideID)
 	if err != nil {
-		s.slogger.Error("cannnot get passenger id", "error", err)
+		s.slogger.ErrorContext(ctx, "cannnot get passenger id", "error", err)
 		return err
 	}
 	answerWS := &domain.RideStatusUpdate{
@@ -114,60 +196,95 @@ func (s *RideService) statusUpdate(ctx context.Context, status *domain.RideStatu
 		DriverID:      status.DriverID,
 		CorrelationID: status.CorrelationID,
 	}
-	defer s.ws.GiveToPassenger(passengerID, answerWS)
 	switch status.Status {
 	// case "MATCHED":
 	// 	return s.db.RideMatchedUpdate(ctx, status)
 	// 	// s.ws.GiveToPassenger(sta)
-	case "EN_ROUTE":
-		return s.db.RideEnRouteUpdate(ctx, status)
-	case "ARRIVED":
-		return s.db.RideArrivedUpdate(ctx, status)
-	case "IN_PROGRESS":
-		return s.db.RideInProgressUpdate(ctx, status)
-	case "COMPLETED":
-		return s.db.RideCompleteUpdate(ctx, status)
+	case domain.RideEnRoute:
+		err = s.db.RideEnRouteUpdate(ctx, status)
+	case domain.RideArrived:
+		err = s.db.RideArrivedUpdate(ctx, status)
+	case domain.RideInProgress:
+		err = s.db.RideInProgressUpdate(ctx, status)
+	case domain.RideCompleted:
+		err = s.db.RideCompleteUpdate(ctx, status)
+		if err == nil {
+			s.rideCompleted(ctx, status.RideID)
+		}
+	case domain.RideCancelled:
+		// only the driver service cancels through here, when nobody accepted the ride
+		err = s.db.RideNoDriverUpdate(ctx, status)
+		if err == nil {
+			metrics.RidesCancelled.Inc()
+		}
 	default:
-		return fmt.Errorf("invalid status: %s", status.Status)
+		return fmt.Errorf("%w: invalid status: %s", domain.Errconflict, status.Status)
 	}
+	if err != nil {
+		return err
+	}
+	// only a status the ride took, a failed one is retried or dropped and the passenger would see it twice or wrongly
+	s.ws.GiveToPassenger(passengerID, answerWS)
+	return nil
 }
 
 func (s *RideService) rideMatcherService(ctx context.Context) {
-	for v := range s.rabbit.GiveResponeChannel() {
-		res, err := v.GiveBody()
-		if err != nil {
-			s.slogger.Error("canot get the body of respone driver", "action", "get body", "error", err)
-			continue
-		}
-		err = s.rideMatched(ctx, res)
-		if err != nil {
-			s.slogger.Error("cannot update to match status", "action", "update status", "error", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-s.rabbit.GiveResponeChannel():
+			mctx := consume(ctx, v, "driver response")
+			res, err := v.GiveBody()
+			if err != nil {
+				s.slogger.ErrorContext(mctx, "canot get the body of respone driver", "action", "get body", "error", err)
+				reject(mctx, s.slogger, v, err)
+				continue
+			}
+			err = s.rideMatched(mctx, res)
+			if err != nil {
+				s.slogger.ErrorContext(mctx, "cannot update to match status", "action", "update status", "error", err)
+			}
+			settle(mctx, s.slogger, v, err)
 		}
 	}
 }
 
 func (s *RideService) rideMatched(ctx context.Context, match *domain.RideResponseMatch) error {
+	current, err := s.db.GetRideStatus(ctx, match.RideID)
+	if err != nil {
+		return err
+	}
+	if current != domain.RideRequested {
+		// a re-delivered match, RideMatchedUpdate tells it from the accept of a driver who lost
+		// the ride to another one or to a cancel, that driver is released
+		err = s.db.RideMatchedUpdate(ctx, match)
+		if err == nil {
+			s.slogger.InfoContext(ctx, "ride is already matched", "action", "update status", "ride_id", match.RideID)
+		}
+		return s.matchLost(ctx, match, err)
+	}
 	passengerID, err := s.db.GetPassengerIDByRideID(ctx, match.RideID)
 	if err != nil {
-		s.slogger.Error("cannnot get passenger id", "error", err)
+		s.slogger.ErrorContext(ctx, "cannnot get passenger id", "error", err)
 		return err
 	}
 	rideNum, err := s.db.GetRideNumberByRideID(ctx, match.RideID)
 	if err != nil {
-		s.slogger.Error("cannnot get passenger id", "error", err)
+		s.slogger.ErrorContext(ctx, "cannnot get passenger id", "error", err)
 		return err
 	}
 
 	err = s.db.RideMatchedUpdate(ctx, match)
 	if err != nil {
-		return err
+		return s.matchLost(ctx, match, err)
 	}
 
 	wsMatch := &domain.RideStatusUpdateMatched{
 		Type:       "ride_status_update",
 		RideID:     match.RideID,
 		RideNumber: rideNum,
-		Status:     "MATCHED",
+		Status:     domain.RideMatched,
 		DriverInfo: domain.DriverInfoWs{
 			DriverID:   match.DriverID,
 			DriverInfo: match.DriverInfo,
@@ -178,6 +295,32 @@ func (s *RideService) rideMatched(ctx context.Context, match *domain.RideRespons
 	return nil
 }
 
+// matchLost acks the accept that lost, its driver is told to drop the ride through the outbox
+func (s *RideService) matchLost(ctx context.Context, match *domain.RideResponseMatch, err error) error {
+	if !errors.Is(err, domain.ErrMatchLost) {
+		return err
+	}
+	s.slogger.InfoContext(ctx, "match lost, driver released", "action", "update status", "ride_id", match.RideID, "driver_id", match.DriverID, "error", err)
+	return nil
+}
+
+func (s *RideService) rideCompleted(ctx context.Context, rideID string) {
+	vehicleType, err := s.db.GetRideVehicleType(ctx, rideID)
+	if err != nil {
+		s.slogger.ErrorContext(ctx, "cannot get vehicle type of completed ride", "action", "count ride", "ride_id", rideID, "error", err)
+	}
+	metrics.RidesCompleted.WithLabelValues(vehicleLabel(vehicleType)).Inc()
+}
+
+// vehicleLabel keeps the metric labels to the known ride types, the type comes from the client
+func vehicleLabel(rideType string) string {
+	switch rideType {
+	case "ECONOMY", "PREMIUM", "XL":
+		return rideType
+	}
+	return "OTHER"
+}
+
 func distanceKM(lat1, lon1, lat2, lon2 float64) float64 {
 	const R = 6371.0 // Радиус Земли в км
 
@@ -196,55 +339,82 @@ func distanceKM(lat1, lon1, lat2, lon2 float64) float64 {
 	return R * c // расстояние в км
 }
 
-func giveTypesFare(str string) (float64, float64, float64, uint8) {
-	switch str {
-	case "PREMIUM":
-		return 800, 120, 60, 5
-	case "XL":
-		return 1000, 150, 75, 10
-	default: /*case "ECONOMY":*/
-		return 500, 100, 50, 1
+func (s *RideService) CancelRide(ctx context.Context, passengerID, rideID string, req *domain.CancelRideRequest) (*domain.CancelRideResponse, error) {
+	now := time.Now()
+	status := &domain.RideStatusUpdate{
+		RideID:    rideID,
+		Status:    domain.RideCancelled,
+		Timestamp: now,
+		Reason:    req.Reason,
 	}
-}
-
-func (s *RideService) CancelRide(ctx context.Context, rideID string, req *domain.CancelRideRequest) (*domain.CancelRideResponse, error) {
-	err := s.db.CancelRide(ctx, rideID, req)
+	// the repo sets the correlation id of the ride, the driver, if any, is notified through the outbox
+	_, err := s.db.CancelRide(ctx, passengerID, rideID, req, status)
 	if err != nil {
 		return nil, err
 	}
+	go s.ws.GiveToPassenger(passengerID, status)
+	metrics.RidesCancelled.Inc()
+	s.slogger.InfoContext(pkg.WithCorrelationID(ctx, status.CorrelationID), "ride cancelled", "action", "cancel ride", "ride_id", rideID)
 
 	return &domain.CancelRideResponse{
 		RideID:      rideID,
-		Status:      "Cancelled",
-		CancelledAt: time.Now(),
+		Status:      domain.RideCancelled,
+		CancelledAt: now,
 		Message:     "Ride cancelled successfully",
 	}, nil
 }
 
 func (s *RideService) locationUpdater(ctx context.Context) {
-	for v := range s.rabbit.GiveLocationChannel() {
-		loca, err := v.GiveBody()
-		if err != nil {
-			s.slogger.Error("canot get location update in body", "action", "get body", "error", err)
-			continue
-		}
-		err = s.locationUpdateHelp(ctx, loca)
-		if err != nil {
-			s.slogger.Error("cannot update location", "error", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-s.rabbit.GiveLocationChannel():
+			mctx := consume(ctx, v, "driver location")
+			loca, err := v.GiveBody()
+			if err != nil {
+				s.slogger.ErrorContext(mctx, "canot get location update in body", "action", "get body", "error", err)
+				reject(mctx, s.slogger, v, err)
+				continue
+			}
+			err = s.locationUpdateHelp(mctx, loca)
+			if err != nil {
+				s.slogger.ErrorContext(mctx, "cannot update location", "error", err)
+			}
+			settle(mctx, s.slogger, v, err)
 		}
 	}
 }
 
 func (s *RideService) locationUpdateHelp(ctx context.Context, loca *domain.DriverLocationUpdate) error {
-	myType, err := s.db.GetRideVehicleType(ctx, loca.RideID)
+	status, err := s.db.GetRideStatus(ctx, loca.RideID)
 	if err != nil {
 		return err
 	}
-	_, rate_per_km, rate_per_min, _ := giveTypesFare(myType)
 	passID, err := s.db.GetPassengerIDByRideID(ctx, loca.RideID)
 	if err != nil {
 		return err
 	}
+	loca.Type = "driver_location_update"
+	switch status {
+	case domain.RideMatched, domain.RideEnRoute, domain.RideArrived:
+		// driver is on the way to pickup, fare is not running yet
+		go s.ws.GiveToPassenger(passID, loca)
+		return nil
+	case domain.RideInProgress:
+	case domain.RideCompleted, domain.RideCancelled:
+		// the last locations may come after the ride is over
+		s.slogger.DebugContext(ctx, "location of finished ride skipped", "action", "update location", "ride_id", loca.RideID, "status", status)
+		return nil
+	default:
+		return fmt.Errorf("ride %s is not active: %s", loca.RideID, status)
+	}
+
+	// the version which priced the ride, a price change does not touch running rides
+	tariff, err := s.db.GetRideTariff(ctx, loca.RideID)
+	if err != nil {
+		return err
+	}
 	oldCoor, err := s.db.GetCurrentCoordinate(ctx, passID)
 	if err != nil {
 		return err
@@ -253,7 +423,7 @@ func (s *RideService) locationUpdateHelp(ctx context.Context, loca *domain.Drive
 	distanceKM := distanceKM(oldCoor.Latitude, oldCoor.Longitude, loca.Location.Lat, loca.Location.Lng)
 	durationMIN := time.Since(oldCoor.UpdatedAt).Minutes()
 
-	fare := (distanceKM * rate_per_km) + (durationMIN * rate_per_min)
+	fare := oldCoor.FareAmount + tariff.Running(distanceKM, durationMIN)
 	data := &domain.LocationCoordinateUpdate{
 		DriverID:       loca.DriverID,
 		RideID:         loca.RideID,
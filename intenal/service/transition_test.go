@@ -0,0 +1,456 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"taxi-hailing/intenal/broker"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/intenal/ws"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// raceRounds repeats every race, the winner differs between rounds
+const raceRounds = 20
+
+// transitionWorld is one requested ride with its services. Nothing relays the outbox,
+// the tests hand the statuses to the other service themselves, like the consumers do.
+type transitionWorld struct {
+	ctx         context.Context
+	store       *repo.MemoryStore
+	rides       *RideService
+	drivers     *DriverService
+	passengerID string
+	driverID    string // the driver the ride is matched to
+	rideID      string
+}
+
+func newTransitionWorld(t *testing.T) *transitionWorld {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	slogger := slog.New(slog.DiscardHandler)
+	mb := broker.NewMemoryBroker()
+	t.Cleanup(func() { mb.CloseRabbit() })
+
+	w := &transitionWorld{ctx: ctx, store: repo.NewMemoryStore()}
+	w.rides = NewRideService(ctx, slogger, w.store, mb.Ride(), ws.NewWebSocket(slogger, tokenAuth{}, 0), []byte("quote-secret"))
+	w.drivers = NewDriverService(ctx, slogger, w.store, mb.Driver(), ws.NewDriverWebSocket(slogger, tokenAuth{}, 0))
+
+	var err error
+	w.passengerID, err = w.store.RegisterPassenger(ctx, &domain.User{Name: "Passenger", Email: "passenger@example.com"})
+	if err != nil {
+		t.Fatalf("register passenger: %v", err)
+	}
+	w.driverID = w.newDriver(t, 1)
+	ride, err := w.rides.CreateRide(ctx, &domain.RideRequest{
+		PassengerID:          w.passengerID,
+		PickupLatitude:       43.238949,
+		PickupLongitude:      76.889709,
+		DestinationLatitude:  43.222015,
+		DestinationLongitude: 76.851248,
+		RideType:             "ECONOMY",
+	})
+	if err != nil {
+		t.Fatalf("create ride: %v", err)
+	}
+	w.rideID = ride.RideID
+	return w
+}
+
+// newDriver registers an AVAILABLE driver
+func (w *transitionWorld) newDriver(t *testing.T, n int) string {
+	t.Helper()
+	driver := &domain.Driver{
+		Name:          fmt.Sprintf("Driver %d", n),
+		Email:         fmt.Sprintf("driver%d@example.com", n),
+		LicenseNumber: fmt.Sprintf("KZ-%03d", n),
+		VehicleType:   "ECONOMY",
+	}
+	err := w.store.CreateDriver(w.ctx, driver)
+	if err != nil {
+		t.Fatalf("create driver: %v", err)
+	}
+	_, err = w.drivers.SetToOnline(w.ctx, uuid.MustParse(driver.ID), &domain.Location{Lat: 43.238949, Lng: 76.889709})
+	if err != nil {
+		t.Fatalf("driver online: %v", err)
+	}
+	return driver.ID
+}
+
+// the moves below are what the services do for one step, the driver side first,
+// then the ride service applying the status the relay would bring it
+
+// match is domain.ErrMatchLost when the accept was acked but lost, and its driver was told to drop the ride
+func (w *transitionWorld) match(driverID string) error {
+	err := w.rides.rideMatched(w.ctx, &domain.RideResponseMatch{RideID: w.rideID, DriverID: driverID, Accepted: true})
+	if err != nil {
+		return err
+	}
+	if w.released(driverID) {
+		return domain.ErrMatchLost
+	}
+	return nil
+}
+
+// released is true when the outbox tells the driver the accept lost
+func (w *transitionWorld) released(driverID string) bool {
+	for _, msg := range w.store.Pending() {
+		if msg.RoutingKey != "driver.status."+driverID {
+			continue
+		}
+		status := new(domain.RideStatusUpdate)
+		if json.Unmarshal(msg.Payload, status) == nil && status.RideID == w.rideID && status.Reason == domain.CancelReasonMatchLost {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *transitionWorld) enRoute(driverID string) error {
+	_, err := w.drivers.EnRoute(w.ctx, driverID, w.location())
+	if err != nil {
+		return err
+	}
+	return w.status(domain.RideEnRoute, driverID)
+}
+
+func (w *transitionWorld) arrived(driverID string) error {
+	_, err := w.drivers.Arrived(w.ctx, driverID, w.location())
+	if err != nil {
+		return err
+	}
+	return w.status(domain.RideArrived, driverID)
+}
+
+func (w *transitionWorld) start(driverID string) error {
+	_, err := w.drivers.Start(w.ctx, driverID, w.location())
+	if err != nil {
+		return err
+	}
+	return w.status(domain.RideInProgress, driverID)
+}
+
+func (w *transitionWorld) complete(driverID string) error {
+	_, err := w.drivers.Complete(w.ctx, driverID, &domain.CompleteRideRequest{
+		RideID:                w.rideID,
+		FinalLocation:         domain.Location{Lat: 43.222015, Lng: 76.851248},
+		ActualDistanceKm:      3.5,
+		ActualDurationMinutes: 10,
+	})
+	if err != nil {
+		return err
+	}
+	return w.status(domain.RideCompleted, driverID)
+}
+
+func (w *transitionWorld) cancel() error {
+	status, err := w.store.GetRideStatus(w.ctx, w.rideID)
+	if err != nil {
+		return err
+	}
+	_, err = w.rides.CancelRide(w.ctx, w.passengerID, w.rideID, &domain.CancelRideRequest{Reason: "changed plans"})
+	if err != nil || status == domain.RideRequested {
+		return err
+	}
+	return w.drivers.statusUpdate(w.ctx, &domain.RideStatusUpdate{RideID: w.rideID, Status: domain.RideCancelled, DriverID: w.driverID})
+}
+
+// status is only the ride service applying a driver's status, without the driver's move
+func (w *transitionWorld) status(status, driverID string) error {
+	return w.rides.statusUpdate(w.ctx, &domain.RideStatusUpdate{RideID: w.rideID, Status: status, DriverID: driverID})
+}
+
+func (w *transitionWorld) location() *domain.DriverLocationMessage {
+	loc := &domain.DriverLocationMessage{RideID: w.rideID}
+	loc.DriverLocation.Latitude = 43.238949
+	loc.DriverLocation.Longitude = 76.889709
+	return loc
+}
+
+// reach moves the ride to status by legal steps
+func (w *transitionWorld) reach(t *testing.T, status string) {
+	t.Helper()
+	var path []func(string) error
+	switch status {
+	case domain.RideRequested:
+	case domain.RideCancelled:
+		path = []func(string) error{func(string) error { return w.cancel() }}
+	default:
+		steps := map[string]func(string) error{
+			domain.RideMatched:    w.match,
+			domain.RideEnRoute:    w.enRoute,
+			domain.RideArrived:    w.arrived,
+			domain.RideInProgress: w.start,
+			domain.RideCompleted:  w.complete,
+		}
+		for _, s := range []string{domain.RideMatched, domain.RideEnRoute, domain.RideArrived, domain.RideInProgress, domain.RideCompleted} {
+			path = append(path, steps[s])
+			if s == status {
+				break
+			}
+		}
+	}
+	for _, step := range path {
+		err := step(w.driverID)
+		if err != nil {
+			t.Fatalf("reach %s: %v", status, err)
+		}
+	}
+	w.checkRide(t, status)
+}
+
+func (w *transitionWorld) checkRide(t *testing.T, want string) {
+	t.Helper()
+	got, err := w.store.GetRideStatus(w.ctx, w.rideID)
+	if err != nil {
+		t.Fatalf("ride status: %v", err)
+	}
+	if got != want {
+		t.Errorf("ride is %s, want %s", got, want)
+	}
+}
+
+func TestRideTransitions(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		move func(w *transitionWorld) error
+		want error
+		to   string // ride status after the move
+	}{
+		// legal moves
+		{"match", domain.RideRequested, func(w *transitionWorld) error { return w.match(w.driverID) }, nil, domain.RideMatched},
+		{"en route", domain.RideMatched, func(w *transitionWorld) error { return w.enRoute(w.driverID) }, nil, domain.RideEnRoute},
+		{"arrived", domain.RideEnRoute, func(w *transitionWorld) error { return w.arrived(w.driverID) }, nil, domain.RideArrived},
+		{"start", domain.RideArrived, func(w *transitionWorld) error { return w.start(w.driverID) }, nil, domain.RideInProgress},
+		{"complete", domain.RideInProgress, func(w *transitionWorld) error { return w.complete(w.driverID) }, nil, domain.RideCompleted},
+		{"cancel requested", domain.RideRequested, (*transitionWorld).cancel, nil, domain.RideCancelled},
+		{"cancel matched", domain.RideMatched, (*transitionWorld).cancel, nil, domain.RideCancelled},
+		{"cancel in progress", domain.RideInProgress, (*transitionWorld).cancel, nil, domain.RideCancelled},
+		{"redelivered match", domain.RideMatched, func(w *transitionWorld) error { return w.match(w.driverID) }, nil, domain.RideMatched},
+		{"redelivered status", domain.RideEnRoute, func(w *transitionWorld) error { return w.status(domain.RideEnRoute, w.driverID) }, nil, domain.RideEnRoute},
+		// the driver completes before the relay brought the ride IN_PROGRESS, the statuses arrive in order later
+		{"complete before the ride applies the start", domain.RideArrived, func(w *transitionWorld) error {
+			_, err := w.drivers.Start(w.ctx, w.driverID, w.location())
+			if err != nil {
+				return err
+			}
+			_, err = w.drivers.Complete(w.ctx, w.driverID, &domain.CompleteRideRequest{RideID: w.rideID, ActualDistanceKm: 3.5, ActualDurationMinutes: 10})
+			if err != nil {
+				return err
+			}
+			err = w.status(domain.RideInProgress, w.driverID)
+			if err != nil {
+				return err
+			}
+			return w.status(domain.RideCompleted, w.driverID)
+		}, nil, domain.RideCompleted},
+		{"match of a cancelled ride", domain.RideCancelled, func(w *transitionWorld) error { return w.match(w.driverID) }, domain.ErrMatchLost, domain.RideCancelled},
+		{"match of another driver's ride", domain.RideMatched, func(w *transitionWorld) error { return w.match(uuid.NewString()) }, domain.ErrMatchLost, domain.RideMatched},
+
+		// illegal moves
+		{"arrived before en route", domain.RideMatched, func(w *transitionWorld) error { return w.arrived(w.driverID) }, domain.ErrInvalidTransition, domain.RideMatched},
+		{"start before en route", domain.RideMatched, func(w *transitionWorld) error { return w.start(w.driverID) }, domain.ErrInvalidTransition, domain.RideMatched},
+		// the driver side refuses it, otherwise the driver would be BUSY on a ride that cannot start
+		{"start before arrived", domain.RideEnRoute, func(w *transitionWorld) error {
+			_, err := w.drivers.Start(w.ctx, w.driverID, w.location())
+			return err
+		}, domain.ErrInvalidTransition, domain.RideEnRoute},
+		{"complete before start", domain.RideArrived, func(w *transitionWorld) error { return w.complete(w.driverID) }, domain.ErrInvalidTransition, domain.RideArrived},
+		{"en route twice", domain.RideEnRoute, func(w *transitionWorld) error { return w.enRoute(w.driverID) }, domain.ErrInvalidTransition, domain.RideEnRoute},
+		{"cancel completed", domain.RideCompleted, (*transitionWorld).cancel, domain.ErrInvalidTransition, domain.RideCompleted},
+		{"cancel cancelled", domain.RideCancelled, (*transitionWorld).cancel, domain.ErrInvalidTransition, domain.RideCancelled},
+		{"stale status", domain.RideInProgress, func(w *transitionWorld) error { return w.status(domain.RideArrived, w.driverID) }, domain.ErrInvalidTransition, domain.RideInProgress},
+		{"status of a cancelled ride", domain.RideCancelled, func(w *transitionWorld) error { return w.status(domain.RideArrived, w.driverID) }, domain.Errconflict, domain.RideCancelled},
+		{"status ahead of another driver's ride", domain.RideMatched, func(w *transitionWorld) error { return w.status(domain.RideArrived, uuid.NewString()) }, domain.Errconflict, domain.RideMatched},
+
+		// statuses which overtook the ones before them, retried until those are applied
+		{"status out of order", domain.RideMatched, func(w *transitionWorld) error { return w.status(domain.RideInProgress, w.driverID) }, domain.ErrStatusAhead, domain.RideMatched},
+		{"arrived while matched", domain.RideMatched, func(w *transitionWorld) error { return w.status(domain.RideArrived, w.driverID) }, domain.ErrStatusAhead, domain.RideMatched},
+		{"completed status of a matched ride", domain.RideMatched, func(w *transitionWorld) error { return w.status(domain.RideCompleted, w.driverID) }, domain.ErrStatusAhead, domain.RideMatched},
+		{"unknown status", domain.RideMatched, func(w *transitionWorld) error { return w.status("TELEPORTED", w.driverID) }, domain.Errconflict, domain.RideMatched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTransitionWorld(t)
+			w.reach(t, tt.from)
+			err := tt.move(w)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			w.checkRide(t, tt.to)
+		})
+	}
+}
+
+// TestTransitionRaces runs two moves of which only one may win at the same time,
+// the loser must get a conflict and the ride must end up as the winner left it
+func TestTransitionRaces(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		a, b func(w *transitionWorld, other string) error
+	}{
+		{
+			"two drivers accept",
+			domain.RideRequested,
+			func(w *transitionWorld, _ string) error { return w.match(w.driverID) },
+			func(w *transitionWorld, other string) error { return w.match(other) },
+		},
+		{
+			"another driver goes en route",
+			domain.RideMatched,
+			func(w *transitionWorld, _ string) error { return w.enRoute(w.driverID) },
+			func(w *transitionWorld, other string) error { return w.enRoute(other) },
+		},
+		{
+			"another driver completes",
+			domain.RideInProgress,
+			func(w *transitionWorld, _ string) error { return w.complete(w.driverID) },
+			func(w *transitionWorld, other string) error { return w.complete(other) },
+		},
+		{
+			"en route tapped twice",
+			domain.RideMatched,
+			func(w *transitionWorld, _ string) error { return w.enRoute(w.driverID) },
+			func(w *transitionWorld, _ string) error { return w.enRoute(w.driverID) },
+		},
+		{
+			"passenger cancels twice",
+			domain.RideMatched,
+			func(w *transitionWorld, _ string) error { return w.cancel() },
+			func(w *transitionWorld, _ string) error { return w.cancel() },
+		},
+		{
+			"cancel against complete",
+			domain.RideInProgress,
+			func(w *transitionWorld, _ string) error {
+				_, err := w.rides.CancelRide(w.ctx, w.passengerID, w.rideID, &domain.CancelRideRequest{Reason: "changed plans"})
+				return err
+			},
+			func(w *transitionWorld, _ string) error { return w.status(domain.RideCompleted, w.driverID) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range raceRounds {
+				w := newTransitionWorld(t)
+				other := w.newDriver(t, 2)
+				if tt.from == domain.RideInProgress {
+					// the other driver needs to be able to try completing
+					w.reachBusy(t, other)
+				}
+				w.reach(t, tt.from)
+
+				var errA, errB error
+				var wg sync.WaitGroup
+				start := make(chan struct{})
+				wg.Go(func() {
+					<-start
+					errA = tt.a(w, other)
+				})
+				wg.Go(func() {
+					<-start
+					errB = tt.b(w, other)
+				})
+				close(start)
+				wg.Wait()
+
+				if (errA == nil) == (errB == nil) {
+					t.Fatalf("exactly one move must win: %v, %v", errA, errB)
+				}
+				lost := errors.Join(errA, errB)
+				if !errors.Is(lost, domain.Errconflict) {
+					t.Fatalf("loser got %v, want %v", lost, domain.Errconflict)
+				}
+			}
+		})
+	}
+}
+
+// reachBusy puts the driver on another ride in progress, so it is BUSY like the driver of w
+func (w *transitionWorld) reachBusy(t *testing.T, driverID string) {
+	t.Helper()
+	own := &transitionWorld{ctx: w.ctx, store: w.store, rides: w.rides, drivers: w.drivers, driverID: driverID}
+	var err error
+	own.passengerID, err = w.store.RegisterPassenger(w.ctx, &domain.User{Name: "Other", Email: "other@example.com"})
+	if err != nil {
+		t.Fatalf("register passenger: %v", err)
+	}
+	ride, err := w.rides.CreateRide(w.ctx, &domain.RideRequest{
+		PassengerID:          own.passengerID,
+		PickupLatitude:       43.238949,
+		PickupLongitude:      76.889709,
+		DestinationLatitude:  43.222015,
+		DestinationLongitude: 76.851248,
+		RideType:             "ECONOMY",
+	})
+	if err != nil {
+		t.Fatalf("create ride: %v", err)
+	}
+	own.rideID = ride.RideID
+	own.reach(t, domain.RideInProgress)
+}
+
+// TestStatusPushedAfterUpdate checks the passenger only hears of statuses the ride took
+func TestStatusPushedAfterUpdate(t *testing.T) {
+	w := newTransitionWorld(t)
+	port := freePort(t)
+	hub := ws.NewWebSocket(slog.New(slog.DiscardHandler), tokenAuth{}, port)
+	go hub.StartServer()
+	t.Cleanup(func() { hub.CloseServer() })
+	eventually(t, "passenger hub is listening", func() bool { return hub.Ready(w.ctx) == nil })
+	w.rides.ws = hub
+	w.reach(t, domain.RideMatched)
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/ws/passengers/%s", port, w.passengerID), nil)
+	if err != nil {
+		t.Fatalf("dial passenger websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	err = conn.WriteJSON(map[string]string{"type": "auth", "token": "passenger:" + w.passengerID})
+	if err != nil {
+		t.Fatalf("send auth: %v", err)
+	}
+	// the hub registers the connection after its greeting, probe until pushes get through
+	eventually(t, "passenger is connected", func() bool {
+		hub.GiveToPassenger(w.passengerID, map[string]string{"status": "probe"})
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		probe := make(map[string]any)
+		return conn.ReadJSON(&probe) == nil && probe["status"] == "probe"
+	})
+
+	err = w.status(domain.RideArrived, w.driverID)
+	if !errors.Is(err, domain.ErrStatusAhead) {
+		t.Fatalf("arrived while matched = %v, want %v", err, domain.ErrStatusAhead)
+	}
+	err = w.status(domain.RideEnRoute, w.driverID)
+	if err != nil {
+		t.Fatalf("en route: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(stepTimeout))
+	for {
+		got := new(domain.RideStatusUpdate)
+		err = conn.ReadJSON(got)
+		if err != nil {
+			t.Fatalf("read status: %v", err)
+		}
+		if got.Status == "probe" {
+			continue
+		}
+		if got.Status != domain.RideEnRoute {
+			t.Fatalf("passenger got %s, want only %s", got.Status, domain.RideEnRoute)
+		}
+		return
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/repo"
+	"taxi-hailing/pkg"
+)
+
+// errBadCredentials is the same for an unknown email and a wrong password, so logins cannot probe emails
+var errBadCredentials = fmt.Errorf("%w: wrong email or password", domain.ErrUnauthorized)
+
+// UserService is the identity side of the auth service: registration, login and passwords
+// for every role. Tokens and sessions are left to AuthService.
+type UserService struct {
+	slogger *slog.Logger
+	db      repo.UserStore
+	auth    *AuthService
+}
+
+func NewUserService(slogger *slog.Logger, db repo.UserStore, auth *AuthService) *UserService {
+	return &UserService{
+		slogger: slogger,
+		db:      db,
+		auth:    auth,
+	}
+}
+
+// Register creates a passenger or a driver and logs them in
+func (u *UserService) Register(ctx context.Context, req *domain.RegisterRequest) (*pkg.RegistrationResponse, error) {
+	hash, err := pkg.HashPassword(req.Password)
+	if err != nil {
+		return nil, err
+	}
+	claims := &pkg.MyClaims{
+		Name:  req.Name,
+		Email: req.Email,
+		Role:  req.Role,
+	}
+	switch req.Role {
+	case "PASSENGER":
+		claims.UserID, err = u.db.RegisterPassenger(ctx, &domain.User{
+			Name:         req.Name,
+			Email:        req.Email,
+			PasswordHash: hash,
+		})
+	case "DRIVER":
+		driver := &domain.Driver{
+			Name:          req.Name,
+			Email:         req.Email,
+			PasswordHash:  hash,
+			LicenseNumber: req.LicenseNumber,
+			VehicleType:   req.VehicleType,
+			VehicleAttrs:  req.VehicleAttrs,
+		}
+		err = u.db.CreateDriver(ctx, driver)
+		claims.UserID = driver.ID
+	default:
+		return nil, fmt.Errorf("%w: role %s cannot register", domain.ErrForbidden, req.Role)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.slogger.InfoContext(ctx, "new user registred", "action", "registration", "user_id", claims.UserID, "role", req.Role)
+	return u.auth.Login(ctx, claims)
+}
+
+// Login checks the password and opens a session. A legacy or outdated hash is replaced on the way.
+func (u *UserService) Login(ctx context.Context, req *domain.LoginRequest) (*pkg.RegistrationResponse, error) {
+	user, err := u.db.GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			// as slow as a wrong password, the timing must not tell which emails are registered
+			pkg.CheckDummyPassword(req.Password)
+			return nil, errBadCredentials
+		}
+		return nil, err
+	}
+	ok, rehash, err := u.auth.CheckPassword(req.Password, user.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errBadCredentials
+	}
+	if user.Status == "BANNED" {
+		return nil, fmt.Errorf("%w: user is banned", domain.ErrForbidden)
+	}
+	if rehash {
+		u.rehashPassword(ctx, user.ID, req.Password)
+	}
+	return u.auth.Login(ctx, &pkg.MyClaims{
+		UserID: user.ID,
+		Name:   user.Name,
+		Email:  user.Email,
+		Role:   user.Role,
+	})
+}
+
+// rehashPassword only logs on failure, the old hash still works
+func (u *UserService) rehashPassword(ctx context.Context, userID, password string) {
+	hash, err := pkg.HashPassword(password)
+	if err != nil {
+		u.slogger.ErrorContext(ctx, "cannot hash the password", "action", "rehash password", "user_id", userID, "error", err)
+		return
+	}
+	err = u.db.UpdatePasswordHash(ctx, userID, hash)
+	if err != nil {
+		u.slogger.ErrorContext(ctx, "cannot save the new password hash", "action", "rehash password", "user_id", userID, "error", err)
+		return
+	}
+	u.slogger.InfoContext(ctx, "password rehashed", "action", "rehash password", "user_id", userID)
+}
+
+// ChangePassword needs the old password. Every session of the user is revoked,
+// the caller continues with the new one returned here.
+func (u *UserService) ChangePassword(ctx context.Context, claim *pkg.MyClaims, req *domain.ChangePasswordRequest) (*pkg.RegistrationResponse, error) {
+	user, err := u.db.GetUserByID(ctx, claim.UserID)
+	if err != nil {
+		return nil, err
+	}
+	ok, _, err := u.auth.CheckPassword(req.OldPassword, user.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: wrong old password", domain.ErrForbidden)
+	}
+	hash, err := pkg.HashPassword(req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+	err = u.db.UpdatePasswordHash(ctx, user.ID, hash)
+	if err != nil {
+		return nil, err
+	}
+	_, err = u.auth.RevokeAll(ctx, user.ID, domain.RevokePasswordChanged)
+	if err != nil {
+		return nil, err
+	}
+	return u.auth.Login(ctx, &pkg.MyClaims{
+		UserID: user.ID,
+		Name:   user.Name,
+		Email:  user.Email,
+		Role:   user.Role,
+	})
+}
+
+func (u *UserService) Me(ctx context.Context, userID string) (*domain.UserInfo, error) {
+	user, err := u.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.UserInfo{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		Role:      user.Role,
+		Status:    user.Status,
+		CreatedAt: user.CreatedAt,
+	}, nil
+}
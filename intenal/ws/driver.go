@@ -6,37 +6,59 @@ import (
 	"log/slog"
 	"net/http"
 	"sync"
-	"taxi-hailing/pkg"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/intenal/metrics"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// only the driver of the path may connect
+var driverRule = authz.Allow(authz.RoleDriver).OwnedBy("driver_id")
+
 type DriverHub struct {
-	secret  []byte
-	srv     *http.Server
-	slogger *slog.Logger
-	clients sync.Map // map[string]*MyWebSocket map[string] chan<- []byte
+	auth     authz.Authenticator
+	srv      *http.Server
+	listener listener
+	slogger  *slog.Logger
+	clients  sync.Map // map[string]*MyWebSocket map[string] chan<- []byte
+	offers   sync.Map // map[offerID]*pendingOffer
+	pending  sync.Map // map[driverID]offerID, one offer per driver at a time
+}
+
+type pendingOffer struct {
+	driverID string
+	rideID   string
+	answer   chan *domain.RideOfferResponse
 }
 
-func NewDriverWebSocket(slogger *slog.Logger, secret []byte, port uint16) *PassengerHub {
+func NewDriverWebSocket(slogger *slog.Logger, auth authz.Authenticator, port uint16) *DriverHub {
 	mux := http.NewServeMux()
 	my := &DriverHub{
-		secret:  secret,
+		auth:    auth,
 		slogger: slogger,
-	}
-	mux.HandleFunc("/ws/drivers/{driver_id}", my.connectDriver)
-	// mux.HandleFunc("GET /ws", wsHandler)
-	return &PassengerHub{
 		srv: &http.Server{
 			Addr:    fmt.Sprintf(":%d", port),
 			Handler: mux,
 		},
 	}
+	mux.HandleFunc("/ws/drivers/{driver_id}", my.connectDriver)
+	return my
 }
 
 func (hub *DriverHub) StartServer() error {
-	return hub.srv.ListenAndServe()
+	return hub.listener.serve(hub.srv)
+}
+
+// Disconnect drops the connection opened with a revoked session
+func (hub *DriverHub) Disconnect(userID, sessionID string) {
+	disconnect(&hub.clients, userID, sessionID)
+}
+
+// Ready fails until the listener is bound and after it stops
+func (hub *DriverHub) Ready(ctx context.Context) error {
+	return hub.listener.ready(ctx)
 }
 
 func (hub *DriverHub) CloseServer() error {
@@ -44,7 +66,7 @@ func (hub *DriverHub) CloseServer() error {
 	return hub.srv.Close()
 }
 
-func (hub *DriverHub) GiveToPassenger(id string, zat any) {
+func (hub *DriverHub) GiveToDriver(id string, zat any) {
 	wsStu, ok := hub.clients.Load(id)
 	if !ok {
 		return
@@ -57,44 +79,81 @@ func (hub *DriverHub) GiveToPassenger(id string, zat any) {
 	ws.pushToChannel(zat)
 }
 
-func (hub *DriverHub) connectDriver(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		hub.slogger.Error("upgrade error:", "error", err)
-		return
+// SendOffer pushes the offer to the driver and waits for his answer until offer.ExpiresAt.
+// A driver can hold only one offer at a time, the second one gets domain.ErrOfferPending.
+func (hub *DriverHub) SendOffer(ctx context.Context, driverID string, offer *domain.RideOffer) (*domain.RideOfferResponse, error) {
+	wsStu, ok := hub.clients.Load(driverID)
+	if !ok {
+		return nil, domain.ErrDriverNotConnected
 	}
-	defer conn.Close()
-	id := r.PathValue("driver_id")
-	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	if err != nil {
-		return
+	ws, ok := wsStu.(*myWebSocket)
+	if !ok {
+		return nil, fmt.Errorf("cannot parse myWebSocket")
 	}
-	auth := new(authMessage)
-	err = conn.ReadJSON(auth)
-	if err != nil {
-		hub.slogger.Error("websocket_auth_timeout", "error", err)
-		conn.WriteJSON(map[string]string{"error": err.Error()})
-		return
+
+	if _, loaded := hub.pending.LoadOrStore(driverID, offer.OfferID); loaded {
+		return nil, domain.ErrOfferPending
 	}
+	defer hub.pending.Delete(driverID)
 
-	if auth.Type != "auth" {
-		conn.WriteJSON(map[string]string{"error": fmt.Sprintf("invalid auth type: %s", auth.Type)})
-		return
+	p := &pendingOffer{
+		driverID: driverID,
+		rideID:   offer.RideID,
+		answer:   make(chan *domain.RideOfferResponse, 1),
 	}
+	hub.offers.Store(offer.OfferID, p)
+	defer hub.offers.Delete(offer.OfferID)
+
+	timer := time.NewTimer(time.Until(offer.ExpiresAt))
+	defer timer.Stop()
+
+	ws.pushToChannel(offer)
+	select {
+	case res := <-p.answer:
+		return res, nil
+	case <-timer.C:
+		ws.pushToChannel(&domain.RideOfferExpired{
+			Type:    "ride_offer_expired",
+			OfferID: offer.OfferID,
+			RideID:  offer.RideID,
+		})
+		return nil, domain.ErrOfferTimeout
+	case <-ws.done:
+		return nil, domain.ErrDriverNotConnected
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	claim, err := pkg.ParseTokenMyClaims(auth.Token, hub.secret)
-	if err != nil {
-		conn.WriteJSON(map[string]string{"error": err.Error()})
-		return
+func (hub *DriverHub) resolveOffer(driverID string, res *domain.RideOfferResponse) error {
+	v, ok := hub.offers.Load(res.OfferID)
+	if !ok {
+		return fmt.Errorf("offer %s not found or expired", res.OfferID)
+	}
+	p := v.(*pendingOffer)
+	if p.driverID != driverID || p.rideID != res.RideID {
+		return fmt.Errorf("offer %s does not belong to this driver", res.OfferID)
 	}
+	select {
+	case p.answer <- res:
+		return nil
+	default:
+		return fmt.Errorf("offer %s already answered", res.OfferID)
+	}
+}
 
-	if claim.UserID != id {
-		conn.WriteJSON(map[string]string{"error": fmt.Sprintln("wrong id != cliam id")})
+func (hub *DriverHub) connectDriver(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		hub.slogger.Error("upgrade error:", "error", err)
 		return
 	}
-
-	if claim.Role != "DRIVER" {
-		conn.WriteJSON(map[string]string{"error": fmt.Sprintln("wrong role != role")})
+	defer conn.Close()
+	id := r.PathValue("driver_id")
+	claim, err := authorize(r, conn, hub.auth, driverRule)
+	if err != nil {
+		hub.slogger.Warn("websocket auth failed", "action", "websocket auth", "driver_id", id, "error", err)
+		return
 	}
 
 	conn.WriteJSON(map[string]string{"msg": "please wait"})
@@ -103,16 +162,37 @@ func (hub *DriverHub) connectDriver(w http.ResponseWriter, r *http.Request) {
 		conn.WriteJSON(map[string]string{"error": "already connected in other ws"})
 		return
 	}
-	myWS := &myWebSocket{
-		done:   make(chan struct{}),
-		sendCh: make(chan any),
-	}
+	myWS := newMyWebSocket(claim.SessionID)
 	go hub.pingPong(r.Context(), conn, myWS)
 	hub.clients.Store(id, myWS)
 	defer hub.clients.Delete(id)
-	go hub.writer(conn, myWS)
+	metrics.WebSocketClients.WithLabelValues("driver").Inc()
+	defer metrics.WebSocketClients.WithLabelValues("driver").Dec()
+	go myWS.writer(conn)
+	go hub.reader(conn, id, myWS)
+	myWS.wait()
+}
 
+// reader handles driver messages, for now only answers to ride offers
+func (hub *DriverHub) reader(conn *websocket.Conn, id string, ws *myWebSocket) {
+	defer ws.safeClose()
+	for {
+		msg := new(domain.RideOfferResponse)
+		err := conn.ReadJSON(msg)
+		if err != nil {
+			return
+		}
+		if msg.Type != "ride_response" {
+			ws.pushToChannel(map[string]string{"error": fmt.Sprintf("unknown message type: %s", msg.Type)})
+			continue
+		}
+		err = hub.resolveOffer(id, msg)
+		if err != nil {
+			ws.pushToChannel(map[string]string{"error": err.Error()})
+		}
+	}
 }
+
 func (hub *DriverHub) pingPong(ctx context.Context, ws *websocket.Conn, my *myWebSocket) {
 	defer my.safeClose()
 	const (
@@ -134,6 +214,8 @@ func (hub *DriverHub) pingPong(ctx context.Context, ws *websocket.Conn, my *myWe
 		select {
 		case <-ctx.Done():
 			return
+		case <-my.done:
+			return
 		case <-ticker.C:
 			if err := ws.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(5*time.Second)); err != nil {
 				ws.Close()
@@ -142,13 +224,3 @@ func (hub *DriverHub) pingPong(ctx context.Context, ws *websocket.Conn, my *myWe
 		}
 	}
 }
-
-func (hub *DriverHub) writer(conn *websocket.Conn, ws *myWebSocket) {
-	defer ws.safeClose()
-	for data := range ws.sendCh {
-		err := conn.WriteJSON(data)
-		if err != nil {
-			return
-		}
-	}
-}
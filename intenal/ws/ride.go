@@ -6,17 +6,22 @@ import (
 	"log/slog"
 	"net/http"
 	"sync"
-	"taxi-hailing/pkg"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/metrics"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// only the passenger of the path may connect
+var passengerRule = authz.Allow(authz.RolePassenger).OwnedBy("passenger_id")
+
 type PassengerHub struct {
-	secret  []byte
-	srv     *http.Server
-	slogger *slog.Logger
-	clients sync.Map // map[string]*MyWebSocket map[string] chan<- []byte
+	auth     authz.Authenticator
+	srv      *http.Server
+	listener listener
+	slogger  *slog.Logger
+	clients  sync.Map // map[string]*MyWebSocket map[string] chan<- []byte
 	// db      *repo.RideRepo
 }
 
@@ -41,40 +46,12 @@ func (hub *PassengerHub) connectPassenger(w http.ResponseWriter, r *http.Request
 	}
 	defer conn.Close()
 	id := r.PathValue("passenger_id")
-
-	//Client sends authentication message within 5 seconds
-	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	if err != nil {
-		return
-	}
-	auth := new(authMessage)
-	err = conn.ReadJSON(auth)
+	claim, err := authorize(r, conn, hub.auth, passengerRule)
 	if err != nil {
-		hub.slogger.Error("websocket_auth_timeout", "error", err)
-		conn.WriteJSON(map[string]string{"error": err.Error()})
+		hub.slogger.Warn("websocket auth failed", "action", "websocket auth", "passenger_id", id, "error", err)
 		return
 	}
 
-	if auth.Type != "auth" {
-		conn.WriteJSON(map[string]string{"error": fmt.Sprintf("invalid auth type: %s", auth.Type)})
-		return
-	}
-
-	claim, err := pkg.ParseTokenMyClaims(auth.Token, hub.secret)
-	if err != nil {
-		conn.WriteJSON(map[string]string{"error": err.Error()})
-		return
-	}
-
-	if claim.UserID != id {
-		conn.WriteJSON(map[string]string{"error": fmt.Sprintln("wrong id != cliam id")})
-		return
-	}
-
-	if claim.Role != "PASSENGER" {
-		conn.WriteJSON(map[string]string{"error": fmt.Sprintln("wrong role != role")})
-	}
-
 	// user, err := hub.db.GetPassengerWS(r.Context(), id)
 	// if err != nil {
 	// 	conn.WriteJSON(map[string]string{"error": err.Error()})
@@ -96,16 +73,15 @@ func (hub *PassengerHub) connectPassenger(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	myWS := &myWebSocket{
-		done:   make(chan struct{}),
-		sendCh: make(chan any),
-	}
+	myWS := newMyWebSocket(claim.SessionID)
 	go hub.pingPong(r.Context(), conn, myWS)
 
 	hub.clients.Store(id, myWS)
 	defer hub.clients.Delete(id)
-	go hub.writer(conn, myWS)
-	<-myWS.done
+	metrics.WebSocketClients.WithLabelValues("passenger").Inc()
+	defer metrics.WebSocketClients.WithLabelValues("passenger").Dec()
+	go myWS.writer(conn)
+	myWS.wait()
 }
 
 func (hub *PassengerHub) pingPong(ctx context.Context, ws *websocket.Conn, my *myWebSocket) {
@@ -138,35 +114,34 @@ func (hub *PassengerHub) pingPong(ctx context.Context, ws *websocket.Conn, my *m
 	}
 }
 
-func (hub *PassengerHub) writer(conn *websocket.Conn, ws *myWebSocket) {
-	defer ws.safeClose()
-	for data := range ws.sendCh {
-		err := conn.WriteJSON(data)
-		if err != nil {
-			return
-		}
-	}
-}
-
-func NewWebSocket(slogger *slog.Logger, secret []byte, port uint16) *PassengerHub {
+func NewWebSocket(slogger *slog.Logger, auth authz.Authenticator, port uint16) *PassengerHub {
 	mux := http.NewServeMux()
 	my := &PassengerHub{
-		secret:  secret,
+		auth:    auth,
 		slogger: slogger,
-		// db:      db,
-	}
-	mux.HandleFunc("/ws/passengers/{passenger_id}", my.connectPassenger)
-	// mux.HandleFunc("GET /ws", wsHandler)
-	return &PassengerHub{
 		srv: &http.Server{
 			Addr:    fmt.Sprintf(":%d", port),
 			Handler: mux,
 		},
+		// db:      db,
 	}
+	mux.HandleFunc("/ws/passengers/{passenger_id}", my.connectPassenger)
+	// mux.HandleFunc("GET /ws", wsHandler)
+	return my
 }
 
 func (hub *PassengerHub) StartServer() error {
-	return hub.srv.ListenAndServe()
+	return hub.listener.serve(hub.srv)
+}
+
+// Disconnect drops the connection opened with a revoked session
+func (hub *PassengerHub) Disconnect(userID, sessionID string) {
+	disconnect(&hub.clients, userID, sessionID)
+}
+
+// Ready fails until the listener is bound and after it stops
+func (hub *PassengerHub) Ready(ctx context.Context) error {
+	return hub.listener.ready(ctx)
 }
 
 func (hub *PassengerHub) CloseServer() error {
@@ -1,8 +1,16 @@
 package ws
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"taxi-hailing/intenal/authz"
+	"taxi-hailing/intenal/domain"
+	"taxi-hailing/pkg"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,24 +22,131 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+var errNotListening = errors.New("websocket listener is not running")
+
+// listener tracks whether the hub is accepting connections, for readiness checks
+type listener struct {
+	up atomic.Bool
+}
+
+// serve binds the address first, so up only turns on once connections can be accepted
+func (l *listener) serve(srv *http.Server) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	l.up.Store(true)
+	defer l.up.Store(false)
+	return srv.Serve(ln)
+}
+
+func (l *listener) ready(ctx context.Context) error {
+	if !l.up.Load() {
+		return errNotListening
+	}
+	return nil
+}
+
 type authMessage struct {
 	Type  string `json:"type"`
 	Token string `json:"token"`
 }
 
+// authorize reads the auth message, which the client sends within 5 seconds, and checks it
+// against the hub's rule like the REST servers do. On failure the client gets
+// {"error": ..., "code": 401|403} and the caller closes the connection.
+func authorize(r *http.Request, conn *websocket.Conn, auth authz.Authenticator, rule authz.Rule) (*pkg.MyClaims, error) {
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return nil, err
+	}
+	msg := new(authMessage)
+	err = conn.ReadJSON(msg)
+	if err != nil {
+		err = fmt.Errorf("%w: no auth message: %v", domain.ErrUnauthorized, err)
+	} else if msg.Type != "auth" {
+		err = fmt.Errorf("%w: invalid auth type: %s", domain.ErrUnauthorized, msg.Type)
+	}
+	var claim *pkg.MyClaims
+	if err == nil {
+		claim, err = authz.Authorize(r.Context(), auth, msg.Token, rule, r.PathValue)
+	}
+	if err != nil {
+		conn.WriteJSON(map[string]any{"error": err.Error(), "code": authz.Status(err)})
+		return nil, err
+	}
+	return claim, nil
+}
+
+// writeWait bounds one write to the client, so a stuck connection cannot hold the writer forever
+const writeWait = 10 * time.Second
+
 type myWebSocket struct {
-	once   sync.Once
-	done   chan struct{}
-	sendCh chan any // канал для отправки сообщений
+	sessionID string // auth session of the token, the connection is dropped when it is revoked
+	once      sync.Once
+	done      chan struct{} // closed when the connection ends
+	written   chan struct{} // closed when the writer has returned
+	sendCh    chan any      // канал для отправки сообщений
 }
 
+func newMyWebSocket(sessionID string) *myWebSocket {
+	return &myWebSocket{
+		sessionID: sessionID,
+		done:      make(chan struct{}),
+		written:   make(chan struct{}),
+		sendCh:    make(chan any),
+	}
+}
+
+// safeClose ends the connection. sendCh is never closed: senders and the writer
+// leave on done instead, so a push racing with the close cannot panic.
 func (s *myWebSocket) safeClose() {
 	s.once.Do(func() {
 		close(s.done)
-		time.Sleep(5 * time.Second)
-		close(s.sendCh)
 	})
 }
+
+// writer sends the pushed messages to the client until the connection ends
+func (s *myWebSocket) writer(conn *websocket.Conn) {
+	defer close(s.written)
+	defer s.safeClose()
+	for {
+		select {
+		case <-s.done:
+			return
+		case data := <-s.sendCh:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := conn.WriteJSON(data)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wait blocks until the connection ends and the writer is done with the message it was sending
+// (e.g. session_revoked), after that the caller may close conn
+func (s *myWebSocket) wait() {
+	<-s.done
+	<-s.written
+}
+
+// disconnect drops the connection of userID if it was opened with the revoked session
+func disconnect(clients *sync.Map, userID, sessionID string) {
+	v, ok := clients.Load(userID)
+	if !ok {
+		return
+	}
+	my, ok := v.(*myWebSocket)
+	if !ok || my.sessionID != sessionID {
+		return
+	}
+	go func() {
+		my.pushToChannel(map[string]string{"type": "session_revoked", "error": "session is revoked"})
+		my.safeClose()
+	}()
+}
+
 func (s *myWebSocket) pushToChannel(zat any) {
 	select {
 	case <-s.done:
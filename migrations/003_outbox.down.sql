@@ -0,0 +1,6 @@
+begin;
+
+drop index if exists idx_outbox_pending;
+drop table if exists outbox;
+
+commit;
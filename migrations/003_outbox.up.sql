@@ -0,0 +1,22 @@
+begin;
+
+-- Messages waiting to be published to RabbitMQ.
+-- Written in the same transaction as the ride/driver change, published by the relay.
+create table outbox (
+    id uuid primary key default gen_random_uuid(),
+    created_at timestamptz not null default now(),
+    exchange text not null,
+    routing_key text not null,
+    priority smallint not null default 0 check (priority between 0 and 255),
+    payload jsonb not null,
+    attempts integer not null default 0,
+    last_error text,
+    -- a relay claims a batch until then and publishes it outside any transaction
+    claimed_until timestamptz,
+    sent_at timestamptz
+);
+
+-- Relay only looks at unsent messages
+create index idx_outbox_pending on outbox(created_at) where sent_at is null;
+
+commit;
@@ -0,0 +1,6 @@
+begin;
+
+alter table outbox drop column if exists headers;
+alter table rides drop column if exists correlation_id;
+
+commit;
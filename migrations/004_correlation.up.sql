@@ -0,0 +1,10 @@
+begin;
+
+-- Correlation id minted when the ride was requested, every message about the ride carries it
+alter table rides add column correlation_id text;
+
+-- Correlation id and w3c trace context of the request which wrote the message,
+-- sent as AMQP headers so consumers continue the same trace
+alter table outbox add column headers jsonb not null default '{}'::jsonb;
+
+commit;
@@ -0,0 +1,9 @@
+begin;
+
+drop trigger if exists trg_user_banned on users;
+drop function if exists revoke_banned_user_sessions();
+drop table if exists auth_session_used_hashes;
+drop table if exists auth_sessions;
+drop function if exists notify_session_revoked();
+
+commit;
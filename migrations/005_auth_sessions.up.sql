@@ -0,0 +1,57 @@
+begin;
+
+-- One row per login. The refresh token is rotated on every use, only its sha256 is stored.
+create table auth_sessions (
+    id uuid primary key default gen_random_uuid(),
+    user_id uuid not null references users(id) on delete cascade,
+    created_at timestamptz not null default now(),
+    last_used_at timestamptz not null default now(),
+    expires_at timestamptz not null,
+    refresh_hash text not null unique,
+    revoked_at timestamptz,
+    revoked_reason text
+);
+
+create index idx_auth_sessions_user on auth_sessions(user_id) where revoked_at is null;
+
+-- Every refresh hash a session has rotated away from. Any of them used again means the token
+-- was copied, then the whole session is revoked.
+create table auth_session_used_hashes (
+    refresh_hash text primary key,
+    session_id uuid not null references auth_sessions(id) on delete cascade,
+    used_at timestamptz not null default now()
+);
+
+create index idx_auth_session_used_hashes_session on auth_session_used_hashes(session_id);
+
+-- Services LISTEN on this channel to drop WebSocket connections of revoked sessions
+create function notify_session_revoked() returns trigger as $$
+begin
+    perform pg_notify('auth_session_revoked', json_build_object('user_id', new.user_id, 'session_id', new.id)::text);
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger trg_auth_session_revoked
+    after update of revoked_at on auth_sessions
+    for each row
+    when (old.revoked_at is null and new.revoked_at is not null)
+    execute function notify_session_revoked();
+
+-- Banning a user, however it is done, revokes all of their sessions
+create function revoke_banned_user_sessions() returns trigger as $$
+begin
+    update auth_sessions
+    set revoked_at = now(), revoked_reason = 'BANNED'
+    where user_id = new.id and revoked_at is null;
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger trg_user_banned
+    after update of status on users
+    for each row
+    when (new.status = 'BANNED' and old.status is distinct from 'BANNED')
+    execute function revoke_banned_user_sessions();
+
+commit;
@@ -0,0 +1,6 @@
+begin;
+
+alter table rides drop column if exists tariff_id;
+drop table if exists tariffs;
+
+commit;
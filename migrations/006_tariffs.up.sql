@@ -0,0 +1,42 @@
+begin;
+
+-- Prices per vehicle type. A version is never updated, a new price is a new version;
+-- the version in effect is the latest one with effective_from <= now()
+create table tariffs (
+    id uuid primary key default gen_random_uuid(),
+    created_at timestamptz not null default now(),
+    vehicle_type text not null references "vehicle_type"(value),
+    version integer not null check (version > 0),
+    effective_from timestamptz not null,
+    currency char(3) not null default 'KZT',
+    base_fare decimal(10,2) not null check (base_fare >= 0),
+    rate_per_km decimal(10,2) not null check (rate_per_km >= 0),
+    rate_per_min decimal(10,2) not null check (rate_per_min >= 0),
+    min_fare decimal(10,2) not null default 0 check (min_fare >= 0),
+    booking_fee decimal(10,2) not null default 0 check (booking_fee >= 0),
+    waiting_free_minutes integer not null default 0 check (waiting_free_minutes >= 0),
+    waiting_rate_per_min decimal(10,2) not null default 0 check (waiting_rate_per_min >= 0),
+    priority integer not null default 1 check (priority between 1 and 10),
+    unique (vehicle_type, version)
+);
+
+create index idx_tariffs_effective on tariffs(vehicle_type, effective_from desc);
+
+-- The prices which were hardcoded in the ride service
+insert into
+    tariffs (vehicle_type, version, effective_from, base_fare, rate_per_km, rate_per_min, priority)
+values
+    ('ECONOMY', 1, '1970-01-01', 500, 100, 50, 1),
+    ('PREMIUM', 1, '1970-01-01', 800, 120, 60, 5),
+    ('XL', 1, '1970-01-01', 1000, 150, 75, 10)
+;
+
+-- The tariff version which priced the ride, the meter and the final fare use it too
+alter table rides add column tariff_id uuid references tariffs(id);
+
+update rides r
+set tariff_id = t.id
+from tariffs t
+where t.vehicle_type = r.vehicle_type and t.version = 1;
+
+commit;
@@ -0,0 +1,7 @@
+begin;
+
+-- The ride the driver reported arriving at the pickup of. Start needs it, so a driver
+-- cannot skip Arrived; any status change of the driver clears it
+alter table drivers add column arrived_ride_id uuid references rides(id);
+
+commit;
@@ -1,7 +1,6 @@
 package pkg
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/drone/envsubst"
@@ -14,6 +13,8 @@ type Config struct {
 	RabbitMQCfg  `yaml:"rabbitmq" json:"rabbitmq"`
 	WebSocketCfg `yaml:"websocket" json:"websocket"`
 	ServicesCfg  `yaml:"services" json:"services"`
+	TracingCfg   `yaml:"tracing" json:"tracing"`
+	JWTCfg       `yaml:"jwt" json:"jwt"`
 }
 
 type DatabaseCfg struct {
@@ -32,14 +33,27 @@ type RabbitMQCfg struct {
 }
 
 type WebSocketCfg struct {
-	Port uint16 `yaml:"port" json:"port"`
+	Port       uint16 `yaml:"port" json:"port"`
+	DriverPort uint16 `yaml:"driver_port" json:"driver_port"`
 }
 
 type ServicesCfg struct {
 	Secret                string 
+	QuoteSecret           string // signs fare quotes, shared by the ride service instances
 	RideService           uint16 `yaml:"ride_service" json:"ride_service"`
 	DriverLocationService uint16 `yaml:"driver_location_service" json:"driver_location_service"`
 	AdminService          uint16 `yaml:"admin_service" json:"admin_service"`
+	AuthService           uint16 `yaml:"auth_service" json:"auth_service"`
+}
+
+type TracingCfg struct {
+	Endpoint string `yaml:"endpoint" json:"endpoint"` // OTLP/HTTP collector host:port, empty to disable export
+}
+
+type JWTCfg struct {
+	Issuer  string `yaml:"issuer" json:"issuer"`
+	JWKSURL string `yaml:"jwks_url" json:"jwks_url"` // where verifiers fetch the auth service's public keys
+	KeysDir string `yaml:"keys_dir" json:"keys_dir"` // auth service only, PEM private keys named <kid>.pem
 }
 
 func ParseConfig() (*Config, error) {
@@ -63,6 +77,6 @@ func ParseConfig() (*Config, error) {
 		return nil, err
 	}
 	cfg.ServicesCfg.Secret = os.Getenv("MY_SECRET")
-	fmt.Println(cfg.ServicesCfg.Secret)
+	cfg.ServicesCfg.QuoteSecret = os.Getenv("QUOTE_SECRET")
 	return cfg, nil
 }
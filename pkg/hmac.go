@@ -6,7 +6,9 @@ import (
 	"encoding/hex"
 )
 
-func HashPassword(password string, secret []byte) (string, error) {
+// legacyHash is the old unsalted password hash, keyed by the jwt secret.
+// Only used to check passwords that were not rehashed yet.
+func legacyHash(password string, secret []byte) (string, error) {
 	mac := hmac.New(sha256.New, secret)
 	_, err := mac.Write([]byte(password))
 	if err != nil {
@@ -16,8 +18,8 @@ func HashPassword(password string, secret []byte) (string, error) {
 	return hex.EncodeToString(mac.Sum(nil)), nil
 }
 
-func CheckPassword(password, storedHash string, secret []byte) (bool, error) {
-	hash, err := HashPassword(password, secret)
+func checkLegacy(password, storedHash string, secret []byte) (bool, error) {
+	hash, err := legacyHash(password, secret)
 	if err != nil {
 		return false, err
 	}
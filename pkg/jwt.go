@@ -1,29 +1,55 @@
 package pkg
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// access tokens are short, a session lives on through its rotating refresh token
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
 type RegistrationResponse struct {
-	ID    string `json:"id"`
-	Token string `json:"token"`
+	ID           string `json:"id"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // seconds until the access token expires
 }
 
 type MyClaims struct {
-	UserID string
-	Name   string
-	Email  string
-	Role   string
+	UserID    string
+	Name      string
+	Email     string
+	Role      string
+	SessionID string // auth_sessions.id, checked on every request so revoked sessions stop at once
 	jwt.RegisteredClaims
 }
 
-func ParseTokenMyClaims(tokenStr string, secret []byte) (*MyClaims, error) {
+// ParseTokenMyClaims accepts only EdDSA tokens with a kid, from issuer and for audience.
+// key resolves the kid to the public key it was signed with.
+func ParseTokenMyClaims(tokenStr string, key func(kid string) (ed25519.PublicKey, error), issuer, audience string) (*MyClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &MyClaims{}, func(t *jwt.Token) (any, error) {
-		return secret, nil
-	})
+		kid, _ := t.Header["kid"].(string)
+		if kid == "" {
+			return nil, fmt.Errorf("token has no kid")
+		}
+		return key(kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -35,11 +61,34 @@ func ParseTokenMyClaims(tokenStr string, secret []byte) (*MyClaims, error) {
 	return claims, nil
 }
 
-func GenerateTokenMyClaims(claims *MyClaims, secret []byte) (string, error) {
+// GenerateTokenMyClaims signs the claims with the key kid, valid for AccessTokenTTL
+func GenerateTokenMyClaims(claims *MyClaims, kid string, key ed25519.PrivateKey, issuer string, audience []string) (string, error) {
+	now := time.Now()
 	claims.RegisteredClaims = jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    issuer,
+		Subject:   claims.UserID,
+		Audience:  audience,
+		ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// NewRefreshToken returns an opaque random token and the hash to store for it
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secret)
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken is a plain sha256, refresh tokens are random so they need no salt
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// argon2Params are the current cost parameters, stored inside every hash,
+// so raising them later only rehashes users on their next login
+type argon2Params struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	saltLen uint32
+	keyLen  uint32
+}
+
+var defaultArgon2 = argon2Params{
+	memory:  64 * 1024,
+	time:    3,
+	threads: 2,
+	saltLen: 16,
+	keyLen:  32,
+}
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// dummyHash is a hash with defaultArgon2 of a password nobody has, checked when there is no user,
+// so an unknown email takes as long as a wrong password. Regenerate it when the parameters change.
+const dummyHash = "$argon2id$v=19$m=65536,t=3,p=2$gNfM9UYLGEkAuXP9NSX+wg$esp9ull2doio12SnL4zyn9lwSp467tFyKacSj46aVKI"
+
+// CheckDummyPassword costs what CheckPassword of an existing user does and always fails
+func CheckDummyPassword(password string) {
+	CheckPassword(password, dummyHash, nil)
+}
+
+// HashPassword hashes with argon2id and a random salt, in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	return hashArgon2(password, defaultArgon2)
+}
+
+func hashArgon2(password string, p argon2Params) (string, error) {
+	salt := make([]byte, p.saltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPassword compares password with the stored hash. Legacy HMAC hashes are checked with the secret.
+// rehash is true when the password matched but the hash is legacy or weaker than the current parameters,
+// then the caller should store a fresh HashPassword.
+func CheckPassword(password, storedHash string, secret []byte) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(storedHash, argon2idPrefix) {
+		ok, err = checkLegacy(password, storedHash, secret)
+		return ok, ok, err
+	}
+	p, salt, key, err := decodeArgon2(storedHash)
+	if err != nil {
+		return false, false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+	def := defaultArgon2
+	rehash = p.memory < def.memory || p.time < def.time || p.keyLen < def.keyLen || p.saltLen < def.saltLen
+	return true, rehash, nil
+}
+
+func decodeArgon2(hash string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	if len(parts) != 6 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrInvalidHash, version)
+	}
+	p := new(argon2Params)
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	p.saltLen = uint32(len(salt))
+	p.keyLen = uint32(len(key))
+	// argon2 panics on zero cost
+	if p.time == 0 || p.threads == 0 || p.keyLen == 0 {
+		return nil, nil, nil, ErrInvalidHash
+	}
+	return p, salt, key, nil
+}
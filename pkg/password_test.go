@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testSecret = []byte("jwt-secret")
+
+// replacePart swaps one $-separated part of a PHC string
+func replacePart(hash string, i int, part string) string {
+	parts := strings.Split(hash, "$")
+	parts[i] = part
+	return strings.Join(parts, "$")
+}
+
+// flipFirst changes the first character of the string to another base64 one,
+// the last one may only carry padding bits and decode to the same bytes
+func flipFirst(s string) string {
+	c := byte('A')
+	if s[0] == c {
+		c = 'B'
+	}
+	return string(c) + s[1:]
+}
+
+func TestCheckPassword(t *testing.T) {
+	const password = "correct horse battery staple"
+	current, err := HashPassword(password)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	weak := defaultArgon2
+	weak.memory /= 2
+	weak.time = 1
+	weaker, err := hashArgon2(password, weak)
+	if err != nil {
+		t.Fatalf("hash with weaker parameters: %v", err)
+	}
+	legacy, err := legacyHash(password, testSecret)
+	if err != nil {
+		t.Fatalf("legacy hash: %v", err)
+	}
+	parts := strings.Split(current, "$")
+
+	tests := []struct {
+		name       string
+		password   string
+		hash       string
+		ok, rehash bool
+		err        error
+	}{
+		{"argon2id", password, current, true, false, nil},
+		{"wrong password", "correct horse battery stapler", current, false, false, nil},
+		{"empty password", "", current, false, false, nil},
+		{"weaker parameters", password, weaker, true, true, nil},
+		{"legacy", password, legacy, true, true, nil},
+		{"legacy wrong password", "wrong", legacy, false, false, nil},
+
+		// tampered hashes are well formed but do not match
+		{"tampered key", password, replacePart(current, 5, flipFirst(parts[5])), false, false, nil},
+		{"tampered salt", password, replacePart(current, 4, flipFirst(parts[4])), false, false, nil},
+		{"tampered cost", password, replacePart(current, 3, "m=65536,t=4,p=2"), false, false, nil},
+
+		// malformed ones cannot be checked at all
+		{"missing part", password, strings.TrimSuffix(current, "$"+parts[5]), false, false, ErrInvalidHash},
+		{"extra part", password, current + "$x", false, false, ErrInvalidHash},
+		{"other version", password, replacePart(current, 2, "v=16"), false, false, ErrInvalidHash},
+		{"bad version", password, replacePart(current, 2, "version"), false, false, ErrInvalidHash},
+		{"bad parameters", password, replacePart(current, 3, "m=x,t=3,p=2"), false, false, ErrInvalidHash},
+		{"zero time", password, replacePart(current, 3, "m=65536,t=0,p=2"), false, false, ErrInvalidHash},
+		{"zero threads", password, replacePart(current, 3, "m=65536,t=3,p=0"), false, false, ErrInvalidHash},
+		{"bad salt", password, replacePart(current, 4, "not*base64"), false, false, ErrInvalidHash},
+		{"bad key", password, replacePart(current, 5, "not*base64"), false, false, ErrInvalidHash},
+		{"empty key", password, replacePart(current, 5, ""), false, false, ErrInvalidHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := CheckPassword(tt.password, tt.hash, testSecret)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("ok, rehash = %v, %v, want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestHashPasswordSalted(t *testing.T) {
+	a, err := HashPassword("same password")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	b, err := HashPassword("same password")
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if a == b {
+		t.Errorf("two hashes of the same password are equal, the salt is not random")
+	}
+}
+
+// TestLegacyRehash is the login of a user with a legacy hash: it matches, asks for a rehash,
+// and the new hash works without the secret and needs no further rehash
+func TestLegacyRehash(t *testing.T) {
+	const password = "old password"
+	legacy, err := legacyHash(password, testSecret)
+	if err != nil {
+		t.Fatalf("legacy hash: %v", err)
+	}
+	ok, rehash, err := CheckPassword(password, legacy, testSecret)
+	if err != nil || !ok || !rehash {
+		t.Fatalf("legacy check = %v, %v, %v, want a match to rehash", ok, rehash, err)
+	}
+	ok, _, err = CheckPassword(password, legacy, []byte("another secret"))
+	if err != nil || ok {
+		t.Errorf("legacy hash matched with another secret: %v, %v", ok, err)
+	}
+
+	fresh, err := HashPassword(password)
+	if err != nil {
+		t.Fatalf("rehash: %v", err)
+	}
+	ok, rehash, err = CheckPassword(password, fresh, nil)
+	if err != nil || !ok || rehash {
+		t.Errorf("rehashed check = %v, %v, %v, want a match without rehash", ok, rehash, err)
+	}
+}
+
+// TestDummyHash checks the dummy costs what a current hash does
+func TestDummyHash(t *testing.T) {
+	p, _, _, err := decodeArgon2(dummyHash)
+	if err != nil {
+		t.Fatalf("decode dummy hash: %v", err)
+	}
+	if *p != defaultArgon2 {
+		t.Errorf("dummy hash has %+v, want the current %+v, regenerate it", *p, defaultArgon2)
+	}
+	if !strings.HasPrefix(dummyHash, argon2idPrefix) {
+		t.Errorf("dummy hash is not argon2id")
+	}
+}
@@ -1,8 +1,11 @@
 package pkg
 
 import (
+	"context"
 	"log/slog"
 	"os"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 func CustomSlog(service string) *slog.Logger {
@@ -24,7 +27,7 @@ func CustomSlog(service string) *slog.Logger {
 			return a
 		},
 	})
-	logger := slog.New(handler)
+	logger := slog.New(&contextHandler{handler})
 	host, err := os.Hostname()
 	if err != nil {
 		logger.Error("cant get host name", "error", err)
@@ -32,3 +35,27 @@ func CustomSlog(service string) *slog.Logger {
 	}
 	return logger.With("host", host, "service", service)
 }
+
+// contextHandler adds the correlation id and the trace of ctx to records logged with
+// the *Context methods (InfoContext, ErrorContext...)
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := CorrelationID(ctx); id != "" {
+		r.AddAttrs(slog.String("correlation_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CorrelationHeader is the http header with the correlation id, clients may send their own
+const CorrelationHeader = "X-Correlation-ID"
+
+// headerCorrelationID is the message header, same as domain.HeaderCorrelationID
+const headerCorrelationID = "x-correlation-id"
+
+// maxCorrelationIDLen bounds a client's id, it ends up in every log line, span and message of the request
+const maxCorrelationIDLen = 64
+
+type correlationKey struct{}
+
+// ValidCorrelationID accepts up to 64 letters, digits and dashes, anything else from a client is replaced
+func ValidCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewCorrelationID mints the id at the edge: the trace id when the request is traced, so logs
+// and spans are found by the same id, otherwise a random uuid
+func NewCorrelationID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return uuid.NewString()
+}
+
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the id stored in ctx, empty if none
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Tracer is used for all spans of the project, the service name comes from the provider
+func Tracer() trace.Tracer {
+	return otel.Tracer("taxi-hailing")
+}
+
+// CorrelationAttr is set on spans so all spans of one ride are found by its correlation id
+func CorrelationAttr(id string) attribute.KeyValue {
+	return attribute.String("correlation_id", id)
+}
+
+// InitTracing exports spans of the service over OTLP/HTTP to cfg.Endpoint (e.g. localhost:4318).
+// With empty endpoint spans are not exported, the ids still propagate. Returns the flush on shutdown.
+func InitTracing(ctx context.Context, service string, cfg TracingCfg) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(cfg.Endpoint),
+		otlptracehttp.WithInsecure(),
+		otlptracehttp.WithTimeout(5*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", service))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// InjectHeaders returns the correlation id and the w3c trace context of ctx as message headers
+func InjectHeaders(ctx context.Context) map[string]string {
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	if id := CorrelationID(ctx); id != "" {
+		headers[headerCorrelationID] = id
+	}
+	return headers
+}
+
+// ExtractHeaders continues the trace and the correlation id of the message in ctx
+func ExtractHeaders(ctx context.Context, headers map[string]string) context.Context {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+	return WithCorrelationID(ctx, headers[headerCorrelationID])
+}